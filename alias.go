@@ -0,0 +1,151 @@
+package main
+
+import (
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "math"
+    "strings"
+    "time"
+)
+
+// The maximum number of CNAME or ALIAS records followed when flattening
+const maxAliasChain = 8
+
+// LookupALIAS returns the target of the ALIAS pseudo-record stored for the
+// given name (/foo/bar/.ALIAS), or an empty string if there isn't one. This
+// comes from the same read of the name as its other records.
+func (r *Resolver) LookupALIAS(name string) (target string, ttl uint32, err error) {
+    name = strings.ToLower(name)
+
+    nodes, err := r.lookupRecords(name, ".ALIAS")
+    if err != nil {
+        return
+    }
+
+    if len(nodes) > 1 {
+        err = &RecordValueError{
+            Message: "Multiple ALIAS records is invalid",
+            AttemptedType: dns.TypeNone,
+            Key: r.etcdPrefix + nameToKey(name, "/.ALIAS")}
+    } else if len(nodes) == 1 {
+        target, err = stringValue(nodes[0].node, dns.TypeNone, "target")
+        if err == nil {
+            target = dns.Fqdn(target)
+            ttl = nodes[0].ttl
+        }
+    }
+
+    return
+}
+
+// ResolveALIAS flattens the ALIAS record for the given name (if it has one)
+// into A or AAAA records. The target is resolved from etcd, following any
+// CNAME or ALIAS records along the way, falling back to the configured
+// upstream nameserver. The resulting addresses are returned under the given
+// name, with the lowest TTL seen along the chain.
+func (r *Resolver) ResolveALIAS(name string, qType uint16) (answers []dns.RR, err error) {
+    target, ttl, err := r.LookupALIAS(name)
+    if err != nil || len(target) == 0 {
+        return
+    }
+
+    counter := metrics.GetOrRegisterCounter("resolver.answers.alias", metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    var records []dns.RR
+    for i := 0; i < maxAliasChain && r.inZone(target); i++ {
+        records, err = r.LookupAnswersForType(target, qType)
+        if err != nil || len(records) > 0 {
+            break
+        }
+
+        var cnames []dns.RR
+        cnames, err = r.LookupAnswersForType(target, dns.TypeCNAME)
+        if err != nil {
+            break
+        } else if len(cnames) > 0 {
+            ttl = minTtl(ttl, cnames[0].Header().Ttl)
+            target = cnames[0].(*dns.CNAME).Target
+            continue
+        }
+
+        var next string
+        var nextTtl uint32
+        next, nextTtl, err = r.LookupALIAS(target)
+        if err != nil || len(next) == 0 {
+            break
+        }
+
+        ttl = minTtl(ttl, nextTtl)
+        target = next
+    }
+
+    if err != nil {
+        return nil, err
+    }
+
+    if len(records) == 0 && len(r.aliasUpstream) > 0 {
+        var upstreamTtl uint32
+        records, upstreamTtl, err = r.resolveUpstream(target, qType)
+        if err != nil {
+            return nil, err
+        }
+        ttl = minTtl(ttl, upstreamTtl)
+    }
+
+    answers = make([]dns.RR, 0, len(records))
+    for _, record := range records {
+        rr := dns.Copy(record)
+        rr.Header().Name = name
+        rr.Header().Ttl = minTtl(ttl, record.Header().Ttl)
+        answers = append(answers, rr)
+    }
+
+    return
+}
+
+// resolveUpstream asks the configured upstream nameserver for the records of
+// the given type, returning the lowest TTL of any CNAME records it followed.
+func (r *Resolver) resolveUpstream(name string, qType uint16) (records []dns.RR, ttl uint32, err error) {
+    counter := metrics.GetOrRegisterCounter("resolver.alias.upstream_count", metrics.DefaultRegistry)
+    error_counter := metrics.GetOrRegisterCounter("resolver.alias.upstream_error_count", metrics.DefaultRegistry)
+
+    counter.Inc(1)
+    debugMsg("Querying upstream " + r.aliasUpstream + " for " + name)
+
+    query := new(dns.Msg)
+    query.SetQuestion(name, qType)
+
+    client := &dns.Client{ReadTimeout: r.timeout(2 * time.Second)}
+    response, _, err := client.Exchange(query, r.aliasUpstream)
+
+    // Truncated answers are asked for again over TCP
+    if err == nil && response.Truncated {
+        debugMsg("Retrying truncated answer from upstream over TCP for " + name)
+        client = &dns.Client{Net: "tcp", ReadTimeout: r.timeout(2 * time.Second)}
+        response, _, err = client.Exchange(query, r.aliasUpstream)
+    }
+
+    if err != nil {
+        error_counter.Inc(1)
+        return
+    }
+
+    ttl = math.MaxUint32
+    for _, rr := range response.Answer {
+        if rr.Header().Rrtype == qType {
+            records = append(records, rr)
+        } else if rr.Header().Rrtype == dns.TypeCNAME {
+            ttl = minTtl(ttl, rr.Header().Ttl)
+        }
+    }
+
+    return
+}
+
+func minTtl(a, b uint32) uint32 {
+    if b < a {
+        return b
+    }
+    return a
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+    "fmt"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "strings"
+)
+
+// Policies for answering ANY queries
+const (
+    anyPolicyFull   = "full"        // Every record of every type
+    anyPolicySingle = "single"      // The first RRset found, in anyPreference order
+    anyPolicyHinfo  = "hinfo"       // A synthesized HINFO record (RFC 8482 4.2)
+)
+
+var anyPolicies = map[string]bool{
+    anyPolicyFull: true,
+    anyPolicySingle: true,
+    anyPolicyHinfo: true,
+}
+
+// The order in which record types are considered for the single policy
+var anyPreference = []uint16{
+    dns.TypeCNAME,
+    dns.TypeDNAME,
+    dns.TypeA,
+    dns.TypeAAAA,
+    dns.TypeSRV,
+    dns.TypeTXT,
+    dns.TypePTR,
+    dns.TypeNS,
+    dns.TypeSOA,
+}
+
+func validateAnyPolicy(policy string) error {
+    if !anyPolicies[policy] {
+        return fmt.Errorf("Unknown ANY policy '%s'", policy)
+    }
+    return nil
+}
+
+// isMinimalANY returns true if ANY queries for the given question should get a
+// minimal response rather than every record.
+func isMinimalANY(q dns.Question, anyPolicy string) bool {
+    return q.Qtype == dns.TypeANY && (anyPolicy == anyPolicySingle || anyPolicy == anyPolicyHinfo)
+}
+
+// AnswerMinimalANY answers an ANY query for the given name as described in RFC
+// 8482, without reading every record type from etcd. Names without any records
+// get no answers, so the usual wildcard and negative answers can follow.
+func (r *Resolver) AnswerMinimalANY(name string, anyPolicy string) (answers []dns.RR, err error) {
+    node, err := r.GetNode(name)
+    if err != nil || node == nil {
+        return
+    }
+
+    // Find out which types of record exist, without reading them
+    types := make(map[uint16]bool)
+    for _, child := range node.Nodes {
+        if isRecordKey(child.Key) {
+            segment := child.Key[strings.LastIndex(child.Key, "/") + 2:]
+            if rrType, ok := dns.StringToType[strings.ToUpper(segment)]; ok {
+                if _, ok := converters[rrType]; ok {
+                    types[rrType] = true
+                }
+            }
+        }
+    }
+
+    if len(types) == 0 {
+        return
+    }
+
+    counter := metrics.GetOrRegisterCounter("resolver.answers.any_minimal", metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    if anyPolicy == anyPolicyHinfo {
+        header := dns.RR_Header{Name: name, Class: dns.ClassINET, Rrtype: dns.TypeHINFO, Ttl: r.defaultTtl}
+        return []dns.RR{&dns.HINFO{Hdr: header, Cpu: "RFC8482", Os: ""}}, nil
+    }
+
+    for _, rrType := range anyPreference {
+        if !types[rrType] {
+            continue
+        }
+
+        answers, err = r.LookupAnswersForType(name, rrType)
+        if err != nil || len(answers) > 0 {
+            return
+        }
+    }
+
+    return
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "errors"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/rcrowley/go-metrics"
+    "net/url"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var (
+    ErrDeadlineExceeded = errors.New("Deadline exceeded answering query")
+    ErrBackendOverloaded = errors.New("Too many etcd requests in flight")
+)
+
+// WithDeadline returns a copy of the resolver for answering a single request,
+// which gives up on any etcd requests still in flight once the deadline has
+// passed. The returned function must be called when the request is finished.
+func (r *Resolver) WithDeadline(deadline time.Time) (request *Resolver, done func()) {
+    cancel := make(chan bool)
+    timer := time.AfterFunc(deadline.Sub(time.Now()), func() {
+        close(cancel)
+    })
+
+    copy := *r
+    copy.deadline = deadline
+    copy.cancel = cancel
+
+    return &copy, func() { timer.Stop() }
+}
+
+// expired returns true if the request's deadline has passed
+func (r *Resolver) expired() bool {
+    if r.cancel == nil {
+        return false
+    }
+
+    select {
+    case <-r.cancel:
+        return true
+    default:
+        return false
+    }
+}
+
+// timeout returns how long a backend call may take, which is the given limit
+// unless the request's deadline is sooner.
+func (r *Resolver) timeout(limit time.Duration) time.Duration {
+    if r.deadline.IsZero() {
+        return limit
+    }
+
+    if remaining := r.deadline.Sub(time.Now()); remaining < limit {
+        return remaining
+    }
+
+    return limit
+}
+
+// cancelableGet reads a key from etcd, giving up when the cancel channel is
+// closed. Requests are refused when the configured number of requests are
+// already in flight, to shed load rather than queue up behind a slow etcd.
+func (r *Resolver) cancelableGet(key string, sort bool, recursive bool, cancel <-chan bool) (*etcd.Response, error) {
+    if r.inflight != nil {
+        select {
+        case r.inflight <- true:
+            defer func() { <-r.inflight }()
+        default:
+            shed_counter := metrics.GetOrRegisterCounter("resolver.etcd.shed_count", metrics.DefaultRegistry)
+            shed_counter.Inc(1)
+            return nil, ErrBackendOverloaded
+        }
+    }
+
+    if cancel == nil {
+        return r.etcd.Get(key, sort, recursive)
+    }
+
+    // The etcd client only exposes cancellation for raw requests, which are
+    // built the same way as a Get (discodns always reads consistently)
+    values := url.Values{}
+    values.Set("consistent", "true")
+    values.Set("recursive", strconv.FormatBool(recursive))
+    values.Set("sorted", strconv.FormatBool(sort))
+
+    keyPath := strings.Replace(url.QueryEscape(path.Join("keys", key)), "%2F", "/", -1)
+    if keyPath == "keys" {
+        keyPath = "keys/"
+    }
+
+    raw, err := r.etcd.SendRequest(etcd.NewRawRequest("GET", keyPath + "?" + values.Encode(), nil, cancel))
+    if err == etcd.ErrRequestCancelled {
+        deadline_counter := metrics.GetOrRegisterCounter("resolver.etcd.deadline_exceeded_count", metrics.DefaultRegistry)
+        deadline_counter.Inc(1)
+        return nil, ErrDeadlineExceeded
+    } else if err != nil {
+        return nil, err
+    }
+
+    return raw.Unmarshal()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "net/http"
+    "net/http/httptest"
+    "runtime"
+    "testing"
+    "time"
+)
+
+// newHangingEtcd returns an etcd client for a server that never answers, until
+// the returned function is called
+func newHangingEtcd() (*etcd.Client, func()) {
+    release := make(chan bool)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        select {
+        case <-req.Context().Done():
+        case <-release:
+        }
+    }))
+
+    return etcd.NewClient([]string{server.URL}), func() {
+        close(release)
+        server.Close()
+    }
+}
+
+func TestQueryTimeout(t *testing.T) {
+    client, stop := newHangingEtcd()
+    defer stop()
+
+    handler := newTestHandler(&Resolver{etcd: client, defaultTtl: 300, coalescer: NewCoalescer(100 * time.Millisecond)})
+    handler.queryTimeout = 100 * time.Millisecond
+
+    baseline := runtime.NumGoroutine()
+    counter := metrics.GetOrRegisterCounter("resolver.etcd.deadline_exceeded_count", metrics.DefaultRegistry)
+    before := counter.Count()
+
+    for _, qtype := range []uint16{dns.TypeA, dns.TypeANY} {
+        req := new(dns.Msg)
+        req.SetQuestion("disco.net.", qtype)
+        req.SetEdns0(4096, false)
+
+        writer := &testResponseWriter{}
+        started := time.Now()
+        handler.Handle(writer, req)
+
+        if elapsed := time.Since(started); elapsed > time.Second {
+            t.Error("Expected a prompt response, took ", elapsed)
+        }
+
+        if len(writer.messages) != 1 || writer.messages[0].Rcode != dns.RcodeServerFailure {
+            t.Error("Expected a SERVFAIL response: ", writer.messages)
+            t.Fatal()
+        }
+
+        extendedError, err := unpackExtendedError(writer.written[0])
+        if err != nil || extendedError == nil || extendedError.Code != edeNoReachableAuthority {
+            t.Error("Expected a No Reachable Authority extended error: ", extendedError, err)
+        }
+    }
+
+    if counter.Count() == before {
+        t.Error("Expected the cancelled etcd requests to be counted")
+    }
+
+    // Nothing should be left waiting on etcd
+    for i := 0; i < 100 && runtime.NumGoroutine() > baseline; i++ {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if goroutines := runtime.NumGoroutine(); goroutines > baseline {
+        t.Error("Expected goroutines to return to ", baseline, ", got ", goroutines)
+    }
+}
+
+func TestBackendOverloaded(t *testing.T) {
+    client, stop := newHangingEtcd()
+    defer stop()
+
+    resolver := &Resolver{etcd: client, defaultTtl: 300, inflight: make(chan bool, 1)}
+    counter := metrics.GetOrRegisterCounter("resolver.etcd.shed_count", metrics.DefaultRegistry)
+    before := counter.Count()
+
+    // Fill up the etcd requests allowed in flight
+    resolver.inflight <- true
+    defer func() { <-resolver.inflight }()
+
+    req := new(dns.Msg)
+    req.SetQuestion("disco.net.", dns.TypeA)
+
+    msg, extendedError := resolver.LookupWithError(req, anyPolicyFull)
+    if msg.Rcode != dns.RcodeServerFailure {
+        t.Error("Expected SERVFAIL when etcd is overloaded, got ", dns.RcodeToString[msg.Rcode])
+    }
+
+    if extendedError == nil || extendedError.Detail != ErrBackendOverloaded.Error() {
+        t.Error("Expected the overload to be reported: ", extendedError)
+    }
+
+    if counter.Count() != before + 1 {
+        t.Error("Expected the shed request to be counted")
+    }
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+    "errors"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/rcrowley/go-metrics"
+    "sync"
+    "time"
+)
+
+// Coalescer merges identical etcd reads that are in flight at the same time
+// into a single request, sharing the response with every caller. This stops a
+// thundering herd of queries for the same name from each hitting etcd.
+type Coalescer struct {
+    lock        sync.Mutex
+    reads       map[string]*inflightRead
+    timeout     time.Duration
+}
+
+type inflightRead struct {
+    done        chan bool
+    response    *etcd.Response
+    err         error
+}
+
+// NewCoalescer returns a coalescer whose shared reads give up after the given
+// timeout, or never if it's zero.
+func NewCoalescer(timeout time.Duration) *Coalescer {
+    return &Coalescer{reads: make(map[string]*inflightRead), timeout: timeout}
+}
+
+// Do calls read unless a read with the same id is already in flight, in which
+// case it waits for that read to finish and returns its result instead. The
+// response is shared between callers, so must not be modified.
+//
+// The read runs on its own, with a cancel channel that's closed once the
+// coalescer's timeout passes, so it isn't tied to the deadline of whichever
+// caller started it. Each caller stops waiting when its own cancel channel is
+// closed, leaving the read to finish for the others.
+func (c *Coalescer) Do(id string, read func(cancel <-chan bool) (*etcd.Response, error), cancel <-chan bool) (response *etcd.Response, err error) {
+    c.lock.Lock()
+    inflight, ok := c.reads[id]
+    if ok {
+        counter := metrics.GetOrRegisterCounter("resolver.etcd.coalesced_count", metrics.DefaultRegistry)
+        counter.Inc(1)
+    } else {
+        inflight = &inflightRead{done: make(chan bool)}
+        c.reads[id] = inflight
+        go c.read(id, inflight, read)
+    }
+    c.lock.Unlock()
+
+    select {
+    case <-inflight.done:
+        return inflight.response, inflight.err
+    case <-cancel:
+        return nil, ErrDeadlineExceeded
+    }
+}
+
+// read performs a shared read, and hands the result to everyone waiting on it
+func (c *Coalescer) read(id string, inflight *inflightRead, read func(cancel <-chan bool) (*etcd.Response, error)) {
+    var cancel chan bool
+    if c.timeout > 0 {
+        cancel = make(chan bool)
+        timer := time.AfterFunc(c.timeout, func() {
+            close(cancel)
+        })
+        defer timer.Stop()
+    }
+
+    defer func() {
+        // Nobody can recover a panic in this goroutine, so it's passed on to
+        // the callers as an error instead
+        if rec := recover(); rec != nil {
+            logger.Printf("[ERROR] Panic in coalesced etcd read of %s: %v", id, rec)
+            inflight.response, inflight.err = nil, errors.New("Coalesced etcd read failed")
+        }
+
+        c.lock.Lock()
+        delete(c.reads, id)
+        c.lock.Unlock()
+
+        close(inflight.done)
+    }()
+
+    inflight.response, inflight.err = read(cancel)
+}
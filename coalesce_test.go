@@ -0,0 +1,178 @@
+package main
+
+import (
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/rcrowley/go-metrics"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestCoalescerSharesInflightReads(t *testing.T) {
+    coalescer := NewCoalescer(0)
+    counter := metrics.GetOrRegisterCounter("resolver.etcd.coalesced_count", metrics.DefaultRegistry)
+    before := counter.Count()
+
+    release := make(chan bool)
+    reads := 0
+    read := func(cancel <-chan bool) (*etcd.Response, error) {
+        reads++
+        <-release
+        return &etcd.Response{EtcdIndex: 42}, nil
+    }
+
+    // Start the first read, and wait for the rest to queue up behind it
+    callers := 10
+    responses := make(chan *etcd.Response, callers)
+    wg := sync.WaitGroup{}
+    wg.Add(callers)
+    for i := 0; i < callers; i++ {
+        go func() {
+            defer wg.Done()
+            response, err := coalescer.Do("/net/disco", read, nil)
+            if err != nil {
+                t.Error("Unexpected error: ", err)
+            }
+            responses <- response
+        }()
+    }
+
+    for counter.Count() - before < int64(callers - 1) {
+        time.Sleep(time.Millisecond)
+    }
+
+    close(release)
+    wg.Wait()
+    close(responses)
+
+    if reads != 1 {
+        t.Error("Expected a single read, got ", reads)
+    }
+
+    for response := range responses {
+        if response == nil || response.EtcdIndex != 42 {
+            t.Error("Expected every caller to share the response: ", response)
+        }
+    }
+
+    // Once the read has finished, the next one goes to etcd again
+    coalescer.Do("/net/disco", func(cancel <-chan bool) (*etcd.Response, error) {
+        reads++
+        return nil, nil
+    }, nil)
+
+    if reads != 2 {
+        t.Error("Expected a second read after the first finished, got ", reads)
+    }
+}
+
+func TestCoalescerSeparatesKeys(t *testing.T) {
+    coalescer := NewCoalescer(0)
+
+    release := make(chan bool)
+    started := make(chan bool)
+    go coalescer.Do("/net/disco", func(cancel <-chan bool) (*etcd.Response, error) {
+        started <- true
+        <-release
+        return nil, nil
+    }, nil)
+    <-started
+
+    // A read for another key isn't held up by the first
+    done := false
+    coalescer.Do("/net/disco/foo", func(cancel <-chan bool) (*etcd.Response, error) {
+        done = true
+        return nil, nil
+    }, nil)
+
+    if !done {
+        t.Error("Expected the read for a different key to happen")
+    }
+
+    close(release)
+}
+
+func TestCoalescerPanickingRead(t *testing.T) {
+    coalescer := NewCoalescer(0)
+
+    _, err := coalescer.Do("/net/disco", func(cancel <-chan bool) (*etcd.Response, error) {
+        panic("boom")
+    }, nil)
+
+    if err == nil {
+        t.Error("Expected an error from the panicking read")
+    }
+
+    // The failed read shouldn't be left in flight
+    response, err := coalescer.Do("/net/disco", func(cancel <-chan bool) (*etcd.Response, error) {
+        return &etcd.Response{EtcdIndex: 1}, nil
+    }, nil)
+
+    if err != nil || response == nil {
+        t.Error("Expected a new read after the panic: ", err)
+    }
+}
+
+func TestCoalescerCallerCancelled(t *testing.T) {
+    coalescer := NewCoalescer(0)
+
+    release := make(chan bool)
+    started := make(chan bool)
+    read := func(cancel <-chan bool) (*etcd.Response, error) {
+        started <- true
+        <-release
+        return &etcd.Response{EtcdIndex: 42}, nil
+    }
+
+    // The caller that started the read gives up on it
+    cancel := make(chan bool)
+    first := make(chan error)
+    go func() {
+        _, err := coalescer.Do("/net/disco", read, cancel)
+        first <- err
+    }()
+    <-started
+
+    counter := metrics.GetOrRegisterCounter("resolver.etcd.coalesced_count", metrics.DefaultRegistry)
+    before := counter.Count()
+
+    second := make(chan *etcd.Response)
+    go func() {
+        response, _ := coalescer.Do("/net/disco", read, nil)
+        second <- response
+    }()
+
+    for counter.Count() == before {
+        time.Sleep(time.Millisecond)
+    }
+
+    close(cancel)
+    if err := <-first; err != ErrDeadlineExceeded {
+        t.Error("Expected the cancelled caller to stop waiting: ", err)
+    }
+
+    // The read carries on for everyone else
+    close(release)
+    if response := <-second; response == nil || response.EtcdIndex != 42 {
+        t.Error("Expected the other caller to get the response: ", response)
+    }
+}
+
+func TestCoalescerTimeout(t *testing.T) {
+    coalescer := NewCoalescer(50 * time.Millisecond)
+
+    // The shared read is cancelled after the coalescer's timeout, even though
+    // the caller would wait for it forever
+    _, err := coalescer.Do("/net/disco", func(cancel <-chan bool) (*etcd.Response, error) {
+        select {
+        case <-cancel:
+            return nil, ErrDeadlineExceeded
+        case <-time.After(time.Second):
+            return &etcd.Response{}, nil
+        }
+    }, nil)
+
+    if err != ErrDeadlineExceeded {
+        t.Error("Expected the shared read to time out: ", err)
+    }
+}
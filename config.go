@@ -0,0 +1,246 @@
+package main
+
+import (
+    "fmt"
+    "github.com/BurntSushi/toml"
+    "github.com/jessevdk/go-flags"
+    "io"
+    "os"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// configValue is a value from the config file, which is either a single value
+// or an array of them
+type configValue struct {
+    values      []string
+    array       bool
+    boolean     bool    // Every value is a boolean
+}
+
+// parseOptions parses the command line arguments, along with the config file
+// they name (if any). Options given on the command line take precedence over
+// those in the config file, which take precedence over the defaults.
+//
+// Boolean options may be given a value on the command line (--debug=false), so
+// those turned on in the config file can be turned off again.
+func parseOptions(args []string, parserOptions flags.Options) (options *CommandOptions, err error) {
+    args, bools := splitBoolArgs(args)
+
+    options = &CommandOptions{}
+    if _, err = flags.NewParser(options, parserOptions).ParseArgs(args); err != nil || len(options.Config) == 0 {
+        setBoolArgs(options, bools)
+        return
+    }
+
+    filename := options.Config
+    config, err := readConfigFile(filename)
+    if err != nil {
+        return nil, err
+    }
+
+    // The config file replaces the defaults, so it's only used for the
+    // options that aren't on the command line
+    options = &CommandOptions{}
+    parser := flags.NewParser(options, parserOptions)
+    if err = setConfigDefaults(parser, filename, config); err != nil {
+        return nil, err
+    }
+
+    _, err = parser.ParseArgs(args)
+    setBoolArgs(options, bools)
+    return
+}
+
+// splitBoolArgs removes the boolean options given a value (e.g --debug=false)
+// from the arguments, since go-flags doesn't allow a value for them. The
+// values are returned by the index of the option's field.
+func splitBoolArgs(args []string) (rest []string, bools map[int]bool) {
+    fields := make(map[string]int)
+    t := reflect.TypeOf(CommandOptions{})
+    for i := 0; i < t.NumField(); i++ {
+        if t.Field(i).Type.Kind() == reflect.Bool {
+            fields[t.Field(i).Tag.Get("long")] = i
+        }
+    }
+
+    rest = make([]string, 0, len(args))
+    bools = make(map[int]bool)
+    for i, arg := range args {
+        if arg == "--" {
+            return append(rest, args[i:]...), bools
+        }
+
+        separator := strings.Index(arg, "=")
+        if strings.HasPrefix(arg, "--") && separator > 0 {
+            field, ok := fields[arg[2:separator]]
+            if value := arg[separator + 1:]; ok && (value == "true" || value == "false") {
+                bools[field] = value == "true"
+                continue
+            }
+        }
+
+        rest = append(rest, arg)
+    }
+
+    return
+}
+
+// setBoolArgs sets the boolean options returned by splitBoolArgs
+func setBoolArgs(options *CommandOptions, bools map[int]bool) {
+    v := reflect.ValueOf(options).Elem()
+    for field, value := range bools {
+        v.Field(field).SetBool(value)
+    }
+}
+
+// readConfigFile reads the options in a config file
+func readConfigFile(filename string) (config map[string]*configValue, err error) {
+    f, err := os.Open(filename)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to read the config file: %s", err)
+    }
+    defer f.Close()
+
+    return parseConfig(f, filename)
+}
+
+// parseConfig reads options from a TOML file, with a key for each option
+// named after its command line flag (e.g default-ttl or default_ttl). The
+// options are a flat list, so they must all be at the top level of the file,
+// and each must be a string, number, boolean or an array of them.
+//
+//     default-ttl = 300
+//     debug = true
+//     reject = ["disco.net:AAAA", "legacy.disco.net: action=refused"]
+func parseConfig(r io.Reader, filename string) (config map[string]*configValue, err error) {
+    var values map[string]interface{}
+    metadata, err := toml.DecodeReader(r, &values)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", filename, err)
+    }
+
+    // Walk the keys in the order they're given, so errors are reported for
+    // the first of them
+    config = make(map[string]*configValue)
+    keys := make(map[string]string)
+    for _, key := range metadata.Keys() {
+        if len(key) > 1 {
+            continue
+        }
+
+        name := strings.Replace(key[0], "_", "-", -1)
+        if previous, ok := keys[name]; ok {
+            return nil, fmt.Errorf("%s: Duplicate option %s (set as both %s and %s)", filename, name, previous, key[0])
+        }
+        keys[name] = key[0]
+
+        parsed, err := parseConfigValue(values[key[0]])
+        if err != nil {
+            return nil, fmt.Errorf("%s: Invalid value for %s: %s", filename, key[0], err)
+        }
+
+        config[name] = parsed
+    }
+
+    return
+}
+
+// parseConfigValue converts a decoded value, or an array of them, to the
+// strings they'd be given as on the command line
+func parseConfigValue(value interface{}) (parsed *configValue, err error) {
+    parsed = &configValue{boolean: true}
+    elements, ok := value.([]interface{})
+    if !ok {
+        elements = []interface{}{value}
+    } else {
+        parsed.array = true
+    }
+
+    parsed.values = make([]string, 0, len(elements))
+    for _, element := range elements {
+        var v string
+        switch element := element.(type) {
+        case string:
+            v = element
+        case int64:
+            v = strconv.FormatInt(element, 10)
+        case float64:
+            v = strconv.FormatFloat(element, 'g', -1, 64)
+        case bool:
+            v = strconv.FormatBool(element)
+        case []interface{}:
+            return nil, fmt.Errorf("Nested arrays aren't supported")
+        case map[string]interface{}, []map[string]interface{}:
+            return nil, fmt.Errorf("Tables aren't supported, options must be at the top level")
+        default:
+            return nil, fmt.Errorf("Unexpected %v (expected a string, number or boolean)", element)
+        }
+
+        if _, ok := element.(bool); !ok {
+            parsed.boolean = false
+        }
+
+        parsed.values = append(parsed.values, v)
+    }
+
+    return
+}
+
+// setConfigDefaults uses the values in the config file as the defaults of the
+// parser's options, checking that every value is valid for its option
+func setConfigDefaults(parser *flags.Parser, filename string, config map[string]*configValue) error {
+    options := make(map[string]*flags.Option)
+    var addOptions func(group *flags.Group)
+    addOptions = func(group *flags.Group) {
+        for _, option := range group.Options() {
+            options[option.LongName] = option
+        }
+        for _, child := range group.Groups() {
+            addOptions(child)
+        }
+    }
+    addOptions(parser.Command.Group)
+
+    names := make([]string, 0, len(config))
+    for name := range config {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    // Check the values by parsing them as arguments, so they're converted
+    // (and any errors reported) in the same way
+    args := make([]string, 0)
+    for _, name := range names {
+        value := config[name]
+        option, ok := options[name]
+        if !ok || name == "config" {
+            return fmt.Errorf("%s: Unknown option %s", filename, name)
+        }
+
+        kind := reflect.TypeOf(option.Value()).Kind()
+        if value.array && kind != reflect.Slice {
+            return fmt.Errorf("%s: Option %s takes a single value, not an array", filename, name)
+        }
+
+        if kind == reflect.Bool {
+            if !value.boolean {
+                return fmt.Errorf("%s: Option %s must be true or false", filename, name)
+            }
+        } else {
+            for _, v := range value.values {
+                args = append(args, "--" + name + "=" + v)
+            }
+        }
+
+        option.Default = value.values
+    }
+
+    if _, err := flags.NewParser(&CommandOptions{}, flags.None).ParseArgs(args); err != nil {
+        return fmt.Errorf("%s: %s", filename, err)
+    }
+
+    return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+    "github.com/jessevdk/go-flags"
+    "io/ioutil"
+    "os"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+// writeConfigFile writes a temporary config file, which the caller must remove
+func writeConfigFile(t *testing.T, config string) string {
+    f, err := ioutil.TempFile("", "discodns-config")
+    if err != nil {
+        t.Error("Unable to create a config file: ", err)
+        t.Fatal()
+    }
+    defer f.Close()
+
+    f.WriteString(config)
+    return f.Name()
+}
+
+func TestParseConfig(t *testing.T) {
+    config, err := parseConfig(strings.NewReader(`
+# Comments and blank lines are ignored
+listen = "127.0.0.1"    # As are comments after values
+port = 5_353
+debug = true
+soa_serial = 'date'
+identity-id = "ns1 \"disco\"\t# not a comment"
+identity-version = """
+1.0"""
+client-rate = 0.5
+reject = [
+    "disco.net:AAAA",   # IPv6 isn't ready yet
+    'legacy.disco.net: action=refused',
+]
+accept = []
+etcd = ["127.0.0.1:4001", "127.0.0.2:4001"]
+`), "test.conf")
+
+    if err != nil {
+        t.Error("Unexpected error parsing the config: ", err)
+        t.Fatal()
+    }
+
+    var expected = map[string][]string {
+        "listen": []string{"127.0.0.1"},
+        "port": []string{"5353"},
+        "debug": []string{"true"},
+        "soa-serial": []string{"date"},
+        "identity-id": []string{"ns1 \"disco\"\t# not a comment"},
+        "identity-version": []string{"1.0"},
+        "client-rate": []string{"0.5"},
+        "reject": []string{"disco.net:AAAA", "legacy.disco.net: action=refused"},
+        "accept": []string{},
+        "etcd": []string{"127.0.0.1:4001", "127.0.0.2:4001"},
+    }
+
+    if len(config) != len(expected) {
+        t.Error("Expected ", len(expected), " options, got ", len(config))
+    }
+
+    for name, values := range expected {
+        if value, ok := config[name]; !ok || !reflect.DeepEqual(value.values, values) {
+            t.Error("Expected ", values, " for ", name, ", got ", value)
+        }
+    }
+
+    if !config["reject"].array || config["port"].array || !config["debug"].boolean || config["soa-serial"].boolean {
+        t.Error("Unexpected details for the options: ", config["reject"], config["port"], config["debug"])
+    }
+}
+
+func TestParseInvalidConfig(t *testing.T) {
+    var expected = []struct {
+        config      string
+        err         string
+    } {
+        {"listen = 127.0.0.1", "test.conf: Near line 1"},
+        {"\nlisten", "test.conf: Near line"},
+        {"[server]\nlisten = \"127.0.0.1\"", "test.conf: Invalid value for server: Tables aren't supported"},
+        {"[[servers]]\nlisten = \"127.0.0.1\"", "test.conf: Invalid value for servers: Tables aren't supported"},
+        {"port = 53\nport = 54", "test.conf: Near line 2"},
+        {"default_ttl = 60\ndefault-ttl = 60", "test.conf: Duplicate option default-ttl (set as both default_ttl and default-ttl)"},
+        {"listen = \"127.0.0.1", "test.conf: Near line 1"},
+        {"reject = [\"disco.net:\",\n", "test.conf: Near line 1"},
+        {"reject = [[\"disco.net:\"]]", "test.conf: Invalid value for reject: Nested arrays"},
+        {"listen = 1979-05-27T07:32:00Z", "test.conf: Invalid value for listen: Unexpected"},
+    }
+
+    for _, e := range expected {
+        _, err := parseConfig(strings.NewReader(e.config), "test.conf")
+        if err == nil || !strings.HasPrefix(err.Error(), e.err) {
+            t.Error("Expected the error ", e.err, " for ", e.config, ", got ", err)
+        }
+    }
+}
+
+func TestParseOptionsWithConfig(t *testing.T) {
+    filename := writeConfigFile(t, `
+port = 5353
+debug = true
+default-ttl = 60
+reject = ["disco.net:AAAA", "disco.org:AAAA"]
+accept = ["disco.net:"]
+`)
+    defer os.Remove(filename)
+
+    options, err := parseOptions([]string{"--config", filename, "--default-ttl", "30", "--reject", "disco.io:"}, flags.None)
+    if err != nil {
+        t.Error("Unexpected error parsing the options: ", err)
+        t.Fatal()
+    }
+
+    // Options on the command line take precedence, replacing whole lists, and
+    // those in neither keep their defaults
+    if options.ListenPort != 5353 || !options.Debug || options.DefaultTtl != 30 {
+        t.Error("Unexpected options: ", options.ListenPort, options.Debug, options.DefaultTtl)
+    }
+
+    if !reflect.DeepEqual(options.Reject, []string{"disco.io:"}) || !reflect.DeepEqual(options.Accept, []string{"disco.net:"}) {
+        t.Error("Unexpected filters: ", options.Reject, options.Accept)
+    }
+
+    if options.ListenAddress != "0.0.0.0" || options.AnyPolicy != "hinfo" {
+        t.Error("Expected the defaults to be kept: ", options.ListenAddress, options.AnyPolicy)
+    }
+
+    // Booleans turned on in the config file can be turned off again
+    options, err = parseOptions([]string{"--config", filename, "--debug=false"}, flags.None)
+    if err != nil || options.Debug || options.ListenPort != 5353 {
+        t.Error("Expected --debug=false to override the config file: ", options, err)
+    }
+
+    // Without a config file the defaults are used as usual
+    options, err = parseOptions([]string{"--port", "5353"}, flags.None)
+    if err != nil || options.ListenPort != 5353 || options.DefaultTtl != 300 || options.Debug {
+        t.Error("Unexpected options without a config file: ", options, err)
+    }
+}
+
+func TestParseOptionsInvalidConfig(t *testing.T) {
+    var expected = []struct {
+        config      string
+        err         string
+    } {
+        {"port = \"fifty-three\"", "--port' (expected int)"},
+        {"listen-on = \"127.0.0.1\"", ": Unknown option listen-on"},
+        {"\nconfig = \"other.conf\"", ": Unknown option config"},
+        {"debug = 1", ": Option debug must be true or false"},
+        {"debug = \"true\"", ": Option debug must be true or false"},
+        {"listen = [\"127.0.0.1\", \"::1\"]", ": Option listen takes a single value"},
+    }
+
+    for _, e := range expected {
+        filename := writeConfigFile(t, e.config)
+        _, err := parseOptions([]string{"--config", filename}, flags.None)
+        os.Remove(filename)
+
+        if err == nil || !strings.Contains(err.Error(), e.err) {
+            t.Error("Expected the error ", e.err, " for ", e.config, ", got ", err)
+        }
+    }
+
+    if _, err := parseOptions([]string{"--debug=maybe"}, flags.None); err == nil {
+        t.Error("Expected an error for a boolean option that isn't true or false")
+    }
+
+    if _, err := parseOptions([]string{"--config", "/does/not/exist.conf"}, flags.None); err == nil {
+        t.Error("Expected an error for a missing config file")
+    }
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+// startDebugServer serves the given debugging endpoints over HTTP in the
+// background, for example /debug/filters lists the query filters in use.
+func startDebugServer(addr string, handlers map[string]http.Handler) {
+    mux := http.NewServeMux()
+    for path, handler := range handlers {
+        mux.Handle(path, handler)
+    }
+
+    go func() {
+        logger.Printf("Serving debug endpoints on %s\n", addr)
+        if err := http.ListenAndServe(addr, mux); err != nil {
+            logger.Printf("[ERROR] Unable to serve debug endpoints: %s", err)
+        }
+    }()
+}
+
+// writeJSON writes the value to the response as indented JSON
+func writeJSON(w http.ResponseWriter, value interface{}) {
+    body, err := json.MarshalIndent(value, "", "  ")
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(append(body, '\n'))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "strings"
+)
+
+// The maximum number of DNAME redirections followed for a single query
+const maxDNAMEChain = 8
+
+// FindDNAME looks for a DNAME record at any ancestor of the given name. The
+// DNAME closest to the root wins, since it occludes anything beneath it. The
+// ancestors are read through the request's name cache (as for SOA records and
+// wildcards), walking up from the name's parent and stopping at its zone apex,
+// which is either the zone it's in (when we know the zones) or the first
+// ancestor with an SOA record.
+func (r *Resolver) FindDNAME(name string) (dname *dns.DNAME, err error) {
+    name = strings.ToLower(dns.Fqdn(name))
+    labels := dns.SplitDomainName(name)
+
+    // The ancestors run from the parent of the name up to the top level
+    // domain (or zone apex)
+    top := len(labels) - 1
+    if r.zones != nil {
+        zone, ok := r.zones.ZoneFor(name)
+        if !ok {
+            return
+        }
+
+        if apex := len(labels) - dns.CountLabel(zone); apex < top {
+            top = apex
+        }
+    }
+
+    for i := 1; i <= top; i++ {
+        owner := dns.Fqdn(strings.Join(labels[i:], "."))
+
+        node, err := r.GetNode(owner)
+        if err != nil {
+            return nil, err
+        } else if node == nil {
+            continue
+        }
+
+        records, err := r.recordsFromNode(node, ".DNAME")
+        if err != nil {
+            return nil, err
+        }
+
+        answers, err := r.convertRecords(owner, dns.TypeDNAME, records)
+        if err != nil {
+            return nil, err
+        }
+
+        if len(answers) > 1 {
+            return nil, &RecordValueError{
+                Message: "Multiple DNAME records is invalid",
+                AttemptedType: dns.TypeDNAME,
+                Key: r.etcdPrefix + nameToKey(owner, "/.DNAME")}
+        } else if len(answers) == 1 {
+            // Keep going, in case a DNAME further up occludes this one
+            dname = answers[0].(*dns.DNAME)
+        }
+
+        if isZoneApex(node) {
+            break
+        }
+    }
+
+    return
+}
+
+// isZoneApex returns true if the given node has an SOA record
+func isZoneApex(node *etcd.Node) bool {
+    for _, child := range node.Nodes {
+        if strings.HasSuffix(child.Key, "/.SOA") {
+            return true
+        }
+    }
+
+    return false
+}
+
+// synthesizeCNAME returns the CNAME record implied by the given DNAME for a
+// name beneath its owner, as described in RFC 6672 section 3.
+func synthesizeCNAME(name string, dname *dns.DNAME) (cname *dns.CNAME, err error) {
+    owner := dname.Header().Name
+    prefix := name[:len(name) - len(owner)]
+    target := prefix + dname.Target
+
+    if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+        return nil, &NameTooLongError{Name: target}
+    }
+
+    header := dns.RR_Header{Name: name, Class: dns.ClassINET, Rrtype: dns.TypeCNAME, Ttl: dname.Header().Ttl}
+    cname = &dns.CNAME{Hdr: header, Target: target}
+
+    return
+}
+
+// RedirectDNAME answers the given question for names that exist beneath a
+// DNAME record. The DNAME and synthesized CNAME records are returned, followed
+// by the answers for the target name when it can be resolved from etcd.
+// Targets that are themselves beneath another DNAME are followed too. When the
+// synthesized name would be too long, the DNAME records are returned with a
+// NameTooLongError.
+func (r *Resolver) RedirectDNAME(q dns.Question, anyPolicy string) (answers []dns.RR, err error) {
+    name := dns.Fqdn(q.Name)
+
+    for i := 0; i < maxDNAMEChain; i++ {
+        dname, err := r.FindDNAME(name)
+        if err != nil || dname == nil {
+            return answers, err
+        }
+
+        cname, err := synthesizeCNAME(name, dname)
+        if err != nil {
+            return append(answers, dname), err
+        }
+
+        counter := metrics.GetOrRegisterCounter("resolver.answers.dname", metrics.DefaultRegistry)
+        counter.Inc(1)
+
+        answers = append(answers, dname, cname)
+        if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeDNAME {
+            return answers, nil
+        }
+
+        // Chase the synthesized name in case we're authoritative for it
+        name = cname.Target
+        if !r.inZone(name) {
+            return answers, nil
+        }
+
+        records, err := r.AnswerTarget(name, q, anyPolicy)
+        if err != nil {
+            return nil, err
+        }
+
+        if len(records) > 0 {
+            return append(answers, records...), nil
+        }
+    }
+
+    debugMsg("Too many DNAME redirections for ", q.Name)
+    return
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+    "errors"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "net"
+)
+
+// The EDNS0 option code for Extended DNS Errors (RFC 8914)
+const edeOptionCode = 15
+
+// Extended DNS Error info codes (RFC 8914 section 4)
+const (
+    edeOther                = 0
+    edeForgedAnswer         = 4
+    edeNotReady             = 14
+    edeBlocked              = 15
+    edeProhibited           = 18
+    edeNoReachableAuthority = 22
+    edeNetworkError         = 23
+    edeInvalidData          = 24
+)
+
+// The go-etcd error code used when none of the etcd peers could be reached
+const etcdNotReachable = 501
+
+// ExtendedError describes why a query failed, and is sent to clients as an
+// Extended DNS Error option (RFC 8914) if they support EDNS.
+type ExtendedError struct {
+    Code        uint16
+    Text        string      // Sent to every client, usually the offending key
+    Detail      string      // Only sent to clients within the verbose networks
+}
+
+// extendedErrorFor returns an extended error describing the given error from
+// looking up or converting records.
+func extendedErrorFor(err error) *ExtendedError {
+    extendedError := &ExtendedError{Code: edeOther, Detail: err.Error()}
+
+    if err == ErrDeadlineExceeded {
+        extendedError.Code = edeNoReachableAuthority
+        return extendedError
+    }
+
+    if err == ErrZonesNotReady {
+        extendedError.Code = edeNotReady
+        return extendedError
+    }
+
+    switch e := err.(type) {
+    case *NodeConversionError:
+        extendedError.Code = edeInvalidData
+        if e.Node != nil {
+            extendedError.Text = e.Node.Key
+        }
+    case *RecordValueError:
+        extendedError.Code = edeInvalidData
+        extendedError.Text = e.Key
+    case *etcd.EtcdError:
+        if e.ErrorCode == etcdNotReachable {
+            extendedError.Code = edeNoReachableAuthority
+        } else {
+            extendedError.Code = edeNetworkError
+            extendedError.Text = e.Cause
+        }
+    case net.Error:
+        extendedError.Code = edeNetworkError
+    }
+
+    return extendedError
+}
+
+// ExtraText returns the EXTRA-TEXT field of the option, including the full
+// error for verbose clients.
+func (e *ExtendedError) ExtraText(verbose bool) string {
+    if verbose && len(e.Detail) > 0 {
+        if len(e.Text) > 0 {
+            return e.Text + ": " + e.Detail
+        }
+        return e.Detail
+    }
+
+    return e.Text
+}
+
+// packExtendedError packs the message with an Extended DNS Error option in its
+// OPT record. The vendored dns library doesn't know about the option, so it's
+// appended to the packed OPT record, which is always placed last.
+func packExtendedError(msg *dns.Msg, req *dns.Msg, extendedError *ExtendedError, verbose bool) (buf []byte, err error) {
+    if req.IsEdns0() == nil {
+        return nil, errors.New("Extended DNS Errors require EDNS")
+    }
+
+    opt := responseOpt(req, msg)
+
+    // Move the OPT record to the end of the message
+    packed := *msg
+    packed.Extra = make([]dns.RR, 0, len(msg.Extra))
+    for _, rr := range msg.Extra {
+        if rr.Header().Rrtype != dns.TypeOPT {
+            packed.Extra = append(packed.Extra, rr)
+        }
+    }
+
+    // The OPT record starts where the message without it ends, since the root
+    // name it's owned by is never compressed
+    head, err := packed.Pack()
+    if err != nil {
+        return
+    }
+
+    packed.Extra = append(packed.Extra, opt)
+    buf, err = packed.Pack()
+    if err != nil {
+        return
+    }
+
+    text := extendedError.ExtraText(verbose)
+    option := make([]byte, 6, 6 + len(text))
+    option[0], option[1] = byte(edeOptionCode >> 8), byte(edeOptionCode)
+    option[2], option[3] = byte((2 + len(text)) >> 8), byte(2 + len(text))
+    option[4], option[5] = byte(extendedError.Code >> 8), byte(extendedError.Code)
+    option = append(option, text...)
+
+    if len(buf) + len(option) > dns.MaxMsgSize - 1 {
+        return nil, errors.New("Extended DNS Error text is too long")
+    }
+
+    // Skip the name, type, class and ttl to find the RDLENGTH of the OPT record
+    off := len(head) + 9
+    rdlength := (int(buf[off]) << 8 | int(buf[off + 1])) + len(option)
+    buf[off], buf[off + 1] = byte(rdlength >> 8), byte(rdlength)
+
+    return append(buf, option...), nil
+}
+
+// addrInNetworks returns true if the address is within any of the networks
+func addrInNetworks(addr net.Addr, networks []*net.IPNet) bool {
+    ip := addrIP(addr)
+    if ip == nil {
+        return false
+    }
+
+    for _, network := range networks {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// addrIP returns the IP address of a client, or nil if it doesn't have one
+func addrIP(addr net.Addr) net.IP {
+    switch a := addr.(type) {
+    case *net.UDPAddr:
+        return a.IP
+    case *net.TCPAddr:
+        return a.IP
+    }
+
+    return nil
+}
@@ -24,6 +24,7 @@ func (e *NodeConversionError) Error() string {
 type RecordValueError struct {
     Message string
     AttemptedType uint16
+    Key string
 }
 func (e *RecordValueError) Error() string {
     return fmt.Sprintf(
@@ -31,3 +32,12 @@ func (e *RecordValueError) Error() string {
         e.AttemptedType,
         e.Message)
 }
+
+type NameTooLongError struct {
+    Name string
+}
+func (e *NameTooLongError) Error() string {
+    return fmt.Sprintf(
+        "Synthesized name %s is too long",
+        e.Name)
+}
@@ -1,70 +1,687 @@
 package main
 
 import (
+    "fmt"
+    "github.com/coreos/go-etcd/etcd"
     "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "hash/fnv"
+    "net"
+    "net/http"
+    "path"
+    "regexp"
     "strings"
+    "sync"
+)
+
+// Transports that queries can be filtered on
+var filterTransports = map[string]bool{"udp": true, "tcp": true}
+
+// Valid names for filters, which are used in metric names
+var filterNamePattern = regexp.MustCompile("^[A-Za-z0-9_-]+$")
+
+// Actions taken for queries that are rejected by a filter
+const (
+    filterActionNXDomain    = "nxdomain"    // NXDOMAIN, with the SOA of the zone
+    filterActionRefused     = "refused"     // REFUSED
+    filterActionDrop        = "drop"        // No response at all
+    filterActionSinkhole    = "sinkhole"    // A fixed A, AAAA or CNAME record
 )
 
 type QueryFilter struct {
     domain          string
+    exact           bool        // Only match the domain itself, not its subdomains
     qTypes          []string
+
+    // Patterns matched against the query name instead of the domain, either
+    // the labels of a glob (e.g *.canary.*.svc.) or an anchored regex
+    glob            []string
+    regex           *regexp.Regexp
+
+    // Only match queries from clients within these networks (if any), and not
+    // within the excluded networks
+    clients         []*net.IPNet
+    excludedClients []*net.IPNet
+    transports      []string
+
+    // What to do with rejected queries, and the address or name to answer
+    // with for the sinkhole action
+    action          string
+    sinkholeIP      net.IP
+    sinkholeTarget  string
+
+    // Filters in dry run mode only count and log the queries they match,
+    // without accepting or rejecting them
+    name            string
+    dryRun          bool
+    hits            metrics.Counter
 }
 
 type QueryFilterer struct {
-    acceptFilters   []QueryFilter
-    rejectFilters   []QueryFilter
+    lock            sync.RWMutex
+    accept          []QueryFilter
+    reject          []QueryFilter
+    acceptFilters   *filterTrie
+    rejectFilters   *filterTrie
+    acceptEnforced  bool        // False if every accept filter is in dry run mode
+
+    // Filters may also be loaded from etcd, alongside the static filters
+    etcd            *etcd.Client
+    etcdKey         string
+    staticAccept    []QueryFilter
+    staticReject    []QueryFilter
+    etcdAccept      []QueryFilter   // The last valid filters loaded from etcd
+    etcdReject      []QueryFilter
+    loadLock        sync.Mutex  // Held while loading, so loads can't overlap
+    stop            chan bool
+    stopped         chan bool
 }
 
-// Matches returns true if the given DNS query matches the filter
-func (f *QueryFilter) Matches(req *dns.Msg) bool {
-    queryDomain := req.Question[0].Name
-    queryQType := dns.TypeToString[req.Question[0].Qtype]
-    if len(queryDomain) > 0 && !strings.HasSuffix(queryDomain, f.domain) {
-        debugMsg("Domain match failed (" + queryDomain + ", " + f.domain + ")")
+// filterTrie indexes filters by the labels of their domain in reverse order
+// (e.g net. then disco. for disco.net.), so finding the filters for a query
+// only visits the labels of the query name, however many filters there are.
+type filterTrie struct {
+    children        map[string]*filterTrie
+    exact           []*QueryFilter
+    subtree         []*QueryFilter
+    patterns        []*QueryFilter  // Globs beneath the node's domain, and regexes
+}
+
+func NewQueryFilterer(acceptFilters []QueryFilter, rejectFilters []QueryFilter) *QueryFilterer {
+    filterer := &QueryFilterer{}
+    filterer.Set(acceptFilters, rejectFilters)
+    return filterer
+}
+
+// Set replaces the filters, so that queries are filtered by either the old or
+// new filters but never a mix of the two
+func (f *QueryFilterer) Set(acceptFilters []QueryFilter, rejectFilters []QueryFilter) {
+    acceptFilters = registerFilters("accept", acceptFilters)
+    rejectFilters = registerFilters("reject", rejectFilters)
+
+    var accept, reject *filterTrie
+    if len(acceptFilters) > 0 {
+        accept = newFilterTrie(acceptFilters)
+    }
+    if len(rejectFilters) > 0 {
+        reject = newFilterTrie(rejectFilters)
+    }
+
+    acceptEnforced := false
+    for _, filter := range acceptFilters {
+        if !filter.dryRun {
+            acceptEnforced = true
+        }
+    }
+
+    f.lock.Lock()
+    previous := append(append([]QueryFilter{}, f.accept...), f.reject...)
+    f.accept, f.reject = acceptFilters, rejectFilters
+    f.acceptFilters, f.rejectFilters = accept, reject
+    f.acceptEnforced = acceptEnforced
+    f.lock.Unlock()
+
+    // Stop reporting the counts of filters that have been removed
+    current := make(map[string]bool)
+    for _, filter := range append(acceptFilters, rejectFilters...) {
+        current[filter.name] = true
+    }
+    for _, filter := range previous {
+        if !current[filter.name] {
+            metrics.DefaultRegistry.Unregister(filterCounterName(filter.name))
+        }
+    }
+}
+
+// Filters returns the accept and reject filters in use
+func (f *QueryFilterer) Filters() (acceptFilters []QueryFilter, rejectFilters []QueryFilter) {
+    f.lock.RLock()
+    defer f.lock.RUnlock()
+
+    return f.accept, f.reject
+}
+
+// registerFilters returns a copy of the filters with a counter for each. Filters
+// without a name are named after their list and a hash of the filter (e.g
+// reject_1a2b3c4d), so their names don't change as other filters are added or
+// removed, and filters keep their counts when reloaded with the same name.
+func registerFilters(list string, filters []QueryFilter) []QueryFilter {
+    registered := make([]QueryFilter, len(filters))
+    for i, filter := range filters {
+        if len(filter.name) == 0 {
+            hash := fnv.New32a()
+            hash.Write([]byte(filter.String()))
+            filter.name = fmt.Sprintf("%s_%08x", list, hash.Sum32())
+        }
+        filter.hits = metrics.GetOrRegisterCounter(filterCounterName(filter.name), metrics.DefaultRegistry)
+        registered[i] = filter
+    }
+
+    return registered
+}
+
+// filterCounterName returns the name of the metric counting a filter's hits
+func filterCounterName(name string) string {
+    return "filter.rules." + name
+}
+
+func newFilterTrie(filters []QueryFilter) *filterTrie {
+    root := &filterTrie{}
+    for i := range filters {
+        root.insert(&filters[i])
+    }
+    return root
+}
+
+func (t *filterTrie) insert(filter *QueryFilter) {
+    node := t
+
+    // Globs are indexed by the labels after their last wildcard, regexes can't
+    // be indexed at all
+    var labels []string
+    if filter.glob != nil {
+        labels = filter.glob
+        for i := len(labels) - 1; i >= 0; i-- {
+            if isGlob(labels[i]) {
+                labels = labels[i + 1:]
+                break
+            }
+        }
+    } else if filter.regex == nil {
+        labels = filterLabels(filter.domain)
+    }
+
+    for i := len(labels) - 1; i >= 0; i-- {
+        if node.children == nil {
+            node.children = make(map[string]*filterTrie)
+        }
+
+        child, ok := node.children[labels[i]]
+        if !ok {
+            child = &filterTrie{}
+            node.children[labels[i]] = child
+        }
+        node = child
+    }
+
+    if filter.glob != nil || filter.regex != nil {
+        node.patterns = append(node.patterns, filter)
+    } else if filter.exact {
+        node.exact = append(node.exact, filter)
+    } else {
+        node.subtree = append(node.subtree, filter)
+    }
+}
+
+// Match returns the filter matching the given DNS query from the client, or nil
+// if none of them do. The filter for the most specific domain wins.
+func (t *filterTrie) Match(req *dns.Msg, addr net.Addr) *QueryFilter {
+    if t == nil || len(req.Question) == 0 {
+        return nil
+    }
+
+    // Find the nodes for the query name and each of its parents
+    labels := filterLabels(req.Question[0].Name)
+    path := []*filterTrie{t}
+    node := t
+    for i := len(labels) - 1; i >= 0; i-- {
+        if node = node.children[labels[i]]; node == nil {
+            break
+        }
+        path = append(path, node)
+    }
+
+    if len(path) == len(labels) + 1 {
+        for _, filter := range path[len(path) - 1].exact {
+            if filter.matchesQuery(req, addr) && !filter.matchedDryRun(req, addr) {
+                return filter
+            }
+        }
+    }
+
+    for i := len(path) - 1; i >= 0; i-- {
+        for _, filter := range path[i].subtree {
+            if filter.matchesQuery(req, addr) && !filter.matchedDryRun(req, addr) {
+                return filter
+            }
+        }
+
+        for _, filter := range path[i].patterns {
+            if filter.matchesName(labels) && filter.matchesQuery(req, addr) && !filter.matchedDryRun(req, addr) {
+                return filter
+            }
+        }
+    }
+
+    return nil
+}
+
+// matchedDryRun counts and logs a query matched by a filter in dry run mode,
+// returning true if the filter is in dry run mode and should be ignored
+func (f *QueryFilter) matchedDryRun(req *dns.Msg, addr net.Addr) bool {
+    if !f.dryRun {
         return false
     }
 
-    matches := false
-    if len(f.qTypes) > 0 {
-        for _, qType := range f.qTypes {
-            if qType == queryQType {
+    f.hit()
+    logger.Printf("[DRY RUN] Filter %s (%s) matched %s query for %s from %v", f.name, f, dns.TypeToString[req.Question[0].Qtype], req.Question[0].Name, addr)
+    return true
+}
+
+// hit counts a query matched by the filter
+func (f *QueryFilter) hit() {
+    if f.hits != nil {
+        f.hits.Inc(1)
+    }
+}
+
+// isGlob returns true if the label contains any glob wildcards
+func isGlob(label string) bool {
+    return strings.ContainsAny(label, "*?[")
+}
+
+// filterLabels returns the labels of a domain, ignoring case
+func filterLabels(domain string) []string {
+    return dns.SplitDomainName(strings.ToLower(domain))
+}
+
+// Matches returns true if the given DNS query from the client matches the filter
+func (f *QueryFilter) Matches(req *dns.Msg, addr net.Addr) bool {
+    if len(req.Question) == 0 {
+        return false
+    }
+
+    if !f.matchesName(filterLabels(req.Question[0].Name)) {
+        debugMsg("Domain match failed (" + req.Question[0].Name + ", " + f.String() + ")")
+        return false
+    }
+
+    return f.matchesQuery(req, addr)
+}
+
+// matchesName returns true if the name with the given labels matches the
+// filter's domain or pattern
+func (f *QueryFilter) matchesName(labels []string) bool {
+    if f.regex != nil {
+        return f.regex.MatchString(strings.Join(labels, "."))
+    }
+
+    domainLabels := f.glob
+    if domainLabels == nil {
+        domainLabels = filterLabels(f.domain)
+    }
+
+    if len(labels) < len(domainLabels) || (f.exact && len(labels) != len(domainLabels)) {
+        return false
+    }
+
+    // Compare the labels from the right, so subdomains match too
+    offset := len(labels) - len(domainLabels)
+    for i, domainLabel := range domainLabels {
+        if f.glob == nil {
+            if domainLabel != labels[offset + i] {
+                return false
+            }
+        } else if matched, _ := path.Match(domainLabel, labels[offset + i]); !matched {
+            return false
+        }
+    }
+
+    return true
+}
+
+// matchesQuery returns true if the type of the given DNS query and the client
+// that sent it match the filter, regardless of the name queried
+func (f *QueryFilter) matchesQuery(req *dns.Msg, addr net.Addr) bool {
+    return f.matchesType(req) && f.matchesClient(addr)
+}
+
+// matchesType returns true if the type of the given DNS query is one the filter
+// applies to
+func (f *QueryFilter) matchesType(req *dns.Msg) bool {
+    if len(f.qTypes) == 0 {
+        return true
+    }
+
+    queryQType := dns.TypeToString[req.Question[0].Qtype]
+    for _, qType := range f.qTypes {
+        if qType == queryQType {
+            return true
+        }
+    }
+
+    return false
+}
+
+// matchesClient returns true if the client's address and transport are ones the
+// filter applies to. Filters restricted to certain clients never match queries
+// without a client address.
+func (f *QueryFilter) matchesClient(addr net.Addr) bool {
+    if len(f.transports) > 0 {
+        matches := false
+        for _, transport := range f.transports {
+            if addr != nil && transport == addr.Network() {
                 matches = true
             }
         }
+
+        if !matches {
+            return false
+        }
+    }
+
+    if len(f.clients) > 0 && !addrInNetworks(addr, f.clients) {
+        return false
+    }
+
+    if len(f.excludedClients) > 0 && (addr == nil || addrInNetworks(addr, f.excludedClients)) {
+        return false
+    }
+
+    return true
+}
+
+// restrictsClients returns true if the filter only applies to some clients
+func (f *QueryFilter) restrictsClients() bool {
+    return len(f.clients) > 0 || len(f.excludedClients) > 0 || len(f.transports) > 0
+}
+
+func (f *QueryFilter) String() string {
+    domain := f.domain
+    if f.regex != nil {
+        domain = "~" + domain
+    } else if f.exact {
+        domain = "=" + domain
+    }
+
+    description := domain + ":" + strings.Join(f.qTypes, ",")
+
+    if len(f.clients) > 0 || len(f.excludedClients) > 0 {
+        clients := make([]string, 0, len(f.clients) + len(f.excludedClients))
+        for _, network := range f.clients {
+            clients = append(clients, network.String())
+        }
+        for _, network := range f.excludedClients {
+            clients = append(clients, "!" + network.String())
+        }
+        description += " from=" + strings.Join(clients, ",")
+    }
+
+    if len(f.transports) > 0 {
+        description += " transport=" + strings.Join(f.transports, ",")
+    }
+
+    if f.action == filterActionSinkhole && f.sinkholeIP != nil {
+        description += " action=sinkhole:" + f.sinkholeIP.String()
+    } else if f.action == filterActionSinkhole {
+        description += " action=sinkhole:" + f.sinkholeTarget
+    } else if len(f.action) > 0 {
+        description += " action=" + f.action
+    }
+
+    if f.dryRun {
+        description += " mode=dry-run"
+    }
+
+    return description
+}
+
+// parseFilter converts a single filter in the format described by parseFilters
+func parseFilter(filter string) (parsed QueryFilter, err error) {
+    fields := strings.Fields(filter)
+    if len(fields) == 0 {
+        return parsed, fmt.Errorf("Empty filter")
+    }
+
+    // Regexes may contain colons themselves, but types never do
+    components := strings.Split(fields[0], ":")
+    if strings.HasPrefix(fields[0], "~") {
+        separator := strings.LastIndex(fields[0], ":")
+        if separator < 0 {
+            return parsed, fmt.Errorf("Expected a colon (~regex:[type,type...]) in filter '%s'", filter)
+        }
+        components = []string{fields[0][:separator], fields[0][separator + 1:]}
+    } else if len(components) != 2 {
+        return parsed, fmt.Errorf("Expected only one colon ([domain]:[type,type...]) in filter '%s'", filter)
+    }
+
+    if strings.HasPrefix(components[0], "~") {
+        // Regexes are matched against the whole name, without the trailing dot
+        parsed.domain = strings.TrimPrefix(components[0], "~")
+        parsed.regex, err = regexp.Compile("^(?i:" + parsed.domain + ")$")
+        if err != nil {
+            return parsed, fmt.Errorf("Invalid regex in filter '%s': %s", filter, err)
+        }
     } else {
-        matches = true
+        parsed.exact = strings.HasPrefix(components[0], "=")
+        parsed.domain = dns.Fqdn(strings.ToLower(strings.TrimPrefix(components[0], "=")))
+
+        if isGlob(parsed.domain) {
+            parsed.glob = filterLabels(parsed.domain)
+            for _, label := range parsed.glob {
+                if _, err := path.Match(label, ""); err != nil {
+                    return parsed, fmt.Errorf("Invalid glob in filter '%s': %s", filter, err)
+                }
+            }
+        }
+    }
+
+    parsed.qTypes = strings.Split(components[1], ",")
+
+    if len(parsed.qTypes) == 1 && len(parsed.qTypes[0]) == 0 {
+        parsed.qTypes = make([]string, 0)
+    }
+
+    for _, option := range fields[1:] {
+        option := strings.SplitN(option, "=", 2)
+        if len(option) != 2 || len(option[1]) == 0 {
+            return parsed, fmt.Errorf("Expected option=value in filter '%s'", filter)
+        }
+
+        switch option[0] {
+        case "from":
+            for _, client := range strings.Split(option[1], ",") {
+                excluded := strings.HasPrefix(client, "!")
+                network, err := parseClientNetwork(strings.TrimPrefix(client, "!"))
+                if err != nil {
+                    return parsed, fmt.Errorf("Invalid client '%s' in filter '%s'", client, filter)
+                }
+
+                if excluded {
+                    parsed.excludedClients = append(parsed.excludedClients, network)
+                } else {
+                    parsed.clients = append(parsed.clients, network)
+                }
+            }
+        case "transport":
+            for _, transport := range strings.Split(option[1], ",") {
+                if !filterTransports[transport] {
+                    return parsed, fmt.Errorf("Unknown transport '%s' in filter '%s', expected udp or tcp", transport, filter)
+                }
+                parsed.transports = append(parsed.transports, transport)
+            }
+        case "name":
+            if !filterNamePattern.MatchString(option[1]) {
+                return parsed, fmt.Errorf("Invalid name '%s' in filter '%s', expected letters, numbers, - and _", option[1], filter)
+            }
+            parsed.name = option[1]
+        case "mode":
+            switch option[1] {
+            case "enforce":
+                parsed.dryRun = false
+            case "dry-run":
+                parsed.dryRun = true
+            default:
+                return parsed, fmt.Errorf("Unknown mode '%s' in filter '%s', expected enforce or dry-run", option[1], filter)
+            }
+        case "action":
+            action := strings.SplitN(option[1], ":", 2)
+            switch action[0] {
+            case filterActionNXDomain, filterActionRefused, filterActionDrop:
+                if len(action) != 1 {
+                    return parsed, fmt.Errorf("Unexpected value for action '%s' in filter '%s'", action[0], filter)
+                }
+            case filterActionSinkhole:
+                if len(action) != 2 || len(action[1]) == 0 {
+                    return parsed, fmt.Errorf("Expected action=sinkhole:address or action=sinkhole:name in filter '%s'", filter)
+                }
+
+                if parsed.sinkholeIP = net.ParseIP(action[1]); parsed.sinkholeIP == nil {
+                    if _, ok := dns.IsDomainName(action[1]); !ok {
+                        return parsed, fmt.Errorf("Invalid sinkhole '%s' in filter '%s'", action[1], filter)
+                    }
+                    parsed.sinkholeTarget = dns.Fqdn(action[1])
+                }
+            default:
+                return parsed, fmt.Errorf("Unknown action '%s' in filter '%s'", action[0], filter)
+            }
+            parsed.action = action[0]
+        default:
+            return parsed, fmt.Errorf("Unknown option '%s' in filter '%s'", option[0], filter)
+        }
     }
 
-    return matches
+    return
+}
+
+// parseClientNetwork parses a CIDR, or a single IPv4 or IPv6 address
+func parseClientNetwork(client string) (*net.IPNet, error) {
+    if !strings.Contains(client, "/") {
+        ip := net.ParseIP(client)
+        if ip == nil {
+            return nil, fmt.Errorf("Invalid IP address '%s'", client)
+        }
+
+        if ip.To4() != nil {
+            return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+        }
+        return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+    }
+
+    _, network, err := net.ParseCIDR(client)
+    return network, err
 }
 
 // ShouldAcceptQuery returns true if the given DNS query matches the given
 // accept/reject filters, and should be accepted.
 func (f *QueryFilterer) ShouldAcceptQuery(req *dns.Msg) bool {
-    accepted := true
+    accepted, _ := f.Filter(req, nil)
+    return accepted
+}
 
-    for _, filter := range f.rejectFilters {
-        filterDescription := "Filter " + filter.domain + ":" + strings.Join(filter.qTypes, ",")
-        if filter.Matches(req) {
-            debugMsg(filterDescription + " rejected")
-            accepted = false
-            break
+// Filter returns true if the given DNS query from the client should be accepted
+// by the accept/reject filters, along with the filter that decided so (if any).
+func (f *QueryFilterer) Filter(req *dns.Msg, addr net.Addr) (accepted bool, filter *QueryFilter) {
+    f.lock.RLock()
+    acceptFilters, rejectFilters, acceptEnforced := f.acceptFilters, f.rejectFilters, f.acceptEnforced
+    f.lock.RUnlock()
+
+    if filter = rejectFilters.Match(req, addr); filter != nil {
+        debugMsg("Filter " + filter.String() + " rejected")
+        filter.hit()
+        return false, filter
+    }
+
+    if acceptFilters != nil {
+        if filter = acceptFilters.Match(req, addr); filter != nil {
+            debugMsg("Filter " + filter.String() + " accepted")
+            filter.hit()
+            return true, filter
         }
-        debugMsg(filterDescription + " not rejected")
+
+        // Only accept filters in dry run mode, which have been logged
+        if !acceptEnforced {
+            return true, nil
+        }
+
+        debugMsg("No filter accepted")
+        return false, nil
     }
 
-    if accepted && len(f.acceptFilters) > 0 {
-        accepted = false
-        for _, filter := range f.acceptFilters {
-            filterDescription := "Filter " + filter.domain + ":" + strings.Join(filter.qTypes, ",")
-            if filter.Matches(req) {
-                debugMsg(filterDescription + " accepted")
-                accepted = true
-                break
-            }
-            debugMsg(filterDescription + " not accepted")
+    return true, nil
+}
+
+// rejectQuery returns the response to a query rejected by the given filter (or
+// by not matching any accept filters, if nil), according to the filter's
+// action. The response is nil if the query should be dropped.
+func rejectQuery(r *Resolver, req *dns.Msg, filter *QueryFilter) (msg *dns.Msg, extendedError *ExtendedError) {
+    action := filterActionNXDomain
+    if filter != nil && len(filter.action) > 0 {
+        action = filter.action
+    }
+
+    counter := metrics.GetOrRegisterCounter("filter.actions." + action, metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    extendedError = &ExtendedError{
+        Code: edeBlocked,
+        Text: "Rejected query based on matched filters"}
+    if filter != nil && filter.restrictsClients() {
+        extendedError.Code = edeProhibited
+    }
+
+    msg = new(dns.Msg)
+    msg.SetReply(req)
+    msg.RecursionAvailable = false
+
+    q := req.Question[0]
+
+    switch action {
+    case filterActionDrop:
+        return nil, nil
+    case filterActionRefused:
+        msg.SetRcode(req, dns.RcodeRefused)
+    case filterActionSinkhole:
+        msg.Authoritative = true
+        extendedError = &ExtendedError{
+            Code: edeForgedAnswer,
+            Text: "Answered with a sinkhole based on matched filters"}
+
+        header := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: r.defaultTtl}
+        if ip := filter.sinkholeIP.To4(); ip != nil && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY) {
+            header.Rrtype = dns.TypeA
+            msg.Answer = []dns.RR{&dns.A{Hdr: header, A: ip}}
+        } else if ip := filter.sinkholeIP; ip != nil && ip.To4() == nil && (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY) {
+            header.Rrtype = dns.TypeAAAA
+            msg.Answer = []dns.RR{&dns.AAAA{Hdr: header, AAAA: ip}}
+        } else if len(filter.sinkholeTarget) > 0 {
+            header.Rrtype = dns.TypeCNAME
+            msg.Answer = []dns.RR{&dns.CNAME{Hdr: header, Target: filter.sinkholeTarget}}
+        }
+    default:
+        // We're only authoritative for names in a zone we serve, otherwise
+        // the answer has no SOA to say how long it may be cached for
+        msg.SetRcode(req, dns.RcodeNameError)
+        if soa := r.Authority(q.Name); soa != nil {
+            msg.Authoritative = true
+            msg.Ns = []dns.RR{soa}
         }
     }
 
-    return accepted
+    return
+}
+
+// filterStatus describes a filter and how many queries it has matched
+type filterStatus struct {
+    Name        string  `json:"name"`
+    Filter      string  `json:"filter"`
+    DryRun      bool    `json:"dry_run"`
+    Hits        int64   `json:"hits"`
+}
+
+// ServeHTTP lists the filters in use, and how many queries each has matched
+func (f *QueryFilterer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    acceptFilters, rejectFilters := f.Filters()
+
+    status := func(filters []QueryFilter) []filterStatus {
+        statuses := make([]filterStatus, 0, len(filters))
+        for _, filter := range filters {
+            statuses = append(statuses, filterStatus{filter.name, filter.String(), filter.dryRun, filter.hits.Count()})
+        }
+        return statuses
+    }
+
+    writeJSON(w, map[string][]filterStatus{
+        "accept": status(acceptFilters),
+        "reject": status(rejectFilters)})
 }
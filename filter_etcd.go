@@ -0,0 +1,169 @@
+package main
+
+import (
+    "fmt"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/rcrowley/go-metrics"
+    "strings"
+)
+
+// The etcd key beneath which filters are stored, in accept/ and reject/
+const etcdFiltersKey = "/_discodns/filters"
+
+// NewEtcdQueryFilterer returns a filterer that combines the given filters with
+// those stored in etcd, once Start is called. Each key beneath the accept/ and
+// reject/ directories holds one or more filters (one per line) in the same
+// format as the --accept and --reject options.
+func NewEtcdQueryFilterer(client *etcd.Client, etcdKey string, acceptFilters []QueryFilter, rejectFilters []QueryFilter) *QueryFilterer {
+    filterer := NewQueryFilterer(acceptFilters, rejectFilters)
+    filterer.etcd = client
+    filterer.etcdKey = "/" + strings.Trim(etcdKey, "/")
+    filterer.staticAccept = acceptFilters
+    filterer.staticReject = rejectFilters
+    filterer.stop = make(chan bool)
+
+    return filterer
+}
+
+// Start loads the filters stored in etcd and watches for changes in the
+// background. This has no effect on filterers without etcd.
+func (f *QueryFilterer) Start() {
+    if f.etcd != nil {
+        f.stopped = make(chan bool)
+        go func() {
+            watchEtcd(f.etcd, f.etcdKey, f.Load, f.reload, f.stop)
+            close(f.stopped)
+        }()
+    }
+}
+
+// Stop stops watching etcd for changes, waiting for any reload in progress
+func (f *QueryFilterer) Stop() {
+    if f.stop != nil {
+        close(f.stop)
+    }
+    if f.stopped != nil {
+        <-f.stopped
+    }
+}
+
+// SetStatic replaces the static filters (those not stored in etcd), keeping
+// the filters last loaded from etcd. Etcd isn't read again, so this can't fail
+// part way through a reload.
+func (f *QueryFilterer) SetStatic(acceptFilters []QueryFilter, rejectFilters []QueryFilter) {
+    if f.etcd == nil {
+        f.Set(acceptFilters, rejectFilters)
+        return
+    }
+
+    f.loadLock.Lock()
+    defer f.loadLock.Unlock()
+
+    f.staticAccept, f.staticReject = acceptFilters, rejectFilters
+    f.setCombined()
+}
+
+// setCombined uses the static filters along with those loaded from etcd. The
+// load lock must be held.
+func (f *QueryFilterer) setCombined() {
+    acceptFilters := append(append([]QueryFilter{}, f.staticAccept...), f.etcdAccept...)
+    rejectFilters := append(append([]QueryFilter{}, f.staticReject...), f.etcdReject...)
+    f.Set(acceptFilters, rejectFilters)
+
+    debugMsg(fmt.Sprintf("Using %d accept and %d reject filters", len(acceptFilters), len(rejectFilters)))
+}
+
+// Load replaces the filters with those stored in etcd (along with the static
+// filters), returning the etcd index of the data. If any of the stored filters
+// are invalid the error is logged, and the current filters are kept.
+func (f *QueryFilterer) Load() (etcdIndex uint64, err error) {
+    f.loadLock.Lock()
+    defer f.loadLock.Unlock()
+
+    var acceptFilters, rejectFilters []QueryFilter
+
+    response, err := f.etcd.Get(f.etcdKey, true, true)
+    if err != nil {
+        if e, ok := err.(*etcd.EtcdError); ok {
+            if e.ErrorCode == 100 {
+                etcdIndex, err = e.Index, nil
+            }
+        }
+
+        if err != nil {
+            return
+        }
+    } else {
+        etcdIndex = response.EtcdIndex
+
+        for _, node := range response.Node.Nodes {
+            var parsed []QueryFilter
+            parsed, err = parseEtcdFilters(node)
+            if err != nil {
+                break
+            }
+
+            switch node.Key[strings.LastIndex(node.Key, "/") + 1:] {
+            case "accept":
+                acceptFilters = append(acceptFilters, parsed...)
+            case "reject":
+                rejectFilters = append(rejectFilters, parsed...)
+            default:
+                logger.Printf("[WARNING] Ignoring unexpected filter key %s", node.Key)
+            }
+        }
+    }
+
+    if err != nil {
+        error_counter := metrics.GetOrRegisterCounter("filter.etcd.load_errors", metrics.DefaultRegistry)
+        error_counter.Inc(1)
+
+        logger.Printf("[ERROR] Keeping the current filters, as those in etcd are invalid: %s", err)
+        return etcdIndex, nil
+    }
+
+    f.etcdAccept, f.etcdReject = acceptFilters, rejectFilters
+    f.setCombined()
+
+    counter := metrics.GetOrRegisterCounter("filter.etcd.loads", metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    debugMsg(fmt.Sprintf("Loaded %d accept and %d reject filters from etcd", len(acceptFilters), len(rejectFilters)))
+    return
+}
+
+// reload loads every filter again after a change in etcd, since the filters
+// are only replaced when all of them are valid
+func (f *QueryFilterer) reload(response *etcd.Response) {
+    f.Load()
+}
+
+// parseEtcdFilters returns the filters stored at or beneath the node, one per
+// line of each value
+func parseEtcdFilters(node *etcd.Node) (filters []QueryFilter, err error) {
+    if node.Dir {
+        for _, child := range node.Nodes {
+            parsed, err := parseEtcdFilters(child)
+            if err != nil {
+                return nil, err
+            }
+            filters = append(filters, parsed...)
+        }
+
+        return
+    }
+
+    lines := make([]string, 0)
+    for _, line := range strings.Split(node.Value, "\n") {
+        if len(strings.TrimSpace(line)) > 0 {
+            lines = append(lines, line)
+        }
+    }
+
+    filters, err = parseFilters(lines)
+    if err != nil {
+        err = fmt.Errorf("%s (%s)", err, node.Key)
+    }
+
+    return
+}
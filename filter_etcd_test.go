@@ -0,0 +1,86 @@
+package main
+
+import (
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "testing"
+    "time"
+)
+
+func TestEtcdFilters(t *testing.T) {
+    client := etcd.NewClient([]string{"http://127.0.0.1:4001"})
+    client.Delete("/_TestEtcdFilters", true)
+    defer client.Delete("/_TestEtcdFilters", true)
+
+    client.Set("/_TestEtcdFilters/reject/ipv6", "disco.net:AAAA", 0)
+
+    filterer := NewEtcdQueryFilterer(client, "/_TestEtcdFilters/", nil, mustParseFilters([]string{"disco.com:"}))
+    filterer.Start()
+    defer filterer.Stop()
+
+    waitForFilter := func(domain string, rrType uint16, accepted bool) bool {
+        for attempt := 0; attempt < 50; attempt++ {
+            if filterer.ShouldAcceptQuery(generateDNSMessage(domain, rrType)) == accepted {
+                return true
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+        return false
+    }
+
+    if !waitForFilter("disco.net", dns.TypeAAAA, false) {
+        t.Error("Expected the filter stored in etcd to reject the query")
+        t.Fatal()
+    }
+
+    if filterer.ShouldAcceptQuery(generateDNSMessage("disco.com", dns.TypeA)) != false {
+        t.Error("Expected the static filter to still reject the query")
+    }
+
+    // Changes are picked up, with several filters in one key
+    client.Set("/_TestEtcdFilters/reject/ipv6", "disco.net:AAAA\n\ndisco.org:AAAA\n", 0)
+    if !waitForFilter("disco.org", dns.TypeAAAA, false) {
+        t.Error("Expected the updated filters to reject the query")
+        t.Fatal()
+    }
+
+    client.Set("/_TestEtcdFilters/accept/only", "disco.net:\ndisco.org:", 0)
+    if !waitForFilter("disco.io", dns.TypeA, false) {
+        t.Error("Expected the accept filters to reject the query")
+        t.Fatal()
+    }
+
+    // Invalid filters are ignored, leaving the previous filters in place
+    client.Set("/_TestEtcdFilters/reject/broken", "disco.net:A:AAAA", 0)
+    client.Set("/_TestEtcdFilters/reject/ipv6", "disco.org:AAAA", 0)
+    time.Sleep(500 * time.Millisecond)
+
+    if filterer.ShouldAcceptQuery(generateDNSMessage("disco.net", dns.TypeAAAA)) != false {
+        t.Error("Expected the previous filters to be kept")
+    }
+
+    // Fixing the filters applies every change
+    client.Delete("/_TestEtcdFilters/reject/broken", false)
+    if !waitForFilter("disco.net", dns.TypeAAAA, true) {
+        t.Error("Expected the fixed filters to accept the query")
+        t.Fatal()
+    }
+
+    client.Delete("/_TestEtcdFilters/accept", true)
+    if !waitForFilter("disco.io", dns.TypeA, true) {
+        t.Error("Expected the removed accept filters to stop rejecting the query")
+    }
+
+    // Replacing the static filters keeps the last valid filters from etcd,
+    // even while those stored are invalid
+    client.Set("/_TestEtcdFilters/reject/broken", "disco.net:A:AAAA", 0)
+    time.Sleep(500 * time.Millisecond)
+
+    filterer.SetStatic(nil, mustParseFilters([]string{"disco.io:"}))
+    if filterer.ShouldAcceptQuery(generateDNSMessage("disco.io", dns.TypeA)) || !filterer.ShouldAcceptQuery(generateDNSMessage("disco.com", dns.TypeA)) {
+        t.Error("Expected the static filters to be replaced")
+    }
+    if filterer.ShouldAcceptQuery(generateDNSMessage("disco.org", dns.TypeAAAA)) {
+        t.Error("Expected the filters from etcd to be kept")
+    }
+}
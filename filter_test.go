@@ -1,13 +1,19 @@
 package main
 
 import (
+    "encoding/json"
+    "fmt"
     "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "net"
+    "net/http/httptest"
+    "strings"
     "testing"
 )
 
 func TestFilters(t *testing.T) {
     // Enable debug logging
-    log_debug = true
+    setDebug(true)
 }
 
 func TestNoFilters(t *testing.T) {
@@ -21,7 +27,7 @@ func TestNoFilters(t *testing.T) {
 }
 
 func TestSimpleAccept(t *testing.T) {
-    filterer := QueryFilterer{acceptFilters: parseFilters([]string{"net:A"})}
+    filterer := NewQueryFilterer(mustParseFilters([]string{"net:A"}), nil)
 
     msg := generateDNSMessage("discodns.net", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != true {
@@ -43,7 +49,7 @@ func TestSimpleAccept(t *testing.T) {
 }
 
 func TestSimpleReject(t *testing.T) {
-    filterer := QueryFilterer{rejectFilters: parseFilters([]string{"net:A"})}
+    filterer := NewQueryFilterer(nil, mustParseFilters([]string{"net:A"}))
 
     msg := generateDNSMessage("discodns.com", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != true {
@@ -65,7 +71,7 @@ func TestSimpleReject(t *testing.T) {
 }
 
 func TestSimpleAcceptFullDomain(t *testing.T) {
-    filterer := QueryFilterer{acceptFilters: parseFilters([]string{"net:"})}
+    filterer := NewQueryFilterer(mustParseFilters([]string{"net:"}), nil)
 
     msg := generateDNSMessage("discodns.net", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != true {
@@ -93,7 +99,7 @@ func TestSimpleAcceptFullDomain(t *testing.T) {
 }
 
 func TestSimpleRejectFullDomain(t *testing.T) {
-    filterer := QueryFilterer{rejectFilters: parseFilters([]string{"net:"})}
+    filterer := NewQueryFilterer(nil, mustParseFilters([]string{"net:"}))
 
     msg := generateDNSMessage("discodns.net", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != false {
@@ -121,7 +127,7 @@ func TestSimpleRejectFullDomain(t *testing.T) {
 }
 
 func TestSimpleAcceptSpecificTypes(t *testing.T) {
-    filterer := QueryFilterer{acceptFilters: parseFilters([]string{":A"})}
+    filterer := NewQueryFilterer(mustParseFilters([]string{":A"}), nil)
 
     msg := generateDNSMessage("discodns.net", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != true {
@@ -137,7 +143,7 @@ func TestSimpleAcceptSpecificTypes(t *testing.T) {
 }
 
 func TestSimpleAcceptMultipleTypes(t *testing.T) {
-    filterer := QueryFilterer{acceptFilters: parseFilters([]string{":A,PTR"})}
+    filterer := NewQueryFilterer(mustParseFilters([]string{":A,PTR"}), nil)
 
     msg := generateDNSMessage("discodns.net", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != true {
@@ -159,7 +165,7 @@ func TestSimpleAcceptMultipleTypes(t *testing.T) {
 }
 
 func TestSimpleRejectSpecificTypes(t *testing.T) {
-    filterer := QueryFilterer{rejectFilters: parseFilters([]string{":A"})}
+    filterer := NewQueryFilterer(nil, mustParseFilters([]string{":A"}))
 
     msg := generateDNSMessage("discodns.net", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != false {
@@ -175,7 +181,7 @@ func TestSimpleRejectSpecificTypes(t *testing.T) {
 }
 
 func TestSimpleRejectMultipleTypes(t *testing.T) {
-    filterer := QueryFilterer{rejectFilters: parseFilters([]string{":A,PTR"})}
+    filterer := NewQueryFilterer(nil, mustParseFilters([]string{":A,PTR"}))
 
     msg := generateDNSMessage("discodns.net", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != false {
@@ -197,7 +203,7 @@ func TestSimpleRejectMultipleTypes(t *testing.T) {
 }
 
 func TestMultipleAccept(t *testing.T) {
-    filterer := QueryFilterer{acceptFilters: parseFilters([]string{"net:A", "com:AAAA"})}
+    filterer := NewQueryFilterer(mustParseFilters([]string{"net:A", "com:AAAA"}), nil)
 
     msg := generateDNSMessage("discodns.net", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != true {
@@ -225,7 +231,7 @@ func TestMultipleAccept(t *testing.T) {
 }
 
 func TestMultipleReject(t *testing.T) {
-    filterer := QueryFilterer{rejectFilters: parseFilters([]string{"net:A", "com:AAAA"})}
+    filterer := NewQueryFilterer(nil, mustParseFilters([]string{"net:A", "com:AAAA"}))
 
     msg := generateDNSMessage("discodns.net", dns.TypeA)
     if filterer.ShouldAcceptQuery(msg) != false {
@@ -252,6 +258,386 @@ func TestMultipleReject(t *testing.T) {
     }
 }
 
+func TestFilterLabelBoundaries(t *testing.T) {
+    filterer := NewQueryFilterer(nil, mustParseFilters([]string{"net:", "disco.com:"}))
+
+    var expected = []struct {
+        domain      string
+        accepted    bool
+    } {
+        {"net", false},
+        {"discodns.net", false},
+        {"cabinet", true},
+        {"disco.com", false},
+        {"foo.disco.com", false},
+        {"FOO.Disco.COM", false},
+        {"xdisco.com", true},
+        {"com", true},
+    }
+
+    for _, e := range expected {
+        msg := generateDNSMessage(e.domain, dns.TypeA)
+        if filterer.ShouldAcceptQuery(msg) != e.accepted {
+            t.Error("Expected ", e.domain, " accepted to be ", e.accepted)
+        }
+    }
+}
+
+func TestFilterExactDomain(t *testing.T) {
+    filterer := NewQueryFilterer(nil, mustParseFilters([]string{"=disco.net:A"}))
+
+    msg := generateDNSMessage("disco.net", dns.TypeA)
+    if filterer.ShouldAcceptQuery(msg) != false {
+        t.Error("Expected the query to be rejected")
+        t.Fatal()
+    }
+
+    msg = generateDNSMessage("disco.net", dns.TypeAAAA)
+    if filterer.ShouldAcceptQuery(msg) != true {
+        t.Error("Expected the query to be accepted")
+        t.Fatal()
+    }
+
+    msg = generateDNSMessage("foo.disco.net", dns.TypeA)
+    if filterer.ShouldAcceptQuery(msg) != true {
+        t.Error("Expected the query for a subdomain to be accepted")
+        t.Fatal()
+    }
+}
+
+func TestFilterMostSpecificMatch(t *testing.T) {
+    filters := mustParseFilters([]string{"net:", "disco.net:A", "=foo.disco.net:"})
+    trie := newFilterTrie(filters)
+
+    var expected = []struct {
+        domain      string
+        qType       uint16
+        filter      *QueryFilter
+    } {
+        {"foo.disco.net", dns.TypeAAAA, &filters[2]},
+        {"bar.disco.net", dns.TypeA, &filters[1]},
+        {"bar.disco.net", dns.TypeAAAA, &filters[0]},
+        {"disco.com", dns.TypeA, nil},
+    }
+
+    for _, e := range expected {
+        if filter := trie.Match(generateDNSMessage(e.domain, e.qType), nil); filter != e.filter {
+            t.Error("Expected ", e.domain, " to match ", e.filter, ", got ", filter)
+        }
+    }
+}
+
+func TestFilterManyRules(t *testing.T) {
+    domains := make([]string, 0, 10000)
+    for i := 0; i < 10000; i++ {
+        domains = append(domains, fmt.Sprintf("host%d.disco.net:", i))
+    }
+    filterer := NewQueryFilterer(mustParseFilters(domains), nil)
+
+    msg := generateDNSMessage("www.host9999.disco.net", dns.TypeA)
+    if filterer.ShouldAcceptQuery(msg) != true {
+        t.Error("Expected the query to be accepted")
+        t.Fatal()
+    }
+
+    msg = generateDNSMessage("host10000.disco.net", dns.TypeA)
+    if filterer.ShouldAcceptQuery(msg) != false {
+        t.Error("Expected the query to be rejected")
+        t.Fatal()
+    }
+}
+
+func TestFilterClients(t *testing.T) {
+    udp := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 53} }
+    tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 53} }
+
+    var expected = []struct {
+        reject      []string
+        domain      string
+        qType       uint16
+        addr        net.Addr
+        accepted    bool
+    } {
+        // Only 10.0.0.0/8 may query internal.corp
+        {[]string{"internal.corp: from=!10.0.0.0/8"}, "foo.internal.corp", dns.TypeA, udp("10.1.2.3"), true},
+        {[]string{"internal.corp: from=!10.0.0.0/8"}, "foo.internal.corp", dns.TypeA, udp("192.168.1.1"), false},
+        {[]string{"internal.corp: from=!10.0.0.0/8"}, "disco.net", dns.TypeA, udp("192.168.1.1"), true},
+        {[]string{"internal.corp: from=!10.0.0.0/8"}, "internal.corp", dns.TypeA, nil, true},
+
+        // No ANY queries from outside the VPCs
+        {[]string{":ANY from=!10.0.0.0/8,!fd00::/8"}, "disco.net", dns.TypeANY, udp("10.0.0.1"), true},
+        {[]string{":ANY from=!10.0.0.0/8,!fd00::/8"}, "disco.net", dns.TypeANY, udp("fd00::1"), true},
+        {[]string{":ANY from=!10.0.0.0/8,!fd00::/8"}, "disco.net", dns.TypeANY, udp("2001:db8::1"), false},
+        {[]string{":ANY from=!10.0.0.0/8,!fd00::/8"}, "disco.net", dns.TypeANY, udp("8.8.8.8"), false},
+        {[]string{":ANY from=!10.0.0.0/8,!fd00::/8"}, "disco.net", dns.TypeA, udp("8.8.8.8"), true},
+
+        // Networks and single addresses
+        {[]string{": from=192.168.0.0/16,2001:db8::1"}, "disco.net", dns.TypeA, udp("192.168.4.4"), false},
+        {[]string{": from=192.168.0.0/16,2001:db8::1"}, "disco.net", dns.TypeA, tcp("2001:db8::1"), false},
+        {[]string{": from=192.168.0.0/16,2001:db8::1"}, "disco.net", dns.TypeA, udp("2001:db8::2"), true},
+        {[]string{": from=192.168.0.0/16,2001:db8::1"}, "disco.net", dns.TypeA, nil, true},
+
+        // Transports
+        {[]string{":ANY transport=udp"}, "disco.net", dns.TypeANY, udp("10.0.0.1"), false},
+        {[]string{":ANY transport=udp"}, "disco.net", dns.TypeANY, tcp("10.0.0.1"), true},
+        {[]string{":ANY transport=udp from=!10.0.0.0/8"}, "disco.net", dns.TypeANY, udp("10.0.0.1"), true},
+        {[]string{":ANY transport=udp from=!10.0.0.0/8"}, "disco.net", dns.TypeANY, udp("8.8.8.8"), false},
+        {[]string{":ANY transport=udp from=!10.0.0.0/8"}, "disco.net", dns.TypeANY, tcp("8.8.8.8"), true},
+    }
+
+    for _, e := range expected {
+        filterer := NewQueryFilterer(nil, mustParseFilters(e.reject))
+        if accepted, _ := filterer.Filter(generateDNSMessage(e.domain, e.qType), e.addr); accepted != e.accepted {
+            t.Error("Expected ", e.domain, " from ", e.addr, " with ", e.reject, " accepted to be ", e.accepted)
+        }
+    }
+}
+
+func TestFilterClientsAccept(t *testing.T) {
+    filterer := NewQueryFilterer(mustParseFilters([]string{"internal.corp: from=10.0.0.0/8", "disco.net:"}), nil)
+
+    addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53}
+    if accepted, _ := filterer.Filter(generateDNSMessage("internal.corp", dns.TypeA), addr); accepted != true {
+        t.Error("Expected the query to be accepted")
+    }
+
+    addr = &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 53}
+    if accepted, _ := filterer.Filter(generateDNSMessage("internal.corp", dns.TypeA), addr); accepted != false {
+        t.Error("Expected the query to be rejected")
+    }
+
+    if accepted, _ := filterer.Filter(generateDNSMessage("disco.net", dns.TypeA), addr); accepted != true {
+        t.Error("Expected the query to be accepted")
+    }
+}
+
+func TestFilterPatterns(t *testing.T) {
+    var expected = []struct {
+        reject      string
+        domain      string
+        accepted    bool
+    } {
+        // Globs match within a label, and subdomains of matching names
+        {"*.canary.*.svc:", "web.canary.prod.svc", false},
+        {"*.canary.*.svc:", "v2.web.canary.prod.svc", false},
+        {"*.canary.*.svc:", "canary.prod.svc", true},
+        {"*.canary.*.svc:", "web.canary.svc", true},
+        {"*.canary.*.svc:", "web.stable.prod.svc", true},
+        {"tmp-*.disco.net:", "tmp-1234.disco.net", false},
+        {"tmp-*.disco.net:", "TMP-1234.Disco.Net", false},
+        {"tmp-*.disco.net:", "foo.tmp-1234.disco.net", false},
+        {"tmp-*.disco.net:", "tmp.disco.net", true},
+        {"tmp-*.disco.net:", "tmp-1234.xdisco.net", true},
+        {"=tmp-*.disco.net:", "foo.tmp-1234.disco.net", true},
+        {"=tmp-*.disco.net:", "tmp-1234.disco.net", false},
+        {"host-?.disco.net:", "host-1.disco.net", false},
+        {"host-?.disco.net:", "host-12.disco.net", true},
+        {"host-[0-9].disco.net:", "host-7.disco.net", false},
+        {"host-[0-9].disco.net:", "host-x.disco.net", true},
+
+        // Regexes are anchored, and match the whole name
+        {`~tmp-[^.]+\.disco\.net:`, "tmp-1234.disco.net", false},
+        {`~tmp-[^.]+\.disco\.net:`, "foo.tmp-1234.disco.net", true},
+        {`~tmp-[^.]+\.disco\.net:`, "tmp-1234.disco.net.evil", true},
+        {`~(?:[^.]+\.)*tmp-[^.]+\.disco\.net:A`, "foo.tmp-1234.disco.net", false},
+        {`~[a-z]+[0-9]{3}\.disco\.net:`, "WEB001.disco.net", false},
+        {`~[a-z]+[0-9]{3}\.disco\.net:`, "web0001.disco.net", true},
+    }
+
+    for _, e := range expected {
+        filterer := NewQueryFilterer(nil, mustParseFilters([]string{e.reject}))
+        if filterer.ShouldAcceptQuery(generateDNSMessage(e.domain, dns.TypeA)) != e.accepted {
+            t.Error("Expected ", e.domain, " with ", e.reject, " accepted to be ", e.accepted)
+        }
+    }
+}
+
+func TestFilterPatternsMixed(t *testing.T) {
+    filters := mustParseFilters([]string{"disco.net:A", "*.disco.net:AAAA", `~.*\.com:`, "=foo.disco.net:"})
+    trie := newFilterTrie(filters)
+
+    var expected = []struct {
+        domain      string
+        qType       uint16
+        filter      *QueryFilter
+    } {
+        {"foo.disco.net", dns.TypeTXT, &filters[3]},
+        {"bar.disco.net", dns.TypeA, &filters[0]},
+        {"bar.disco.net", dns.TypeAAAA, &filters[1]},
+        {"disco.net", dns.TypeAAAA, nil},
+        {"disco.com", dns.TypeMX, &filters[2]},
+    }
+
+    for _, e := range expected {
+        if filter := trie.Match(generateDNSMessage(e.domain, e.qType), nil); filter != e.filter {
+            t.Error("Expected ", e.domain, " to match ", e.filter, ", got ", filter)
+        }
+    }
+}
+
+func TestFilterDryRun(t *testing.T) {
+    filterer := NewQueryFilterer(nil, mustParseFilters([]string{
+        "disco.net: name=TestFilterDryRun-net mode=dry-run",
+        "com: name=TestFilterDryRun-com",
+        "disco.com: name=TestFilterDryRun-disco-com mode=dry-run"}))
+
+    before := metrics.GetOrRegisterCounter("filter.rules.TestFilterDryRun-net", metrics.DefaultRegistry).Count()
+
+    msg := generateDNSMessage("foo.disco.net", dns.TypeA)
+    if filterer.ShouldAcceptQuery(msg) != true {
+        t.Error("Expected the query to be accepted by a dry run filter")
+        t.Fatal()
+    }
+
+    if count := metrics.GetOrRegisterCounter("filter.rules.TestFilterDryRun-net", metrics.DefaultRegistry).Count(); count != before + 1 {
+        t.Error("Expected the dry run filter to count the query, got ", count - before)
+    }
+
+    // Less specific filters still apply
+    msg = generateDNSMessage("disco.com", dns.TypeA)
+    if accepted, filter := filterer.Filter(msg, nil); accepted != false || filter == nil || filter.name != "TestFilterDryRun-com" {
+        t.Error("Expected the query to be rejected by the enforced filter: ", filter)
+        t.Fatal()
+    }
+
+    // Dry run accept filters don't reject anything
+    filterer = NewQueryFilterer(mustParseFilters([]string{"disco.net: mode=dry-run"}), nil)
+    msg = generateDNSMessage("disco.com", dns.TypeA)
+    if filterer.ShouldAcceptQuery(msg) != true {
+        t.Error("Expected the query to be accepted")
+        t.Fatal()
+    }
+
+    filterer = NewQueryFilterer(mustParseFilters([]string{"disco.net: mode=dry-run", "disco.org:"}), nil)
+    if filterer.ShouldAcceptQuery(msg) != false {
+        t.Error("Expected the query to be rejected by the enforced accept filter")
+        t.Fatal()
+    }
+}
+
+func TestFilterHits(t *testing.T) {
+    filterer := NewQueryFilterer(
+        mustParseFilters([]string{"disco.net: name=TestFilterHits-accept"}),
+        mustParseFilters([]string{"=bad.disco.net:"}))
+
+    _, rejectFilters := filterer.Filters()
+    accept := metrics.GetOrRegisterCounter("filter.rules.TestFilterHits-accept", metrics.DefaultRegistry)
+    reject := metrics.GetOrRegisterCounter("filter.rules." + rejectFilters[0].name, metrics.DefaultRegistry)
+    acceptBefore, rejectBefore := accept.Count(), reject.Count()
+
+    for _, domain := range []string{"foo.disco.net", "bar.disco.net", "bad.disco.net", "disco.com"} {
+        filterer.ShouldAcceptQuery(generateDNSMessage(domain, dns.TypeA))
+    }
+
+    if accept.Count() - acceptBefore != 2 {
+        t.Error("Expected the accept filter to count 2 queries, got ", accept.Count() - acceptBefore)
+    }
+    if reject.Count() - rejectBefore != 1 {
+        t.Error("Expected the reject filter to count 1 query, got ", reject.Count() - rejectBefore)
+    }
+
+    // Hits are kept when the filters are replaced
+    filterer.Set(mustParseFilters([]string{"disco.net:A name=TestFilterHits-accept"}), nil)
+    filterer.ShouldAcceptQuery(generateDNSMessage("foo.disco.net", dns.TypeA))
+    if accept.Count() - acceptBefore != 3 {
+        t.Error("Expected the replaced filter to keep counting, got ", accept.Count() - acceptBefore)
+    }
+}
+
+func TestFilterDefaultNames(t *testing.T) {
+    filterer := NewQueryFilterer(nil, mustParseFilters([]string{"a.disco.net:", "b.disco.net:AAAA"}))
+    _, before := filterer.Filters()
+
+    // Unnamed filters are named after the filter rather than their position,
+    // so adding another filter in front doesn't rename them
+    filterer.Set(nil, mustParseFilters([]string{"c.disco.net:", "a.disco.net:", "b.disco.net:AAAA"}))
+    _, after := filterer.Filters()
+
+    if before[0].name != after[1].name || before[1].name != after[2].name || before[0].name == before[1].name {
+        t.Error("Expected the filters to keep their names: ", before[0].name, before[1].name, after[1].name, after[2].name)
+    }
+
+    if !strings.HasPrefix(after[0].name, "reject_") {
+        t.Error("Expected the filter to be named after its list: ", after[0].name)
+    }
+
+    // The counters of removed filters are unregistered
+    filterer.Set(nil, mustParseFilters([]string{"a.disco.net:"}))
+    if metrics.DefaultRegistry.Get("filter.rules." + before[1].name) != nil {
+        t.Error("Expected the removed filter's counter to be unregistered")
+    }
+    if metrics.DefaultRegistry.Get("filter.rules." + before[0].name) == nil {
+        t.Error("Expected the remaining filter's counter to be kept")
+    }
+}
+
+func TestFilterDebugEndpoint(t *testing.T) {
+    filterer := NewQueryFilterer(
+        mustParseFilters([]string{"disco.net: name=TestFilterDebugEndpoint"}),
+        mustParseFilters([]string{"bad.disco.net: mode=dry-run"}))
+    filterer.ShouldAcceptQuery(generateDNSMessage("foo.disco.net", dns.TypeA))
+
+    recorder := httptest.NewRecorder()
+    filterer.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/filters", nil))
+
+    var status map[string][]filterStatus
+    if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+        t.Error("Unexpected error decoding filters: ", err)
+        t.Fatal()
+    }
+
+    if len(status["accept"]) != 1 || len(status["reject"]) != 1 {
+        t.Error("Expected one accept and one reject filter: ", status)
+        t.Fatal()
+    }
+
+    accept := status["accept"][0]
+    if accept.Name != "TestFilterDebugEndpoint" || accept.Filter != "disco.net.:" || accept.DryRun || accept.Hits < 1 {
+        t.Error("Unexpected accept filter: ", accept)
+    }
+
+    reject := status["reject"][0]
+    if !strings.HasPrefix(reject.Name, "reject_") || reject.Filter != "bad.disco.net.: mode=dry-run" || !reject.DryRun {
+        t.Error("Unexpected reject filter: ", reject)
+    }
+}
+
+func TestParseInvalidFilters(t *testing.T) {
+    invalid := []string{
+        "disco.net",
+        "disco.net:A:AAAA",
+        "disco.net: from=10.0.0.0/33",
+        "disco.net: from=not-an-address",
+        "disco.net: from=",
+        "disco.net: transport=tls",
+        "disco.net: colour=blue",
+        "disco.net: action=ignore",
+        "disco.net: action=refused:10.0.0.1",
+        "disco.net: action=sinkhole",
+        "disco.net: action=sinkhole:not..valid",
+        "~tmp-(:A",
+        "~tmp-",
+        "host-[0-9.disco.net:",
+        "disco.net: mode=maybe",
+        "disco.net: name=disco.net",
+    }
+
+    for _, filter := range invalid {
+        if _, err := parseFilters([]string{filter}); err == nil {
+            t.Error("Expected an error parsing ", filter)
+        }
+    }
+}
+
+// mustParseFilters returns the parsed filters, and panics if any are invalid
+func mustParseFilters(filters []string) []QueryFilter {
+    parsed, err := parseFilters(filters)
+    if err != nil {
+        panic(err)
+    }
+    return parsed
+}
+
 // generateDNSMessage returns a simple DNS query with a single question,
 // comprised of the domain and rrType given.
 func generateDNSMessage(domain string, rrType uint16) *dns.Msg {
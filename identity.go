@@ -0,0 +1,83 @@
+package main
+
+import (
+    "encoding/hex"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "strings"
+)
+
+// ServerIdentity tells clients which discodns instance answered their query,
+// through CHAOS class TXT queries and the EDNS NSID option (RFC 5001). Either
+// value may be left empty to hide it.
+type ServerIdentity struct {
+    id          string      // hostname.bind, id.server and NSID
+    version     string      // version.bind and version.server
+}
+
+func NewServerIdentity(id string, version string) *ServerIdentity {
+    return &ServerIdentity{id: id, version: version}
+}
+
+// value returns the identity value for the given CHAOS name, and whether the
+// name is one we know about
+func (i *ServerIdentity) value(name string) (value string, ok bool) {
+    switch strings.ToLower(name) {
+    case "hostname.bind.", "id.server.":
+        return i.id, true
+    case "version.bind.", "version.server.":
+        return i.version, true
+    }
+
+    return "", false
+}
+
+// AnswerChaos answers a CHAOS class query. Names we don't know about, or that
+// have been hidden, are refused.
+func (i *ServerIdentity) AnswerChaos(req *dns.Msg) (msg *dns.Msg) {
+    counter := metrics.GetOrRegisterCounter("identity.chaos_queries", metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    msg = new(dns.Msg)
+    msg.SetReply(req)
+
+    q := req.Question[0]
+    value, ok := "", false
+    if i != nil {
+        value, ok = i.value(q.Name)
+    }
+
+    if !ok || len(value) == 0 {
+        msg.SetRcode(req, dns.RcodeRefused)
+        return
+    }
+
+    msg.Authoritative = true
+    if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+        header := dns.RR_Header{Name: q.Name, Class: dns.ClassCHAOS, Rrtype: dns.TypeTXT}
+        msg.Answer = []dns.RR{&dns.TXT{Hdr: header, Txt: []string{value}}}
+    }
+
+    return
+}
+
+// SetNSID adds our identifier to the response if the client asked for it
+func (i *ServerIdentity) SetNSID(req *dns.Msg, msg *dns.Msg) {
+    reqOpt := req.IsEdns0()
+    if i == nil || reqOpt == nil || len(i.id) == 0 {
+        return
+    }
+
+    for _, option := range reqOpt.Option {
+        if option.Option() == dns.EDNS0NSID {
+            counter := metrics.GetOrRegisterCounter("identity.nsid_requests", metrics.DefaultRegistry)
+            counter.Inc(1)
+
+            opt := responseOpt(req, msg)
+            opt.Option = append(opt.Option, &dns.EDNS0_NSID{
+                Code: dns.EDNS0NSID,
+                Nsid: hex.EncodeToString([]byte(i.id))})
+            return
+        }
+    }
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+    "encoding/hex"
+    "github.com/miekg/dns"
+    "testing"
+)
+
+func TestChaosQueries(t *testing.T) {
+    handler := newTestHandler(nil)
+    handler.identity = NewServerIdentity("ns1.example.com", "")
+
+    var expected = []struct {
+        name    string
+        qType   uint16
+        rcode   int
+        answer  string
+    }{
+        {"hostname.bind.", dns.TypeTXT, dns.RcodeSuccess, "ns1.example.com"},
+        {"ID.SERVER.", dns.TypeTXT, dns.RcodeSuccess, "ns1.example.com"},
+        {"id.server.", dns.TypeANY, dns.RcodeSuccess, "ns1.example.com"},
+        {"id.server.", dns.TypeA, dns.RcodeSuccess, ""},
+        {"version.bind.", dns.TypeTXT, dns.RcodeRefused, ""},
+        {"version.server.", dns.TypeTXT, dns.RcodeRefused, ""},
+        {"authors.bind.", dns.TypeTXT, dns.RcodeRefused, ""}}
+
+    for _, test := range expected {
+        query := new(dns.Msg)
+        query.SetQuestion(test.name, test.qType)
+        query.Question[0].Qclass = dns.ClassCHAOS
+
+        writer := &testResponseWriter{}
+        handler.Handle(writer, query)
+
+        if len(writer.messages) != 1 {
+            t.Error("Expected one response, got ", len(writer.messages))
+            t.Fatal()
+        }
+
+        msg := writer.messages[0]
+        if msg.Rcode != test.rcode {
+            t.Error("Expected ", dns.RcodeToString[test.rcode], " for ", test.name, ": ", dns.RcodeToString[msg.Rcode])
+            continue
+        }
+
+        if len(test.answer) == 0 {
+            if len(msg.Answer) > 0 {
+                t.Error("Didn't expect any answers for ", test.name)
+            }
+            continue
+        }
+
+        if len(msg.Answer) != 1 {
+            t.Error("Expected one answer for ", test.name, ", got ", len(msg.Answer))
+            continue
+        }
+
+        rr := msg.Answer[0].(*dns.TXT)
+        if rr.Hdr.Class != dns.ClassCHAOS || len(rr.Txt) != 1 || rr.Txt[0] != test.answer {
+            t.Error("Unexpected answer for ", test.name, ": ", rr)
+        }
+    }
+}
+
+func TestChaosQueriesDisabled(t *testing.T) {
+    handler := newTestHandler(nil)
+
+    query := new(dns.Msg)
+    query.SetQuestion("version.bind.", dns.TypeTXT)
+    query.Question[0].Qclass = dns.ClassCHAOS
+
+    writer := &testResponseWriter{}
+    handler.Handle(writer, query)
+
+    if len(writer.messages) != 1 || writer.messages[0].Rcode != dns.RcodeRefused {
+        t.Error("Expected CHAOS queries to be refused")
+    }
+}
+
+func TestNSID(t *testing.T) {
+    handler := newTestHandler(nil)
+    handler.identity = NewServerIdentity("ns1.example.com", "discodns")
+    handler.queryFilterer = NewQueryFilterer(nil, []QueryFilter{QueryFilter{domain: "disco.net.", action: filterActionRefused}})
+
+    query := new(dns.Msg)
+    query.SetQuestion("foo.disco.net.", dns.TypeA)
+    query.SetEdns0(4096, false)
+    opt := query.IsEdns0()
+    opt.Option = append(opt.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+
+    writer := &testResponseWriter{}
+    handler.Handle(writer, query)
+
+    if len(writer.messages) != 1 {
+        t.Error("Expected one response, got ", len(writer.messages))
+        t.Fatal()
+    }
+
+    opt = writer.messages[0].IsEdns0()
+    if opt == nil || len(opt.Option) != 1 {
+        t.Error("Expected an OPT record with the NSID option")
+        t.Fatal()
+    }
+
+    nsid := opt.Option[0].(*dns.EDNS0_NSID)
+    if nsid.Nsid != hex.EncodeToString([]byte("ns1.example.com")) {
+        t.Error("Unexpected NSID: ", nsid.Nsid)
+    }
+
+    // The extended error for the rejection should still be included
+    extendedError, err := unpackExtendedError(writer.written[0])
+    if err != nil || extendedError == nil || extendedError.Code != edeBlocked {
+        t.Error("Expected a Blocked extended error alongside the NSID: ", err)
+    }
+
+    // Clients that don't ask for an NSID don't get one
+    query.Extra = nil
+    query.SetEdns0(4096, false)
+
+    writer = &testResponseWriter{}
+    handler.Handle(writer, query)
+
+    for _, option := range writer.messages[0].IsEdns0().Option {
+        if option.Option() == dns.EDNS0NSID {
+            t.Error("Didn't expect an NSID without asking for one")
+        }
+    }
+}
@@ -4,47 +4,101 @@ import (
     "github.com/coreos/go-etcd/etcd"
     "github.com/jessevdk/go-flags"
     "github.com/rcrowley/go-metrics"
-    "github.com/miekg/dns"
     "log"
     "os"
     "os/signal"
     "runtime"
+    "sync/atomic"
     "time"
     "net"
-    "strings"
+    "net/http"
+    "syscall"
 )
 
 var (
     logger = log.New(os.Stderr, "[discodns] ", log.Ldate|log.Ltime)
-    log_debug = false
+    log_debug int32 // Set atomically, as reloading the config can change it
 
     // Define all of the command line arguments
-    Options struct {
-        ListenAddress       string      `short:"l" long:"listen" description:"Listen IP address" default:"0.0.0.0"`
-        ListenPort          int         `short:"p" long:"port" description:"Port to listen on" default:"53"`
-        EtcdHosts           []string    `short:"e" long:"etcd" description:"host:port[,host:port] for etcd hosts" default:"127.0.0.1:4001"`
-        Debug               bool        `short:"v" long:"debug" description:"Enable debug logging"`
-        MetricsDuration     int         `short:"m" long:"metrics" description:"Dump metrics to stderr every N seconds" default:"30"`
-        GraphiteServer      string      `long:"graphite" description:"Graphite server to send metrics to"`
-        GraphiteDuration    int         `long:"graphite-duration" description:"Duration to periodically send metrics to the graphite server" default:"10"`
-        DefaultTtl          uint32      `short:"t" long:"default-ttl" description:"Default TTL to return on records without an explicit TTL" default:"300"`
-        Accept              []string    `long:"accept" description:"Limit DNS queries to a set of domain:[type,...] pairs"`
-        Reject              []string    `long:"reject" description:"Limit DNS queries to a set of domain:[type,...] pairs"`
-    }
+    Options CommandOptions
 )
 
+// CommandOptions are the options given on the command line, or in a config file
+type CommandOptions struct {
+    Config              string      `short:"c" long:"config" description:"Path to a TOML config file of options, any given on the command line take precedence"`
+    ListenAddress       string      `short:"l" long:"listen" description:"Listen IP address" default:"0.0.0.0"`
+    ListenPort          int         `short:"p" long:"port" description:"Port to listen on" default:"53"`
+    EtcdHosts           []string    `short:"e" long:"etcd" description:"host:port[,host:port] for etcd hosts" default:"127.0.0.1:4001"`
+    Debug               bool        `short:"v" long:"debug" description:"Enable debug logging"`
+    MetricsDuration     int         `short:"m" long:"metrics" description:"Dump metrics to stderr every N seconds" default:"30"`
+    DebugListen         string      `long:"debug-listen" description:"host:port to serve debugging endpoints on over HTTP (e.g /debug/filters)"`
+    GraphiteServer      string      `long:"graphite" description:"Graphite server to send metrics to"`
+    GraphiteDuration    int         `long:"graphite-duration" description:"Duration to periodically send metrics to the graphite server" default:"10"`
+    DefaultTtl          uint32      `short:"t" long:"default-ttl" description:"Default TTL to return on records without an explicit TTL" default:"300"`
+    Accept              []string    `long:"accept" description:"Limit DNS queries to a set of domain:[type,...] pairs, optionally followed by from=cidr,... and transport=udp|tcp"`
+    Reject              []string    `long:"reject" description:"Limit DNS queries to a set of domain:[type,...] pairs, optionally followed by from=cidr,..., transport=udp|tcp and action=nxdomain|refused|drop|sinkhole:target"`
+    EtcdFilters         bool        `long:"etcd-filters" description:"Load accept and reject filters from etcd (beneath /_discodns/filters/), and reload them when they change"`
+    RPZZones            []string    `long:"rpz-zone" description:"Path to a response policy zone file, to block or rewrite queries (can be given more than once, earlier zones take precedence)"`
+    EtcdRPZ             bool        `long:"etcd-rpz" description:"Load response policy zones from etcd (beneath /_discodns/rpz/), and reload them when they change"`
+    AliasUpstream       string      `long:"alias-upstream" description:"host:port of a nameserver used to resolve ALIAS targets that aren't stored in etcd"`
+    SynthesizePTR       bool        `long:"synthesize-ptr" description:"Answer reverse lookups without a PTR record from an index of A and AAAA records"`
+    PTRPolicy           string      `long:"ptr-policy" description:"Which names to return when several share an address (all, oldest, newest, shortest)" default:"oldest"`
+    SOASerial           string      `long:"soa-serial" description:"How to generate SOA serial numbers (index, date, stored)" default:"index"`
+    Zones               []string    `long:"zone" description:"Only answer queries within the given zone, others are refused"`
+    DiscoverZones       bool        `long:"discover-zones" description:"Only answer queries within zones that have an SOA record, others are refused"`
+    VerboseErrors       []string    `long:"verbose-errors" description:"Include the full error in Extended DNS Errors sent to clients within the given CIDR"`
+    Identity            bool        `long:"identity" description:"Identify this server in CHAOS TXT queries (hostname.bind, id.server, version.bind, version.server) and EDNS NSID responses"`
+    IdentityId          string      `long:"identity-id" description:"Identifier returned for hostname.bind, id.server and NSID, defaults to the hostname"`
+    IdentityVersion     string      `long:"identity-version" description:"Version returned for version.bind and version.server" default:"discodns"`
+    HideId              bool        `long:"hide-id" description:"Refuse hostname.bind and id.server queries, and don't return an NSID"`
+    HideVersion         bool        `long:"hide-version" description:"Refuse version.bind and version.server queries"`
+    AnyPolicy           string      `long:"any-policy" description:"How to answer ANY queries (hinfo, single, full)" default:"hinfo"`
+    AnyFullClients      []string    `long:"any-full-clients" description:"Answer ANY queries over TCP from clients within the given CIDR with every record"`
+    QueryTimeout        int         `long:"query-timeout" description:"Milliseconds to spend answering a query before responding with SERVFAIL, 0 to wait for etcd indefinitely" default:"2000"`
+    MaxEtcdRequests     int         `long:"max-etcd-requests" description:"Maximum number of etcd requests in flight, queries needing more fail immediately (0 for no limit)" default:"128"`
+    RRLResponsesPerSecond int       `long:"rrl-responses-per-second" description:"Limit identical UDP responses to each client network to N per second (response rate limiting), 0 to disable" default:"0"`
+    RRLWindow           int         `long:"rrl-window" description:"Seconds over which response rates are averaged, clients exceeding the limit must slow down for this long" default:"15"`
+    RRLSlip             int         `long:"rrl-slip" description:"Send every Nth rate limited response truncated (so clients retry over TCP) rather than dropping it, 0 to drop them all" default:"2"`
+    RRLIPv4Prefix       int         `long:"rrl-ipv4-prefix" description:"Prefix length of the IPv4 networks that share response rate limits" default:"24"`
+    RRLIPv6Prefix       int         `long:"rrl-ipv6-prefix" description:"Prefix length of the IPv6 networks that share response rate limits" default:"56"`
+    RRLExempt           []string    `long:"rrl-exempt" description:"Never rate limit responses to clients within the given CIDR"`
+    RRLLogOnly          bool        `long:"rrl-log-only" description:"Log and count the responses that would be rate limited, but send them anyway"`
+    RRLMaxTableSize     int         `long:"rrl-max-table-size" description:"Most responses (per client network) to track for rate limiting, the least recently used are forgotten to make room, 0 for no limit" default:"20000"`
+    ClientRate          float64     `long:"client-rate" description:"Limit the queries from each client address to N per second, 0 for no limit" default:"0"`
+    ClientBurst         int         `long:"client-burst" description:"Number of queries each client address may send in a burst before --client-rate applies" default:"50"`
+    NetworkRate         float64     `long:"network-rate" description:"Limit the queries from each client network to N per second, 0 for no limit" default:"0"`
+    NetworkBurst        int         `long:"network-burst" description:"Number of queries each client network may send in a burst before --network-rate applies" default:"200"`
+    NetworkIPv4Prefix   int         `long:"network-ipv4-prefix" description:"Prefix length of the IPv4 networks limited by --network-rate" default:"24"`
+    NetworkIPv6Prefix   int         `long:"network-ipv6-prefix" description:"Prefix length of the IPv6 networks limited by --network-rate" default:"56"`
+    RateLimitAction     string      `long:"rate-limit-action" description:"How to answer queries over the client and network rates (refused, drop)" default:"refused"`
+    RateLimitExempt     []string    `long:"rate-limit-exempt" description:"Never limit the rate of queries from clients within the given CIDR"`
+    RateLimitMaxClients int         `long:"rate-limit-max-clients" description:"Most clients and networks to track for --client-rate and --network-rate, the least recently used are forgotten to make room, 0 for no limit" default:"100000"`
+}
+
 func main() {
 
-    _, err := flags.ParseArgs(&Options, os.Args[1:])
+    options, err := parseOptions(os.Args[1:], flags.Default)
     if err != nil {
+        if _, ok := err.(*flags.Error); !ok {
+            logger.Printf("[ERROR] %s", err)
+        }
         os.Exit(1)
     }
+    Options = *options
 
     if Options.Debug {
-        log_debug = true
+        setDebug(true)
         debugMsg("Debug mode enabled")
     }
 
+    if err := validateSerialStrategy(Options.SOASerial); err != nil {
+        logger.Fatalf("Invalid --soa-serial option: %s", err)
+    }
+
+    if err := validateAnyPolicy(Options.AnyPolicy); err != nil {
+        logger.Fatalf("Invalid --any-policy option: %s", err)
+    }
+
     // Create an ETCD client
     etcd := etcd.NewClient(Options.EtcdHosts)
     if !etcd.SyncCluster() {
@@ -52,31 +106,167 @@ func main() {
     }
 
     // Register the metrics writer
-    if len(Options.GraphiteServer) > 0 {
-        addr, err := net.ResolveTCPAddr("tcp", Options.GraphiteServer)
+    reporter, err := NewMetricsReporter(Options.GraphiteServer, Options.GraphiteDuration, Options.MetricsDuration)
+    if err != nil {
+        logger.Fatalf("Invalid --graphite option: %s", err)
+    }
+    reporter.Start()
+
+    if len(Options.GraphiteServer) == 0 && Options.MetricsDuration > 0 {
+        // Register a bunch of debug metrics
+        metrics.RegisterDebugGCStats(metrics.DefaultRegistry)
+        metrics.RegisterRuntimeMemStats(metrics.DefaultRegistry)
+        go metrics.CaptureDebugGCStats(metrics.DefaultRegistry, time.Duration(Options.MetricsDuration))
+        go metrics.CaptureRuntimeMemStats(metrics.DefaultRegistry, time.Duration(Options.MetricsDuration))
+    }
+
+    // Work out which zones we're serving, if we've been asked to
+    var zones *ZoneList
+    if len(Options.Zones) > 0 {
+        zones = NewZoneList(Options.Zones)
+    } else if Options.DiscoverZones {
+        zones = NewDiscoveredZoneList(etcd, "")
+        zones.Start()
+    }
+
+    // Keep track of changes to each zone for their SOA serials
+    var serials *ZoneSerials
+    if Options.SOASerial != "date" {
+        serials = NewZoneSerials(etcd, "")
+        serials.Start()
+    }
+
+    // Build an index of address records for synthesizing PTR records
+    var reverseIndex *ReverseIndex
+    if Options.SynthesizePTR {
+        reverseIndex, err = NewReverseIndex(etcd, "", Options.PTRPolicy, zones)
+        if err != nil {
+            logger.Fatalf("Failed to create reverse index: %s", err)
+        }
+
+        reverseIndex.Start()
+    }
+
+    acceptFilters, err := parseFilters(Options.Accept)
+    if err != nil {
+        logger.Fatalf("Invalid --accept option: %s", err)
+    }
+
+    rejectFilters, err := parseFilters(Options.Reject)
+    if err != nil {
+        logger.Fatalf("Invalid --reject option: %s", err)
+    }
+
+    queryFilterer := NewQueryFilterer(acceptFilters, rejectFilters)
+    if Options.EtcdFilters {
+        queryFilterer = NewEtcdQueryFilterer(etcd, etcdFiltersKey, acceptFilters, rejectFilters)
+        queryFilterer.Start()
+    }
+
+    policies, err := NewResponsePolicies(Options.RPZZones)
+    if err != nil {
+        logger.Fatalf("Invalid --rpz-zone option: %s", err)
+    }
+    if Options.EtcdRPZ {
+        policies.WatchEtcd(etcd, etcdPoliciesKey)
+        policies.Start()
+    }
+
+    // Clients that are sent the full details of any errors
+    verboseNetworks, err := parseNetworks(Options.VerboseErrors)
+    if err != nil {
+        logger.Fatalf("Invalid --verbose-errors option: %s", err)
+    }
+
+    // Clients that may ask for every record with ANY queries
+    anyFullNetworks, err := parseNetworks(Options.AnyFullClients)
+    if err != nil {
+        logger.Fatalf("Invalid --any-full-clients option: %s", err)
+    }
+
+    // Limit the rate of responses, to avoid being used in reflection attacks
+    var rateLimiter *ResponseRateLimiter
+    if Options.RRLResponsesPerSecond > 0 {
+        if Options.RRLIPv4Prefix < 0 || Options.RRLIPv4Prefix > 32 {
+            logger.Fatalf("Invalid --rrl-ipv4-prefix option: %d", Options.RRLIPv4Prefix)
+        }
+        if Options.RRLIPv6Prefix < 0 || Options.RRLIPv6Prefix > 128 {
+            logger.Fatalf("Invalid --rrl-ipv6-prefix option: %d", Options.RRLIPv6Prefix)
+        }
+
+        if Options.RRLMaxTableSize < 0 {
+            logger.Fatalf("Invalid --rrl-max-table-size option: %d", Options.RRLMaxTableSize)
+        }
+
+        exemptNetworks, err := parseNetworks(Options.RRLExempt)
         if err != nil {
-            logger.Fatalf("Failed to parse graphite server: ", err)
+            logger.Fatalf("Invalid --rrl-exempt option: %s", err)
+        }
+
+        rateLimiter = NewResponseRateLimiter(Options.RRLResponsesPerSecond, Options.RRLWindow, Options.RRLSlip,
+                                             Options.RRLIPv4Prefix, Options.RRLIPv6Prefix, exemptNetworks, Options.RRLLogOnly,
+                                             Options.RRLMaxTableSize)
+    }
+
+    // Limit the rate of queries from each client, so one can't overload etcd
+    var clientLimiter *ClientRateLimiter
+    if Options.ClientRate > 0 || Options.NetworkRate > 0 {
+        if err := validateRateLimitAction(Options.RateLimitAction); err != nil {
+            logger.Fatalf("Invalid --rate-limit-action option: %s", err)
+        }
+        if Options.ClientBurst < 1 || Options.NetworkBurst < 1 {
+            logger.Fatalf("Invalid --client-burst or --network-burst option, must be at least 1")
+        }
+        if Options.NetworkIPv4Prefix < 0 || Options.NetworkIPv4Prefix > 32 {
+            logger.Fatalf("Invalid --network-ipv4-prefix option: %d", Options.NetworkIPv4Prefix)
+        }
+        if Options.NetworkIPv6Prefix < 0 || Options.NetworkIPv6Prefix > 128 {
+            logger.Fatalf("Invalid --network-ipv6-prefix option: %d", Options.NetworkIPv6Prefix)
         }
 
-        prefix := "discodns"
-        hostname, err := os.Hostname()
+        if Options.RateLimitMaxClients < 0 {
+            logger.Fatalf("Invalid --rate-limit-max-clients option: %d", Options.RateLimitMaxClients)
+        }
+
+        exemptNetworks, err := parseNetworks(Options.RateLimitExempt)
         if err != nil {
-            logger.Fatalf("Unable to get hostname: ", err)
+            logger.Fatalf("Invalid --rate-limit-exempt option: %s", err)
         }
 
-        prefix = prefix + "." + strings.Replace(hostname, ".", "_", -1)
+        clientLimiter = NewClientRateLimiter(Options.ClientRate, Options.ClientBurst, Options.NetworkRate, Options.NetworkBurst,
+                                             Options.NetworkIPv4Prefix, Options.NetworkIPv6Prefix, Options.RateLimitAction, exemptNetworks,
+                                             Options.RateLimitMaxClients)
+    }
 
-        go metrics.Graphite(metrics.DefaultRegistry, time.Duration(Options.GraphiteDuration) * time.Second, prefix, addr)
-    } else if Options.MetricsDuration > 0 {
-        go metrics.Log(metrics.DefaultRegistry, time.Duration(Options.MetricsDuration) * time.Second, logger)
+    // Tell clients which server answered their query, if we've been asked to
+    var identity *ServerIdentity
+    if Options.Identity {
+        id := Options.IdentityId
+        if len(id) == 0 {
+            id, err = os.Hostname()
+            if err != nil {
+                logger.Fatalf("Unable to get hostname: %s", err)
+            }
+        }
+        if Options.HideId {
+            id = ""
+        }
 
-        // Register a bunch of debug metrics
-        metrics.RegisterDebugGCStats(metrics.DefaultRegistry)
-        metrics.RegisterRuntimeMemStats(metrics.DefaultRegistry)
-        go metrics.CaptureDebugGCStats(metrics.DefaultRegistry, time.Duration(Options.MetricsDuration))
-        go metrics.CaptureRuntimeMemStats(metrics.DefaultRegistry, time.Duration(Options.MetricsDuration))
-    } else {
-        logger.Printf("Metric logging disabled")
+        version := Options.IdentityVersion
+        if Options.HideVersion {
+            version = ""
+        }
+
+        identity = NewServerIdentity(id, version)
+    }
+
+    if len(Options.DebugListen) > 0 {
+        handlers := map[string]http.Handler{"/debug/filters": queryFilterer}
+        if clientLimiter != nil {
+            handlers["/debug/clients"] = clientLimiter
+        }
+
+        startDebugServer(Options.DebugListen, handlers)
     }
 
     // Start up the DNS resolver server
@@ -87,28 +277,66 @@ func main() {
         rTimeout: time.Duration(5) * time.Second,
         wTimeout: time.Duration(5) * time.Second,
         defaultTtl: Options.DefaultTtl,
-        queryFilterer: &QueryFilterer{acceptFilters: parseFilters(Options.Accept),
-                                      rejectFilters: parseFilters(Options.Reject)}}
+        aliasUpstream: Options.AliasUpstream,
+        reverseIndex: reverseIndex,
+        soaSerial: Options.SOASerial,
+        serials: serials,
+        zones: zones,
+        queryFilterer: queryFilterer,
+        policies: policies,
+        verboseNetworks: verboseNetworks,
+        identity: identity,
+        anyPolicy: Options.AnyPolicy,
+        anyFullNetworks: anyFullNetworks,
+        queryTimeout: time.Duration(Options.QueryTimeout) * time.Millisecond,
+        maxInflight: Options.MaxEtcdRequests,
+        rateLimiter: rateLimiter,
+        clientLimiter: clientLimiter}
 
     server.Run()
 
     logger.Printf("Listening on %s:%d\n", Options.ListenAddress, Options.ListenPort)
 
-    sig := make(chan os.Signal)
-    signal.Notify(sig, os.Interrupt)
+    // Apply changes to the configuration when sent a SIGHUP
+    reloader := NewReloader(os.Args[1:], options, server, queryFilterer, reporter)
+
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, os.Interrupt, syscall.SIGHUP)
 
 forever:
     for {
         select {
-        case <-sig:
+        case received := <-sig:
+            if received == syscall.SIGHUP {
+                logger.Printf("Reloading the configuration")
+                if err := reloader.Reload(); err != nil {
+                    logger.Printf("[ERROR] %s", err)
+                }
+                continue
+            }
+
             logger.Printf("Bye bye :(\n")
             break forever
         }
     }
 }
 
+// setDebug enables or disables debug logging, and is safe to call while
+// queries are being handled
+func setDebug(enabled bool) {
+    var value int32
+    if enabled {
+        value = 1
+    }
+    atomic.StoreInt32(&log_debug, value)
+}
+
+func debugEnabled() bool {
+    return atomic.LoadInt32(&log_debug) == 1
+}
+
 func debugMsg(v ...interface{}) {
-    if log_debug {
+    if debugEnabled() {
         vars := []interface{}{"[", runtime.NumGoroutine(), "]"}
         vars = append(vars, v...)
 
@@ -117,32 +345,45 @@ func debugMsg(v ...interface{}) {
 }
 
 // parseFilters will convert a string into a Query Filter structure. The accepted
-// format for input is [domain]:[type,type,...]. For example...
+// format for input is [=|~][domain]:[type,type,...] [option=value ...]. For example...
 // 
 // - "domain:A,AAAA" # Match all A and AAAA queries within `domain`
 // - ":TXT" # Matches only TXT queries for any domain
 // - "domain:" # Matches any query within `domain`
-func parseFilters(filters []string) []QueryFilter {
-    parsedFilters := make([]QueryFilter, 0)
+// - "=domain:" # Matches any query for `domain` itself, but not its subdomains
+// - "tmp-*.domain:" # Matches any query within `domain` for a name starting with tmp-
+// - "~tmp-[0-9]+\.domain:" # Matches queries for names matching the (anchored) regex
+// - "domain: from=10.0.0.0/8" # Matches queries within `domain` from 10.0.0.0/8
+// - ":ANY from=!10.0.0.0/8,!fd00::/8" # Matches ANY queries from outside both networks
+// - "domain: transport=udp" # Matches queries within `domain` sent over UDP
+// - "domain: action=refused" # Answers rejected queries within `domain` with REFUSED
+func parseFilters(filters []string) (parsedFilters []QueryFilter, err error) {
+    parsedFilters = make([]QueryFilter, 0)
     for _, filter := range filters {
-        components := strings.Split(filter, ":")
-        if len(components) != 2 {
-            logger.Printf("Expected only one colon ([domain]:[type,type...])")
-            continue
+        parsed, err := parseFilter(filter)
+        if err != nil {
+            return nil, err
         }
 
-        domain := dns.Fqdn(components[0])
-        types := strings.Split(components[1], ",")
+        debugMsg("Adding filter " + parsed.String())
+        parsedFilters = append(parsedFilters, parsed)
+    }
 
-        if len(types) == 1 && len(types[0]) == 0 {
-            types = make([]string, 0)
-        }
+    return
+}
 
-        debugMsg("Adding filter with domain '" + domain + "' and types '" + strings.Join(types, ",") + "'")
-        parsedFilters = append(parsedFilters, QueryFilter{domain, types})
+// parseNetworks converts a list of CIDR strings into networks
+func parseNetworks(cidrs []string) (networks []*net.IPNet, err error) {
+    networks = make([]*net.IPNet, 0, len(cidrs))
+    for _, cidr := range cidrs {
+        _, network, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return nil, err
+        }
+        networks = append(networks, network)
     }
 
-    return parsedFilters
+    return
 }
 
 func init() {
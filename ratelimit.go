@@ -0,0 +1,268 @@
+package main
+
+import (
+    "fmt"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    rateLimitActionRefused  = "refused"
+    rateLimitActionDrop     = "drop"
+
+    // How often idle clients are forgotten, and the top offender metrics are
+    // updated
+    rateLimitPruneInterval  = 10 * time.Second
+    rateLimitIdleTimeout    = time.Minute
+
+    // How many of the top offenders are reported as metrics
+    rateLimitTopOffenders   = 10
+)
+
+// ClientRateLimiter limits the rate of queries from each client address, and
+// from each network of clients, so a single misbehaving client can't saturate
+// etcd. Each address and network has a bucket of tokens, refilled at the
+// configured rate up to the burst size, and every query spends one.
+type ClientRateLimiter struct {
+    lock            sync.Mutex
+    clientLimit     rateLimit
+    networkLimit    rateLimit
+    ipv4Prefix      int
+    ipv6Prefix      int
+    action          string
+    exempt          []*net.IPNet
+    buckets         *bucketTable
+    offenderMetrics []string
+    pruned          time.Time
+    now             func() time.Time
+}
+
+// rateLimit is a number of queries per second, allowing bursts of up to burst
+// queries at once. A rate of zero is unlimited.
+type rateLimit struct {
+    rate            float64
+    burst           int
+}
+
+type clientBucket struct {
+    key             string
+    tokens          float64
+    updated         time.Time
+    queries         int64
+    limited         int64
+}
+
+// clientStatus is the state of a limited client or network, used for metrics
+// and the debug endpoint
+type clientStatus struct {
+    Client          string  `json:"client"`
+    Queries         int64   `json:"queries"`
+    Limited         int64   `json:"limited"`
+}
+
+// NewClientRateLimiter returns a limiter keeping at most maxBuckets clients and
+// networks, evicting the least recently used when there are more (or any
+// number if zero).
+func NewClientRateLimiter(clientRate float64, clientBurst int, networkRate float64, networkBurst int, ipv4Prefix int, ipv6Prefix int, action string, exempt []*net.IPNet, maxBuckets int) *ClientRateLimiter {
+    return &ClientRateLimiter{
+        clientLimit: rateLimit{clientRate, clientBurst},
+        networkLimit: rateLimit{networkRate, networkBurst},
+        ipv4Prefix: ipv4Prefix,
+        ipv6Prefix: ipv6Prefix,
+        action: action,
+        exempt: exempt,
+        buckets: newBucketTable(maxBuckets),
+        now: time.Now}
+}
+
+// validateRateLimitAction returns an error for an unknown rate limit action
+func validateRateLimitAction(action string) error {
+    if action != rateLimitActionRefused && action != rateLimitActionDrop {
+        return fmt.Errorf("Unknown rate limit action '%s'", action)
+    }
+    return nil
+}
+
+// Allow returns true if the query from the client should be answered, spending
+// a token from both the client's bucket and its network's bucket
+func (l *ClientRateLimiter) Allow(addr net.Addr) bool {
+    if l == nil {
+        return true
+    }
+
+    ip := addrIP(addr)
+    if ip == nil || addrInNetworks(addr, l.exempt) {
+        return true
+    }
+
+    if ip4 := ip.To4(); ip4 != nil {
+        ip = ip4
+    }
+
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    now := l.now()
+    l.prune(now)
+
+    client := l.bucket(ip.String(), l.clientLimit, now)
+    network := l.bucket(clientNetwork(ip, l.ipv4Prefix, l.ipv6Prefix), l.networkLimit, now)
+
+    // Only spend tokens when both buckets have one, so queries refused for
+    // the network don't also use up the client's allowance
+    allowed := true
+    for _, bucket := range []*clientBucket{client, network} {
+        if bucket != nil {
+            bucket.queries++
+            if bucket.tokens < 1 {
+                bucket.limited++
+                allowed = false
+            }
+        }
+    }
+
+    if allowed {
+        for _, bucket := range []*clientBucket{client, network} {
+            if bucket != nil {
+                bucket.tokens -= 1
+            }
+        }
+    }
+
+    return allowed
+}
+
+// Limit answers a query that wasn't allowed, returning nil if it should be
+// dropped
+func (l *ClientRateLimiter) Limit(req *dns.Msg) (msg *dns.Msg) {
+    counter := metrics.GetOrRegisterCounter("ratelimit.actions." + l.action, metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    if l.action == rateLimitActionDrop {
+        return nil
+    }
+
+    msg = new(dns.Msg)
+    msg.SetRcode(req, dns.RcodeRefused)
+    return
+}
+
+// bucket returns the refilled bucket for the key, or nil if the limit is
+// disabled
+func (l *ClientRateLimiter) bucket(key string, limit rateLimit, now time.Time) *clientBucket {
+    if limit.rate <= 0 {
+        return nil
+    }
+
+    var bucket *clientBucket
+    if value, ok := l.buckets.Get(key, now); ok {
+        bucket = value.(*clientBucket)
+    } else {
+        bucket = &clientBucket{key: key, tokens: float64(limit.burst), updated: now}
+        if l.buckets.Add(key, bucket, now) {
+            evicted_counter := metrics.GetOrRegisterCounter("ratelimit.evicted", metrics.DefaultRegistry)
+            evicted_counter.Inc(1)
+        }
+    }
+
+    bucket.tokens += now.Sub(bucket.updated).Seconds() * limit.rate
+    if bucket.tokens > float64(limit.burst) {
+        bucket.tokens = float64(limit.burst)
+    }
+    bucket.updated = now
+
+    return bucket
+}
+
+// prune forgets the clients that haven't sent a query for a while, and
+// updates the top offender metrics. This happens at most once per interval.
+func (l *ClientRateLimiter) prune(now time.Time) {
+    if now.Sub(l.pruned) < rateLimitPruneInterval {
+        return
+    }
+    l.pruned = now
+
+    l.buckets.Expire(now.Add(-rateLimitIdleTimeout))
+
+    gauge := metrics.GetOrRegisterGauge("ratelimit.clients", metrics.DefaultRegistry)
+    gauge.Update(int64(l.buckets.Len()))
+
+    // Replace the metrics for the previous top offenders
+    for _, name := range l.offenderMetrics {
+        metrics.DefaultRegistry.Unregister(name)
+    }
+    l.offenderMetrics = l.offenderMetrics[:0]
+
+    for _, offender := range l.offenders(rateLimitTopOffenders) {
+        name := "ratelimit.offenders." + strings.NewReplacer(".", "_", ":", "_", "/", "_").Replace(offender.Client)
+        gauge := metrics.GetOrRegisterGauge(name, metrics.DefaultRegistry)
+        gauge.Update(offender.Limited)
+
+        l.offenderMetrics = append(l.offenderMetrics, name)
+    }
+}
+
+// offenders returns the clients and networks with the most limited queries,
+// must be called with the lock held
+func (l *ClientRateLimiter) offenders(n int) []clientStatus {
+    offenders := make([]clientStatus, 0)
+    l.buckets.Each(func(key string, value interface{}) {
+        if bucket := value.(*clientBucket); bucket.limited > 0 {
+            offenders = append(offenders, clientStatus{bucket.key, bucket.queries, bucket.limited})
+        }
+    })
+
+    sort.Sort(clientsByLimited(offenders))
+    if n >= 0 && len(offenders) > n {
+        offenders = offenders[:n]
+    }
+
+    return offenders
+}
+
+// TopOffenders returns up to n of the clients and networks with the most
+// limited queries
+func (l *ClientRateLimiter) TopOffenders(n int) []clientStatus {
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    return l.offenders(n)
+}
+
+// ServeHTTP lists the top offenders (20 unless ?n= is given) and the limits
+func (l *ClientRateLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    n := 20
+    if value := req.URL.Query().Get("n"); len(value) > 0 {
+        var err error
+        if n, err = strconv.Atoi(value); err != nil {
+            http.Error(w, "Invalid n: " + value, http.StatusBadRequest)
+            return
+        }
+    }
+
+    writeJSON(w, map[string]interface{}{
+        "action": l.action,
+        "client_rate": l.clientLimit.rate,
+        "client_burst": l.clientLimit.burst,
+        "network_rate": l.networkLimit.rate,
+        "network_burst": l.networkLimit.burst,
+        "offenders": l.TopOffenders(n)})
+}
+
+type clientsByLimited []clientStatus
+
+func (s clientsByLimited) Len() int { return len(s) }
+func (s clientsByLimited) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s clientsByLimited) Less(i, j int) bool {
+    if s[i].Limited != s[j].Limited {
+        return s[i].Limited > s[j].Limited
+    }
+    return s[i].Client < s[j].Client
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "net"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// testClientRateLimiter returns a limiter with a clock that only moves when
+// told to
+func testClientRateLimiter(clientRate float64, clientBurst int, networkRate float64, networkBurst int, action string) (limiter *ClientRateLimiter, clock *time.Time) {
+    clock = &time.Time{}
+    *clock = time.Unix(1000000, 0)
+
+    limiter = NewClientRateLimiter(clientRate, clientBurst, networkRate, networkBurst, 24, 56, action, nil, 0)
+    limiter.now = func() time.Time { return *clock }
+    return
+}
+
+// allowedQueries sends a number of queries from the client, returning how
+// many were allowed
+func allowedQueries(limiter *ClientRateLimiter, addr net.Addr, count int) (allowed int) {
+    for i := 0; i < count; i++ {
+        if limiter.Allow(addr) {
+            allowed++
+        }
+    }
+    return
+}
+
+func TestClientRateLimit(t *testing.T) {
+    limiter, clock := testClientRateLimiter(2, 5, 0, 0, rateLimitActionRefused)
+
+    if allowed := allowedQueries(limiter, udpAddr("192.0.2.1"), 10); allowed != 5 {
+        t.Error("Expected a burst of 5 queries to be allowed, got ", allowed)
+    }
+
+    // Other clients, even within the same network, have their own limit
+    if allowed := allowedQueries(limiter, udpAddr("192.0.2.2"), 10); allowed != 5 {
+        t.Error("Expected another client to have its own limit, got ", allowed)
+    }
+
+    // The bucket refills at the rate, up to the burst
+    *clock = clock.Add(time.Second)
+    if allowed := allowedQueries(limiter, udpAddr("192.0.2.1"), 10); allowed != 2 {
+        t.Error("Expected 2 queries to be allowed after a second, got ", allowed)
+    }
+
+    *clock = clock.Add(time.Hour)
+    if allowed := allowedQueries(limiter, udpAddr("192.0.2.1"), 10); allowed != 5 {
+        t.Error("Expected the burst to be allowed after an hour, got ", allowed)
+    }
+
+    // TCP clients are limited too, and share the limit with UDP
+    tcpAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}
+    if limiter.Allow(tcpAddr) {
+        t.Error("Expected the query over TCP to be limited")
+    }
+}
+
+func TestNetworkRateLimit(t *testing.T) {
+    limiter, _ := testClientRateLimiter(0, 0, 1, 10, rateLimitActionRefused)
+
+    allowed := 0
+    for i := 1; i <= 20; i++ {
+        allowed += allowedQueries(limiter, udpAddr("192.0.2." + string('0' + byte(i % 10))), 1)
+    }
+    if allowed != 10 {
+        t.Error("Expected clients within a network to share the limit, got ", allowed)
+    }
+
+    if allowed := allowedQueries(limiter, udpAddr("192.0.3.1"), 20); allowed != 10 {
+        t.Error("Expected other networks to have their own limit, got ", allowed)
+    }
+
+    if allowed := allowedQueries(limiter, udpAddr("2001:db8:0:ff::1"), 5) + allowedQueries(limiter, udpAddr("2001:db8::2"), 10); allowed != 10 {
+        t.Error("Expected IPv6 clients within a /56 to share the limit, got ", allowed)
+    }
+}
+
+func TestClientAndNetworkRateLimit(t *testing.T) {
+    limiter, _ := testClientRateLimiter(1, 3, 1, 5, rateLimitActionRefused)
+
+    // Queries refused for the client don't use up the network's allowance
+    if allowed := allowedQueries(limiter, udpAddr("192.0.2.1"), 10); allowed != 3 {
+        t.Error("Expected the client limit to apply, got ", allowed)
+    }
+
+    if allowed := allowedQueries(limiter, udpAddr("192.0.2.2"), 10); allowed != 2 {
+        t.Error("Expected the network limit to apply, got ", allowed)
+    }
+
+    offenders := limiter.TopOffenders(10)
+    var expected = []clientStatus {
+        {"192.0.2.0/24", 20, 8},
+        {"192.0.2.1", 10, 7},
+    }
+
+    if len(offenders) != 2 || offenders[0] != expected[0] || offenders[1] != expected[1] {
+        t.Error("Unexpected top offenders: ", offenders)
+    }
+
+    if offenders := limiter.TopOffenders(1); len(offenders) != 1 || offenders[0] != expected[0] {
+        t.Error("Expected only the top offender, got ", offenders)
+    }
+}
+
+func TestClientRateLimitExempt(t *testing.T) {
+    limiter, _ := testClientRateLimiter(1, 1, 0, 0, rateLimitActionRefused)
+    limiter.exempt, _ = parseNetworks([]string{"10.0.0.0/8"})
+
+    if allowed := allowedQueries(limiter, udpAddr("10.1.2.3"), 10); allowed != 10 {
+        t.Error("Expected every query from an exempt client to be allowed, got ", allowed)
+    }
+}
+
+func TestClientRateLimitPrune(t *testing.T) {
+    limiter, clock := testClientRateLimiter(1, 1, 0, 0, rateLimitActionRefused)
+
+    allowedQueries(limiter, udpAddr("192.0.2.1"), 3)
+    allowedQueries(limiter, udpAddr("192.0.2.2"), 3)
+
+    if _, ok := metrics.DefaultRegistry.Get("ratelimit.offenders.192_0_2_1").(metrics.Gauge); ok {
+        t.Error("Didn't expect the offender metrics to be registered yet")
+    }
+
+    *clock = clock.Add(rateLimitPruneInterval)
+    allowedQueries(limiter, udpAddr("192.0.2.1"), 1)
+
+    gauge, ok := metrics.DefaultRegistry.Get("ratelimit.offenders.192_0_2_1").(metrics.Gauge)
+    if !ok || gauge.Value() != 2 {
+        t.Error("Expected the top offender metric to be registered")
+    }
+
+    // Idle clients are forgotten, along with their metrics
+    *clock = clock.Add(rateLimitIdleTimeout + time.Second)
+    allowedQueries(limiter, udpAddr("192.0.2.3"), 1)
+
+    if limiter.buckets.Len() != 1 {
+        t.Error("Expected the idle clients to be forgotten, got ", limiter.buckets.Len())
+    }
+    if metrics.DefaultRegistry.Get("ratelimit.offenders.192_0_2_1") != nil {
+        t.Error("Expected the offender metric to be removed")
+    }
+}
+
+func TestClientRateLimitMaxClients(t *testing.T) {
+    limiter, clock := testClientRateLimiter(1, 2, 0, 0, rateLimitActionRefused)
+    limiter.buckets = newBucketTable(3)
+
+    // A limited client stays limited while a flood of other addresses come
+    // and go
+    allowedQueries(limiter, udpAddr("2001:db8::1"), 2)
+    for i := 0; i < 100; i++ {
+        *clock = clock.Add(time.Millisecond)
+        allowedQueries(limiter, udpAddr(fmt.Sprintf("2001:db8:%x::1", i + 1)), 1)
+
+        if allowedQueries(limiter, udpAddr("2001:db8::1"), 1) != 0 {
+            t.Error("Expected the recently used client to stay limited")
+            t.Fatal()
+        }
+    }
+
+    if limiter.buckets.Len() != 3 {
+        t.Error("Expected the table to hold 3 clients, got ", limiter.buckets.Len())
+    }
+}
+
+func TestHandlerClientRateLimit(t *testing.T) {
+    var expected = []struct {
+        action      string
+        responses   int
+    } {
+        {rateLimitActionRefused, 5},
+        {rateLimitActionDrop, 2},
+    }
+
+    for _, e := range expected {
+        handler := newTestHandler(nil)
+        handler.queryFilterer = NewQueryFilterer(nil, []QueryFilter{QueryFilter{domain: "disco.net.", action: filterActionRefused}})
+        handler.clientLimiter, _ = testClientRateLimiter(1, 2, 0, 0, e.action)
+
+        writer := &testResponseWriter{}
+        for i := 0; i < 5; i++ {
+            query := new(dns.Msg)
+            query.SetQuestion("foo.disco.net.", dns.TypeA)
+            handler.Handle(writer, query)
+        }
+
+        if len(writer.messages) != e.responses {
+            t.Error("Expected ", e.responses, " responses with the ", e.action, " action, got ", len(writer.messages))
+            continue
+        }
+
+        for _, msg := range writer.messages {
+            if msg.Rcode != dns.RcodeRefused {
+                t.Error("Unexpected response: ", msg)
+            }
+        }
+    }
+}
+
+func TestClientRateLimitDebugEndpoint(t *testing.T) {
+    limiter, _ := testClientRateLimiter(1, 1, 0, 0, rateLimitActionDrop)
+    allowedQueries(limiter, udpAddr("192.0.2.1"), 3)
+    allowedQueries(limiter, udpAddr("192.0.2.2"), 2)
+
+    recorder := httptest.NewRecorder()
+    limiter.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/clients?n=1", nil))
+
+    var body struct {
+        Action      string          `json:"action"`
+        Offenders   []clientStatus  `json:"offenders"`
+    }
+    if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+        t.Error("Unable to parse the response: ", err)
+        t.Fatal()
+    }
+
+    if body.Action != rateLimitActionDrop || len(body.Offenders) != 1 || body.Offenders[0] != (clientStatus{"192.0.2.1", 3, 2}) {
+        t.Error("Unexpected response: ", recorder.Body.String())
+    }
+
+    recorder = httptest.NewRecorder()
+    limiter.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/clients?n=lots", nil))
+    if recorder.Code != 400 {
+        t.Error("Expected an invalid n to be rejected, got ", recorder.Code)
+    }
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+    "fmt"
+    "github.com/jessevdk/go-flags"
+    "github.com/rcrowley/go-metrics"
+    "reflect"
+    "sync"
+)
+
+// The options that can be changed by reloading the config file, the rest need
+// a restart
+var reloadableOptions = map[string]bool {
+    "accept": true,
+    "reject": true,
+    "default-ttl": true,
+    "debug": true,
+    "metrics": true,
+    "graphite": true,
+    "graphite-duration": true,
+}
+
+// Reloader applies changes to the config file (or command line) while we're
+// running, when sent a SIGHUP
+type Reloader struct {
+    lock            sync.Mutex
+    args            []string
+    options         *CommandOptions
+    server          *Server
+    queryFilterer   *QueryFilterer
+    reporter        *MetricsReporter
+}
+
+func NewReloader(args []string, options *CommandOptions, server *Server, queryFilterer *QueryFilterer, reporter *MetricsReporter) *Reloader {
+    return &Reloader{
+        args: args,
+        options: options,
+        server: server,
+        queryFilterer: queryFilterer,
+        reporter: reporter}
+}
+
+// reloadedConfig holds the reloadable options, already checked and converted
+// into the form they're used in
+type reloadedConfig struct {
+    options         *CommandOptions
+    acceptFilters   []QueryFilter
+    rejectFilters   []QueryFilter
+    reporter        *MetricsReporter
+}
+
+// Reload reads the options again and applies the reloadable ones. The whole
+// configuration is checked before anything is applied, so if there's an error
+// nothing changes.
+func (r *Reloader) Reload() (err error) {
+    r.lock.Lock()
+    defer r.lock.Unlock()
+
+    defer func() {
+        if err != nil {
+            counter := metrics.GetOrRegisterCounter("config.reload_errors", metrics.DefaultRegistry)
+            counter.Inc(1)
+        }
+    }()
+
+    config, err := r.load()
+    if err != nil {
+        return
+    }
+
+    for _, name := range changedOptions(r.options, config.options) {
+        if !reloadableOptions[name] {
+            logger.Printf("[WARNING] Ignoring the change to --%s, which needs a restart", name)
+        }
+    }
+
+    r.apply(config)
+
+    counter := metrics.GetOrRegisterCounter("config.reloads", metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    logger.Printf("Reloaded the configuration")
+    return nil
+}
+
+// load reads and checks the options, without applying any of them
+func (r *Reloader) load() (config *reloadedConfig, err error) {
+    config = &reloadedConfig{}
+
+    config.options, err = parseOptions(r.args, flags.PassDoubleDash)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid configuration, keeping the current one: %s", err)
+    }
+
+    config.acceptFilters, err = parseFilters(config.options.Accept)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid accept option, keeping the current configuration: %s", err)
+    }
+
+    config.rejectFilters, err = parseFilters(config.options.Reject)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid reject option, keeping the current configuration: %s", err)
+    }
+
+    options := config.options
+    config.reporter, err = NewMetricsReporter(options.GraphiteServer, options.GraphiteDuration, options.MetricsDuration)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid metrics options, keeping the current configuration: %s", err)
+    }
+
+    return
+}
+
+// apply switches to a configuration returned by load. None of this can fail,
+// so a reload is either applied in full or not at all.
+func (r *Reloader) apply(config *reloadedConfig) {
+    options := config.options
+
+    setDebug(options.Debug)
+    r.queryFilterer.SetStatic(config.acceptFilters, config.rejectFilters)
+    r.server.SetDefaultTtl(options.DefaultTtl)
+
+    if !config.reporter.Equal(r.reporter) {
+        r.reporter.Stop()
+        r.reporter = config.reporter
+        r.reporter.Start()
+    }
+
+    // Only the reloadable options are applied, so we keep warning about
+    // changes to the others
+    updated := *r.options
+    updated.Debug = options.Debug
+    updated.Accept, updated.Reject = options.Accept, options.Reject
+    updated.DefaultTtl = options.DefaultTtl
+    updated.MetricsDuration = options.MetricsDuration
+    updated.GraphiteServer, updated.GraphiteDuration = options.GraphiteServer, options.GraphiteDuration
+    r.options = &updated
+}
+
+// changedOptions returns the long names of the options that differ
+func changedOptions(a *CommandOptions, b *CommandOptions) (names []string) {
+    va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+    for i := 0; i < va.NumField(); i++ {
+        name := va.Type().Field(i).Tag.Get("long")
+        if name == "config" {
+            continue
+        }
+
+        if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+            names = append(names, name)
+        }
+    }
+
+    return
+}
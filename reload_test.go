@@ -0,0 +1,88 @@
+package main
+
+import (
+    "github.com/jessevdk/go-flags"
+    "github.com/miekg/dns"
+    "io/ioutil"
+    "os"
+    "testing"
+)
+
+func TestReload(t *testing.T) {
+    defer setDebug(debugEnabled())
+
+    filename := writeConfigFile(t, "default-ttl = 60\nmetrics = 0\nreject = [\"disco.net:AAAA\"]\n")
+    defer os.Remove(filename)
+
+    args := []string{"--config", filename}
+    options, err := parseOptions(args, flags.None)
+    if err != nil {
+        t.Error("Unexpected error parsing the options: ", err)
+        t.Fatal()
+    }
+
+    rejectFilters, _ := parseFilters(options.Reject)
+    queryFilterer := NewQueryFilterer(nil, rejectFilters)
+
+    resolver := &Resolver{defaultTtl: options.DefaultTtl}
+    handler := newTestHandler(resolver)
+    server := &Server{defaultTtl: options.DefaultTtl, resolver: resolver, handlers: []*Handler{handler}}
+
+    reporter, _ := NewMetricsReporter(options.GraphiteServer, options.GraphiteDuration, options.MetricsDuration)
+    reloader := NewReloader(args, options, server, queryFilterer, reporter)
+
+    // Both the reloadable and other options change
+    ioutil.WriteFile(filename, []byte("default-ttl = 30\nmetrics = 0\ndebug = true\nport = 5353\nreject = [\"disco.org:AAAA\"]\n"), 0644)
+    if err := reloader.Reload(); err != nil {
+        t.Error("Unexpected error reloading: ", err)
+        t.Fatal()
+    }
+
+    if current, _ := handler.requestResolver(); current.defaultTtl != 30 || resolver.defaultTtl != 60 {
+        t.Error("Expected new requests to use the new TTL, without changing the old resolver")
+    }
+
+    if queryFilterer.ShouldAcceptQuery(generateDNSMessage("disco.org", dns.TypeAAAA)) || !queryFilterer.ShouldAcceptQuery(generateDNSMessage("disco.net", dns.TypeAAAA)) {
+        t.Error("Expected the filters to be replaced")
+    }
+
+    if !debugEnabled() {
+        t.Error("Expected debug logging to be enabled")
+    }
+
+    if reloader.options.ListenPort != 53 || reloader.options.DefaultTtl != 30 {
+        t.Error("Expected only the reloadable options to be applied")
+    }
+
+    // Nothing changes when the config is invalid, even the valid options
+    var invalid = []string {
+        "default-ttl = 15\nreject = [\"disco.org:A:AAAA\"]\n",
+        "default-ttl = 15\ngraphite = \"not a host:port\"\n",
+        "default-ttl = 15\nreject = [\"disco.org:AAAA\"\n",
+    }
+
+    for _, config := range invalid {
+        ioutil.WriteFile(filename, []byte(config), 0644)
+        if err := reloader.Reload(); err == nil {
+            t.Error("Expected an error reloading ", config)
+        }
+
+        if current, _ := handler.requestResolver(); current.defaultTtl != 30 {
+            t.Error("Expected the TTL to be kept after reloading ", config)
+        }
+
+        if queryFilterer.ShouldAcceptQuery(generateDNSMessage("disco.org", dns.TypeAAAA)) {
+            t.Error("Expected the filters to be kept after reloading ", config)
+        }
+    }
+}
+
+func TestChangedOptions(t *testing.T) {
+    a, _ := parseOptions([]string{"--port", "5353", "--reject", "disco.net:"}, flags.None)
+    b, _ := parseOptions([]string{"--port", "5353", "--reject", "disco.org:", "--default-ttl", "60"}, flags.None)
+
+    changed := changedOptions(a, b)
+    if len(changed) != 2 || changed[0] != "default-ttl" || changed[1] != "reject" {
+        t.Error("Unexpected changed options: ", changed)
+    }
+}
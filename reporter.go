@@ -0,0 +1,112 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "github.com/rcrowley/go-metrics"
+    "net"
+    "os"
+    "strings"
+    "time"
+)
+
+// MetricsReporter periodically sends the metrics to a graphite server, or
+// writes them to the log. Unlike the reporters in go-metrics it can be
+// stopped, so the metrics targets can be changed while we're running.
+type MetricsReporter struct {
+    graphite        *net.TCPAddr
+    prefix          string
+    interval        time.Duration
+    stop            chan bool
+    stopped         chan bool
+}
+
+// NewMetricsReporter returns a reporter for the given graphite server (if any)
+// or the log, reporting every interval seconds. An interval of zero disables
+// reporting to the log.
+func NewMetricsReporter(graphiteServer string, graphiteInterval int, logInterval int) (reporter *MetricsReporter, err error) {
+    reporter = &MetricsReporter{interval: time.Duration(logInterval) * time.Second}
+
+    if len(graphiteServer) > 0 {
+        reporter.graphite, err = net.ResolveTCPAddr("tcp", graphiteServer)
+        if err != nil {
+            return nil, err
+        }
+
+        hostname, err := os.Hostname()
+        if err != nil {
+            return nil, err
+        }
+
+        reporter.prefix = "discodns." + strings.Replace(hostname, ".", "_", -1)
+        reporter.interval = time.Duration(graphiteInterval) * time.Second
+    }
+
+    return
+}
+
+// Start reports the metrics in the background, until Stop is called
+func (r *MetricsReporter) Start() {
+    if r.interval <= 0 {
+        logger.Printf("Metric logging disabled")
+        return
+    }
+
+    r.stop = make(chan bool)
+    r.stopped = make(chan bool)
+
+    go func() {
+        defer close(r.stopped)
+
+        ticker := time.NewTicker(r.interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-ticker.C:
+                r.report()
+            case <-r.stop:
+                return
+            }
+        }
+    }()
+}
+
+// Stop stops reporting the metrics, waiting for any report in progress
+func (r *MetricsReporter) Stop() {
+    if r.stop != nil {
+        close(r.stop)
+        <-r.stopped
+    }
+}
+
+// Equal returns true if both reporters send the metrics to the same place at
+// the same interval
+func (r *MetricsReporter) Equal(other *MetricsReporter) bool {
+    return r.graphite.String() == other.graphite.String() && r.interval == other.interval
+}
+
+func (r *MetricsReporter) report() {
+    if r.graphite != nil {
+        err := metrics.GraphiteOnce(metrics.GraphiteConfig{
+            Addr: r.graphite,
+            Registry: metrics.DefaultRegistry,
+            FlushInterval: r.interval,
+            DurationUnit: time.Nanosecond,
+            Prefix: r.prefix,
+            Percentiles: []float64{0.5, 0.75, 0.95, 0.99, 0.999}})
+        if err != nil {
+            logger.Printf("[ERROR] Unable to send metrics to graphite: %s", err)
+        }
+
+        return
+    }
+
+    var buf bytes.Buffer
+    metrics.WriteOnce(metrics.DefaultRegistry, &buf)
+
+    scanner := bufio.NewScanner(&buf)
+    for scanner.Scan() {
+        logger.Println(scanner.Text())
+    }
+}
@@ -9,25 +9,41 @@ import (
     "net"
     "strconv"
     "strings"
-    "sync"
     "time"
 )
 
 type Resolver struct {
-    etcd        *etcd.Client
-    etcdPrefix  string
-    defaultTtl  uint32
+    etcd            *etcd.Client
+    etcdPrefix      string
+    defaultTtl      uint32
+    aliasUpstream   string
+    reverseIndex    *ReverseIndex
+    soaSerial       string
+    serials         *ZoneSerials
+    zones           *ZoneList
+    names           *NameCache
+    coalescer       *Coalescer
+    inflight        chan bool
+
+    // The deadline of the request being answered, and a channel that's closed
+    // when it passes
+    deadline        time.Time
+    cancel          chan bool
 }
 
 type EtcdRecord struct {
     node    *etcd.Node
     ttl     uint32
+    comment string
 }
 
 // GetFromStorage looks up a key in etcd and returns a slice of nodes. It supports two storage structures;
 //  - File:         /foo/bar/.A -> "value"
 //  - Directory:    /foo/bar/.A/0 -> "value-0"
 //                  /foo/bar/.A/1 -> "value-1"
+//
+// Values stored as JSON objects may also carry a "ttl" (which takes precedence
+// over any .ttl key), a "comment", and a "disabled" flag to hide the record.
 func (r *Resolver) GetFromStorage(key string) (nodes []*EtcdRecord, err error) {
 
     counter := metrics.GetOrRegisterCounter("resolver.etcd.query_count", metrics.DefaultRegistry)
@@ -36,81 +52,48 @@ func (r *Resolver) GetFromStorage(key string) (nodes []*EtcdRecord, err error) {
     counter.Inc(1)
     debugMsg("Querying etcd for " + key)
 
-    response, err := r.etcd.Get(r.etcdPrefix + key, true, true)
+    response, err := r.etcdGet(r.etcdPrefix + key, true, true)
     if err != nil {
         error_counter.Inc(1)
         return
     }
 
-    var findKeys func(node *etcd.Node, ttl uint32, tryTtl bool)
+    ttl := r.defaultTtl
+    if !response.Node.Dir {
+        // Values stored directly may have a TTL alongside them
+        ttlKey := response.Node.Key + ".ttl"
 
-    nodes = make([]*EtcdRecord, 0)
-    findKeys = func(node *etcd.Node, ttl uint32, tryTtl bool) {
-        if node.Dir == true {
-            var lastValNode *etcd.Node
-            for _, node := range node.Nodes {
-
-                if strings.HasSuffix(node.Key, ".ttl") {
-                    ttlValue, err := strconv.ParseUint(node.Value, 10, 32)
-                    if err != nil {
-                        debugMsg("Unable to convert ttl value to int: ", node.Value)
-                    } else if lastValNode == nil {
-                        debugMsg(".ttl node with no matching value node: ", node.Key)
-                    } else {
-                        findKeys(lastValNode, uint32(ttlValue), false)
-                        lastValNode = nil
-                        continue
-                    }
-                } else {
-                    if lastValNode != nil {
-                        findKeys(lastValNode, r.defaultTtl, false)
-                    }
-                    lastValNode = node
-                }
-            }
-
-            if lastValNode != nil {
-                findKeys(lastValNode, r.defaultTtl, false)
-            }
-        } else {
-            // If for some reason this is passed a ttl node unexpectedly, bail
-            if strings.HasSuffix(node.Key, ".ttl") {
-                debugMsg("Unexpected .ttl node", node.Key)
-                return
-            }
-
-            // If we don't have a TLL try and find one
-            if tryTtl {
-                ttlKey := node.Key + ".ttl"
-
-                debugMsg("Querying etcd for " + ttlKey)
-                response, err := r.etcd.Get(ttlKey, false, false)
-                if err == nil {
-                    ttlValue, err := strconv.ParseUint(response.Node.Value, 10, 32)
-                    if err != nil {
-                        debugMsg("Unable to convert ttl value to int: ", response.Node.Value)
-                    } else {
-                        ttl = uint32(ttlValue)
-                    }
-                }
+        debugMsg("Querying etcd for " + ttlKey)
+        response, err := r.etcdGet(ttlKey, false, false)
+        if err == nil {
+            ttlValue, err := strconv.ParseUint(response.Node.Value, 10, 32)
+            if err != nil {
+                debugMsg("Unable to convert ttl value to int: ", response.Node.Value)
+            } else {
+                ttl = uint32(ttlValue)
             }
-
-            nodes = append(nodes, &EtcdRecord{node, ttl})
         }
     }
 
-    findKeys(response.Node, r.defaultTtl, true)
-
+    nodes = r.collectRecords(response.Node, ttl)
     return
 }
 
 // Authority returns a dns.RR describing the know authority for the given
 // domain. It will recurse up the domain structure to find an SOA record that
-// matches.
+// matches, stopping at the apex of the domain's zone if we know the zones.
 func (r *Resolver) Authority(domain string) (soa *dns.SOA) {
-    tree := strings.Split(domain, ".")
-    for i, _ := range tree {
-        subdomain := strings.Join(tree[i:], ".")
+    labels := dns.SplitDomainName(strings.ToLower(dns.Fqdn(domain)))
+
+    top := len(labels)
+    if r.zones != nil {
+        if zone, ok := r.zones.ZoneFor(domain); ok {
+            top = len(labels) - dns.CountLabel(zone)
+        }
+    }
+
+    for i := 0; i <= top; i++ {
+        subdomain := dns.Fqdn(strings.Join(labels[i:], "."))
 
         // Check for an SOA entry
         answers, err := r.LookupAnswersForType(subdomain, dns.TypeSOA)
@@ -120,7 +103,6 @@ func (r *Resolver) Authority(domain string) (soa *dns.SOA) {
 
         if len(answers) == 1 {
             soa = answers[0].(*dns.SOA)
-            soa.Serial = uint32(time.Now().Truncate(time.Hour).Unix())
             return
         }
     }
@@ -136,46 +118,101 @@ func (r *Resolver) Authority(domain string) (soa *dns.SOA) {
 // In the event that the query's value+type yields no known records, this falls back to
 // querying the given nameservers instead.
 func (r *Resolver) Lookup(req *dns.Msg) (msg *dns.Msg) {
-    q := req.Question[0]
+    msg, _ = r.LookupWithError(req, anyPolicyFull)
+    return
+}
+
+// LookupWithError answers the query in the same way as Lookup, also returning
+// an extended error describing why the lookup failed (if it did). ANY queries
+// are answered according to the given policy.
+func (r *Resolver) LookupWithError(req *dns.Msg, anyPolicy string) (msg *dns.Msg, extendedError *ExtendedError) {
+    // Every name is read from etcd at most once while answering the request
+    r = r.withNameCache()
 
     msg = new(dns.Msg)
     msg.SetReply(req)
     msg.Authoritative = true
     msg.RecursionAvailable = false // We're a nameserver, no recursion for you!
 
+    if len(req.Question) == 0 {
+        msg.SetRcode(req, dns.RcodeFormatError)
+        msg.Authoritative = false
+        return
+    }
+
+    q := req.Question[0]
+
+    // Until the zones have been discovered we can't tell which names are ours,
+    // and refusing them all would tell resolvers we're lame for every zone
+    if r.zones != nil && !r.zones.Ready() {
+        error_counter := metrics.GetOrRegisterCounter("resolver.answers.error", metrics.DefaultRegistry)
+        error_counter.Inc(1)
+
+        msg.SetRcode(req, dns.RcodeServerFailure)
+        msg.Authoritative = false
+        extendedError = extendedErrorFor(ErrZonesNotReady)
+        return
+    }
+
+    // Refuse to answer for names outside of the zones we serve, rather than
+    // claiming they don't exist
+    if r.zones != nil && !r.zones.Contains(q.Name) {
+        refused_counter := metrics.GetOrRegisterCounter("resolver.answers.refused", metrics.DefaultRegistry)
+        refused_counter.Inc(1)
+
+        msg.SetRcode(req, dns.RcodeRefused)
+        msg.Authoritative = false
+        return
+    }
+
     answers := []dns.RR{}
     errors := []error{}
-    errored := false
+    var failure error
+
+    // Names beneath a DNAME record are redirected to the DNAME target, hiding
+    // anything stored for the name itself (RFC 6672 section 2.3)
+    var redirected []dns.RR
+    tooLong := false
+    if q.Qclass == dns.ClassINET {
+        var err error
+        redirected, err = r.RedirectDNAME(q, anyPolicy)
+        if _, ok := err.(*NameTooLongError); ok {
+            tooLong = true
+        } else if err != nil {
+            debugMsg("Caught error", err)
+            failure = err
+        }
+    }
 
     var aChan chan dns.RR
     var eChan chan error
 
-    if q.Qclass == dns.ClassINET {
-        aChan, eChan = r.AnswerQuestion(q)
-        answers, errors = gatherFromChannels(aChan, eChan)
+    if len(redirected) == 0 && !tooLong && failure == nil {
+        if isMinimalANY(q, anyPolicy) {
+            var err error
+            answers, err = r.AnswerMinimalANY(q.Name, anyPolicy)
+            if err != nil {
+                errors = append(errors, err)
+            }
+        } else if q.Qclass == dns.ClassINET {
+            aChan, eChan = r.AnswerQuestion(q)
+            answers, errors = gatherFromChannels(aChan, eChan)
+        }
     }
 
-    errored = errored || len(errors) > 0
-    if len(answers) == 0 {
-        // If we failed to find any answers, let's keep looking up the tree for
-        // any wildcard domain entries.
-        parts := strings.Split(q.Name, ".")
-        for level := 1; level < len(parts); level++ {
-            domain := strings.Join(parts[level:], ".")
-            if len(domain) > 1 {
-                question := dns.Question{
-                    Name: "*." + dns.Fqdn(domain),
-                    Qtype: q.Qtype,
-                    Qclass: q.Qclass}
-
-                aChan, eChan = r.AnswerQuestion(question)
-                answers, errors = gatherFromChannels(aChan, eChan)
-
-                errored = errored || len(errors) > 0
-                if len(answers) > 0 {
-                    break;
-                }
-            }
+    if len(errors) > 0 {
+        failure = errors[0]
+    }
+
+    // Names that don't exist may be synthesized from a wildcard
+    var chased []dns.RR
+    exists := false
+    if len(answers) == 0 && len(redirected) == 0 && !tooLong && failure == nil {
+        var err error
+        answers, chased, exists, err = r.AnswerWildcard(q, anyPolicy)
+        if err != nil {
+            debugMsg("Caught error", err)
+            failure = err
         }
     }
 
@@ -183,14 +220,29 @@ func (r *Resolver) Lookup(req *dns.Msg) (msg *dns.Msg) {
     hit_counter := metrics.GetOrRegisterCounter("resolver.answers.hit", metrics.DefaultRegistry)
     error_counter := metrics.GetOrRegisterCounter("resolver.answers.error", metrics.DefaultRegistry)
 
-    if errored {
-        // TODO(tarnfeld): Send special TXT records with a server error response code
+    // Anything that failed after the deadline passed may have been taken for
+    // a missing record
+    if failure == nil && r.expired() {
+        failure = ErrDeadlineExceeded
+    }
+
+    if failure != nil {
         error_counter.Inc(1)
         msg.SetRcode(req, dns.RcodeServerFailure)
+        extendedError = extendedErrorFor(failure)
+    } else if tooLong {
+        // The DNAME is still included, so resolvers know why (RFC 6672 2.2)
+        msg.SetRcode(req, dns.RcodeYXDomain)
+        msg.Answer = redirected
+    } else if len(redirected) > 0 {
+        hit_counter.Inc(1)
+        msg.Answer = redirected
     } else if len(answers) == 0 {
         soa := r.Authority(q.Name)
         miss_counter.Inc(1)
-        msg.SetRcode(req, dns.RcodeNameError)
+        if !exists {
+            msg.SetRcode(req, dns.RcodeNameError)
+        }
         if soa != nil {
             msg.Ns = []dns.RR{soa}
         } else {
@@ -202,6 +254,7 @@ func (r *Resolver) Lookup(req *dns.Msg) (msg *dns.Msg) {
             rr.Header().Name = q.Name
             msg.Answer = append(msg.Answer, rr)
         }
+        msg.Answer = append(msg.Answer, chased...)
     }
 
     return
@@ -238,7 +291,8 @@ func gatherFromChannels(rrsIn chan dns.RR, errsIn chan error) (rrs []dns.RR, err
 // given question writing the answers as dns.RR structures, and any errors it encounters along
 // the way. The function will return immediately, and spawn off a bunch of goroutines
 // to do the work, when using this function one should use a WaitGroup to know when all work
-// has been completed.
+// has been completed. Use a resolver from withNameCache, so the CNAME and ALIAS fallbacks
+// share the read of the name.
 func (r *Resolver) AnswerQuestion(q dns.Question) (answers chan dns.RR, errors chan error) {
     answers = make(chan dns.RR)
     errors = make(chan error)
@@ -250,18 +304,13 @@ func (r *Resolver) AnswerQuestion(q dns.Question) (answers chan dns.RR, errors c
     debugMsg("Answering question ", q)
 
     if q.Qtype == dns.TypeANY {
-        wg := sync.WaitGroup{}
-        wg.Add(len(converters))
-        go func(){
-            wg.Wait()
-            close(answers)
-            close(errors)
-        }()
-        for rrType, _ := range converters {
-            go func(rrType uint16) {
-                defer func() { recover() }()
-                defer wg.Done()
-
+        // Every type is answered from the same read of the name
+        go func() {
+            defer func(){
+                close(answers)
+                close(errors)
+            }()
+            for rrType, _ := range converters {
                 results, err := r.LookupAnswersForType(q.Name, rrType)
                 if err != nil {
                     errors <- err
@@ -270,8 +319,8 @@ func (r *Resolver) AnswerQuestion(q dns.Question) (answers chan dns.RR, errors c
                         answers <- answer
                     }
                 }
-            }(rrType)
-        }
+            }
+        }()
     } else if _, ok := converters[q.Qtype]; ok {
         go func() {
             defer func(){
@@ -294,9 +343,23 @@ func (r *Resolver) AnswerQuestion(q dns.Question) (answers chan dns.RR, errors c
                         if len(cnames) > 1 {
                             errors <- &RecordValueError{
                                 Message: "Multiple CNAME records is invalid",
-                                AttemptedType: dns.TypeCNAME}
+                                AttemptedType: dns.TypeCNAME,
+                                Key: r.etcdPrefix + nameToKey(strings.ToLower(q.Name), "/.CNAME")}
                         } else if len(cnames) > 0 {
                             answers <- cnames[0]
+                        } else if q.Qtype == dns.TypePTR {
+                            for _, rr := range r.SynthesizePTR(q.Name) {
+                                answers <- rr
+                            }
+                        } else if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+                            aliases, err := r.ResolveALIAS(q.Name, q.Qtype)
+                            if err != nil {
+                                errors <- err
+                            } else {
+                                for _, rr := range aliases {
+                                    answers <- rr
+                                }
+                            }
                         }
                     }
                 }
@@ -311,22 +374,50 @@ func (r *Resolver) AnswerQuestion(q dns.Question) (answers chan dns.RR, errors c
     return answers, errors
 }
 
+// AnswerTarget answers the given question for another name, such as the
+// target of a synthesized CNAME record.
+func (r *Resolver) AnswerTarget(name string, q dns.Question, anyPolicy string) (answers []dns.RR, err error) {
+    if isMinimalANY(q, anyPolicy) {
+        return r.AnswerMinimalANY(name, anyPolicy)
+    }
+
+    question := dns.Question{Name: name, Qtype: q.Qtype, Qclass: q.Qclass}
+    answers, errors := gatherFromChannels(r.AnswerQuestion(question))
+    if len(errors) > 0 {
+        return nil, errors[0]
+    }
+
+    return
+}
+
+// LookupAnswersForType returns the records of the given type for a name. The
+// name is read from etcd once per request, so looking up other types for the
+// same name while answering a request only reads their record directories.
 func (r *Resolver) LookupAnswersForType(name string, rrType uint16) (answers []dns.RR, err error) {
     name = strings.ToLower(name)
 
-    typeStr := dns.TypeToString[rrType]
-    nodes, err := r.GetFromStorage(nameToKey(name, "/." + typeStr))
-
+    nodes, err := r.lookupRecords(name, "." + dns.TypeToString[rrType])
     if err != nil {
-        if e, ok := err.(*etcd.EtcdError); ok {
-            if e.ErrorCode == 100 {
-                return answers, nil
-            }
-        }
+        return
+    }
 
+    return r.convertRecords(name, rrType, nodes)
+}
+
+// lookupRecords returns the records stored for a name with the given key
+// segment (e.g .A), taken from the same read of the name as every other type.
+func (r *Resolver) lookupRecords(name string, segment string) (records []*EtcdRecord, err error) {
+    node, err := r.GetNode(name)
+    if err != nil {
         return
     }
 
+    return r.recordsFromNode(node, segment)
+}
+
+// convertRecords converts the records stored for a name into answers of the
+// given type.
+func (r *Resolver) convertRecords(name string, rrType uint16, nodes []*EtcdRecord) (answers []dns.RR, err error) {
     answers = make([]dns.RR, len(nodes))
     for i, node := range nodes {
 
@@ -338,6 +429,13 @@ func (r *Resolver) LookupAnswersForType(name string, rrType uint16) (answers []d
             return nil, err
         }
 
+        if soa, ok := answer.(*dns.SOA); ok {
+            soa.Serial, err = r.ZoneSerial(name, soa)
+            if err != nil {
+                return nil, err
+            }
+        }
+
         answers[i] = answer
     }
 
@@ -361,22 +459,29 @@ func nameToKey(name string, suffix string) string {
     return keyBuffer.String()
 }
 
-// Map of conversion functions that turn individual etcd nodes into dns.RR answers
+// Map of conversion functions that turn individual etcd nodes into dns.RR answers.
+// Each converter accepts either the plain string format of a record, or the
+// equivalent structured JSON object.
 var converters = map[uint16]func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
 
     dns.TypeA: func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
 
-        ip := net.ParseIP(node.Value)
+        value, err := stringValue(node, dns.TypeA, "address")
+        if err != nil {
+            return
+        }
+
+        ip := net.ParseIP(value)
         if ip == nil {
             err = &NodeConversionError{
                 Node: node,
-                Message: fmt.Sprintf("Failed to parse %s as IP Address", node.Value),
+                Message: fmt.Sprintf("Failed to parse %s as IP Address", value),
                 AttemptedType: dns.TypeA,
             }
         } else if ip.To4() == nil {
             err = &NodeConversionError{
                 Node: node,
-                Message: fmt.Sprintf("Value %s isn't an IPv4 address", node.Value),
+                Message: fmt.Sprintf("Value %s isn't an IPv4 address", value),
                 AttemptedType: dns.TypeA,
             }
         } else {
@@ -388,16 +493,21 @@ var converters = map[uint16]func (node *etcd.Node, header dns.RR_Header) (rr dns
 
     dns.TypeAAAA: func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
 
-        ip := net.ParseIP(node.Value)
+        value, err := stringValue(node, dns.TypeAAAA, "address")
+        if err != nil {
+            return
+        }
+
+        ip := net.ParseIP(value)
         if ip == nil {
             err = &NodeConversionError{
                 Node: node,
-                Message: fmt.Sprintf("Failed to parse IP Address %s", node.Value),
+                Message: fmt.Sprintf("Failed to parse IP Address %s", value),
                 AttemptedType: dns.TypeAAAA}
         } else if ip.To16() == nil {
             err = &NodeConversionError{
                 Node: node,
-                Message: fmt.Sprintf("Value %s isn't an IPv6 address", node.Value),
+                Message: fmt.Sprintf("Value %s isn't an IPv6 address", value),
                 AttemptedType: dns.TypeA}
         } else {
             rr = &dns.AAAA{header, ip}
@@ -406,35 +516,98 @@ var converters = map[uint16]func (node *etcd.Node, header dns.RR_Header) (rr dns
     },
 
     dns.TypeTXT: func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
-        rr = &dns.TXT{header, []string{node.Value}}
+        txt, err := txtStrings(node)
+        if err == nil {
+            rr = &dns.TXT{header, txt}
+        }
         return
     },
 
     dns.TypeCNAME: func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
-        rr = &dns.CNAME{header, dns.Fqdn(node.Value)}
+        value, err := stringValue(node, dns.TypeCNAME, "target")
+        if err == nil {
+            rr = &dns.CNAME{header, dns.Fqdn(value)}
+        }
+        return
+    },
+
+    dns.TypeDNAME: func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+        value, err := stringValue(node, dns.TypeDNAME, "target")
+        if err != nil {
+            return
+        }
+
+        labels, ok := dns.IsDomainName(value)
+
+        if (ok && labels > 0) {
+            rr = &dns.DNAME{Hdr: header, Target: dns.Fqdn(value)}
+        } else {
+            err = &NodeConversionError{
+                Node: node,
+                Message: fmt.Sprintf("Value '%s' isn't a valid domain name", value),
+                AttemptedType: dns.TypeDNAME}
+        }
         return
     },
 
     dns.TypeNS: func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
-        rr = &dns.NS{header, dns.Fqdn(node.Value)}
+        value, err := stringValue(node, dns.TypeNS, "target")
+        if err == nil {
+            rr = &dns.NS{header, dns.Fqdn(value)}
+        }
         return
     },
 
     dns.TypePTR: func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
-        labels, ok := dns.IsDomainName(node.Value)
+        value, err := stringValue(node, dns.TypePTR, "target")
+        if err != nil {
+            return
+        }
+
+        labels, ok := dns.IsDomainName(value)
 
         if (ok && labels > 0) {
-            rr = &dns.PTR{header, dns.Fqdn(node.Value)}
+            rr = &dns.PTR{header, dns.Fqdn(value)}
         } else {
             err = &NodeConversionError{
                 Node: node,
-                Message: fmt.Sprintf("Value '%s' isn't a valid domain name", node.Value),
+                Message: fmt.Sprintf("Value '%s' isn't a valid domain name", value),
                 AttemptedType: dns.TypePTR}
         }
         return
     },
 
     dns.TypeSRV: func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+        if isJSONObject(node) {
+            var value struct {
+                Priority    uint16  `json:"priority"`
+                Weight      uint16  `json:"weight"`
+                Port        uint16  `json:"port"`
+                Target      string  `json:"target"`
+            }
+
+            err = decodeJSONValue(node, dns.TypeSRV, &value)
+            if err != nil {
+                return
+            }
+
+            if len(value.Target) == 0 {
+                err = &NodeConversionError{
+                    Node: node,
+                    Message: "Missing 'target' field in JSON value for SRV",
+                    AttemptedType: dns.TypeSRV}
+                return
+            }
+
+            rr = &dns.SRV{
+                Hdr:        header,
+                Priority:   value.Priority,
+                Weight:     value.Weight,
+                Port:       value.Port,
+                Target:     dns.Fqdn(value.Target)}
+            return
+        }
+
         parts := strings.SplitN(node.Value, "\t", 4)
 
         if len(parts) != 4 {
@@ -472,6 +645,42 @@ var converters = map[uint16]func (node *etcd.Node, header dns.RR_Header) (rr dns
     },
 
     dns.TypeSOA: func (node *etcd.Node, header dns.RR_Header) (rr dns.RR, err error) {
+        if isJSONObject(node) {
+            var value struct {
+                Ns          string  `json:"ns"`
+                Mbox        string  `json:"mbox"`
+                Refresh     uint32  `json:"refresh"`
+                Retry       uint32  `json:"retry"`
+                Expire      uint32  `json:"expire"`
+                Serial      uint32  `json:"serial"`
+                Minttl      uint32  `json:"minttl"`
+            }
+
+            err = decodeJSONValue(node, dns.TypeSOA, &value)
+            if err != nil {
+                return
+            }
+
+            if len(value.Ns) == 0 || len(value.Mbox) == 0 {
+                err = &NodeConversionError{
+                    Node: node,
+                    Message: "Missing 'ns' or 'mbox' field in JSON value for SOA",
+                    AttemptedType: dns.TypeSOA}
+                return
+            }
+
+            rr = &dns.SOA{
+                Hdr:     header,
+                Ns:      dns.Fqdn(value.Ns),
+                Mbox:    dns.Fqdn(value.Mbox),
+                Serial:  value.Serial,
+                Refresh: value.Refresh,
+                Retry:   value.Retry,
+                Expire:  value.Expire,
+                Minttl:  value.Minttl}
+            return
+        }
+
         parts := strings.SplitN(node.Value, "\t", 6)
 
         if len(parts) < 6 {
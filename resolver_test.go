@@ -3,6 +3,8 @@ package main
 import (
     "github.com/coreos/go-etcd/etcd"
     "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "net"
     "testing"
     "strings"
 )
@@ -14,7 +16,7 @@ var (
 
 func TestEtcd(t *testing.T) {
     // Enable debug logging
-    log_debug = true
+    setDebug(true)
 
     if !client.SyncCluster() {
         t.Error("Failed to sync etcd cluster")
@@ -391,10 +393,142 @@ func TestAnswerQuestionANY(t *testing.T) {
     }
 }
 
+func TestAnswerQuestionANYHinfo(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionANYHinfo/"
+    client.Set("TestAnswerQuestionANYHinfo/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    client.Set("TestAnswerQuestionANYHinfo/net/disco/bar/.TXT", "google.com.", 0)
+    client.Set("TestAnswerQuestionANYHinfo/net/disco/bar/.A/0", "1.2.3.4", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("bar.disco.net.", dns.TypeANY)
+
+    answer, _ := resolver.LookupWithError(query, anyPolicyHinfo)
+
+    if len(answer.Answer) != 1 {
+        t.Error("Expected one answer, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    rr, ok := answer.Answer[0].(*dns.HINFO)
+    if !ok || rr.Cpu != "RFC8482" || rr.Header().Name != "bar.disco.net." {
+        t.Error("Expected an RFC 8482 HINFO record: ", answer.Answer[0])
+    }
+
+    // Names that don't exist are still NXDOMAIN
+    query.SetQuestion("foo.disco.net.", dns.TypeANY)
+    answer, _ = resolver.LookupWithError(query, anyPolicyHinfo)
+
+    if answer.Rcode != dns.RcodeNameError || len(answer.Answer) > 0 {
+        t.Error("Expected NXDOMAIN for a name that doesn't exist: ", answer)
+    }
+}
+
+func TestAnswerQuestionANYSingle(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionANYSingle/"
+    client.Set("TestAnswerQuestionANYSingle/net/disco/bar/.TXT", "google.com.", 0)
+    client.Set("TestAnswerQuestionANYSingle/net/disco/bar/.A/0", "1.2.3.4", 0)
+    client.Set("TestAnswerQuestionANYSingle/net/disco/bar/.A/1", "2.3.4.5", 0)
+    client.Set("TestAnswerQuestionANYSingle/net/disco/*/.TXT", "wildcard", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("bar.disco.net.", dns.TypeANY)
+
+    answer, _ := resolver.LookupWithError(query, anyPolicySingle)
+
+    if len(answer.Answer) != 2 {
+        t.Error("Expected two answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    for _, rr := range answer.Answer {
+        if rr.Header().Rrtype != dns.TypeA {
+            t.Error("Expected only A records: ", rr)
+        }
+    }
+
+    // Wildcards are answered with a single RRset too
+    query.SetQuestion("foo.disco.net.", dns.TypeANY)
+    answer, _ = resolver.LookupWithError(query, anyPolicySingle)
+
+    if len(answer.Answer) != 1 || answer.Answer[0].Header().Rrtype != dns.TypeTXT {
+        t.Error("Expected a single TXT record from the wildcard: ", answer.Answer)
+    }
+}
+
+func TestLookupSingleReadPerName(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupSingleReadPerName/"
+    client.Set("TestLookupSingleReadPerName/net/disco/bar/.A", "1.2.3.4", 0)
+    client.Set("TestLookupSingleReadPerName/net/disco/bar/.A.ttl", "60", 0)
+    client.Set("TestLookupSingleReadPerName/net/disco/bar/.TXT/0", "foo", 0)
+    client.Set("TestLookupSingleReadPerName/net/disco/bar/.TXT/0.ttl", "30", 0)
+    client.Set("TestLookupSingleReadPerName/net/disco/baz/.CNAME", "bar.disco.net.", 0)
+    client.Set("TestLookupSingleReadPerName/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+
+    // Without a list of zones, as by default
+    defer func(zones *ZoneList) { resolver.zones = zones }(resolver.zones)
+    resolver.zones = nil
+
+    counter := metrics.GetOrRegisterCounter("resolver.etcd.query_count", metrics.DefaultRegistry)
+
+    // Each name is read once, along with its parents up to the zone apex
+    // (checked for a DNAME) and the record directories that are needed (.TXT
+    // for ANY)
+    var expected = []struct {
+        name    string
+        qType   uint16
+        answers int
+        reads   int64
+    }{
+        {"bar.disco.net.", dns.TypeA, 1, 2},
+        {"bar.disco.net.", dns.TypeANY, 2, 3},
+        {"baz.disco.net.", dns.TypeAAAA, 1, 2}}
+
+    for _, test := range expected {
+        query := new(dns.Msg)
+        query.SetQuestion(test.name, test.qType)
+
+        before := counter.Count()
+        answer := resolver.Lookup(query)
+
+        if len(answer.Answer) != test.answers {
+            t.Error("Expected ", test.answers, " answers for ", test.name, ": ", answer.Answer)
+            t.Fatal()
+        }
+        if reads := counter.Count() - before; reads != test.reads {
+            t.Error("Expected ", test.reads, " reads from etcd for ", test.name, ", got ", reads)
+        }
+    }
+
+    // TTLs come from the same read as the values
+    query := new(dns.Msg)
+    query.SetQuestion("bar.disco.net.", dns.TypeANY)
+    for _, rr := range resolver.Lookup(query).Answer {
+        if rr.Header().Rrtype == dns.TypeA && rr.Header().Ttl != 60 {
+            t.Error("Expected A record TTL of 60: ", rr)
+        } else if rr.Header().Rrtype == dns.TypeTXT && rr.Header().Ttl != 30 {
+            t.Error("Expected TXT record TTL of 30: ", rr)
+        }
+    }
+
+    // The subdomains beneath a name aren't read with it
+    node, err := resolver.GetNode("disco.net.")
+    if err != nil || node == nil {
+        t.Error("Unexpected error reading disco.net.: ", err)
+        t.Fatal()
+    }
+    for _, child := range node.Nodes {
+        if len(child.Nodes) > 0 {
+            t.Error("Expected the children of ", child.Key, " not to be read")
+        }
+    }
+}
+
 func TestAnswerQuestionUnsupportedType(t *testing.T) {
     // query for a type that we don't have support for (I tried to pick the most
     // obscure rr type that the dns library supports and that we're unlikely to
     // add support for)
+    resolver.etcdPrefix = "TestAnswerQuestionUnsupportedType/"
+
     query := new(dns.Msg)
     query.SetQuestion("bar.disco.net.", dns.TypeEUI64)
 
@@ -425,8 +559,8 @@ func TestAnswerQuestionWildcardCNAME(t *testing.T) {
 
     answer := resolver.Lookup(query)
 
-    if len(answer.Answer) != 1 {
-        t.Error("Expected one answers, got ", len(answer.Answer))
+    if len(answer.Answer) != 2 {
+        t.Error("Expected two answers, got ", len(answer.Answer))
         t.Fatal()
     }
 
@@ -453,6 +587,13 @@ func TestAnswerQuestionWildcardCNAME(t *testing.T) {
         t.Error("Expected CNAME target baz.disco.net.:", header.Rrtype)
         t.Fatal()
     }
+
+    // Verify the CNAME target was chased
+    target := answer.Answer[1].(*dns.A)
+    if target.Header().Name != "baz.disco.net." || target.A.String() != "1.2.3.4" {
+        t.Error("Expected A record for baz.disco.net.: ", target)
+        t.Fatal()
+    }
 }
 
 func TestAnswerQuestionCNAME(t *testing.T) {
@@ -1004,3 +1145,689 @@ func TestLookupAnswerForSRVInvalidValues(t *testing.T) {
         }
     }
 }
+
+/**
+ * Test conversion of records stored as structured JSON objects.
+ **/
+
+func TestLookupAnswerForAJSON(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupAnswerForAJSON/"
+    client.Set("TestLookupAnswerForAJSON/net/disco/bar/.A", "{\"address\": \"1.2.3.4\"}", 0)
+
+    records, err := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeA)
+
+    if err != nil {
+        t.Error("Unexpected error: ", err)
+        t.Fatal()
+    }
+
+    if len(records) != 1 {
+        t.Error("Expected one answer, got ", len(records))
+        t.Fatal()
+    }
+
+    rr := records[0].(*dns.A)
+    if rr.A.String() != "1.2.3.4" {
+        t.Error("Expected A record to be 1.2.3.4: ", rr.A)
+        t.Fatal()
+    }
+}
+
+func TestLookupAnswerForSRVJSON(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupAnswerForSRVJSON/"
+    client.Set("TestLookupAnswerForSRVJSON/net/disco/_tcp/_http/.SRV",
+        "{\"priority\": 10, \"weight\": 5, \"port\": 80, \"target\": \"some-webserver.disco.net\"}",
+        0)
+
+    records, err := resolver.LookupAnswersForType("_http._tcp.disco.net.", dns.TypeSRV)
+
+    if err != nil {
+        t.Error("Unexpected error: ", err)
+        t.Fatal()
+    }
+
+    if len(records) != 1 {
+        t.Error("Expected one answer, got ", len(records))
+        t.Fatal()
+    }
+
+    rr := records[0].(*dns.SRV)
+
+    if rr.Priority != 10 {
+        t.Error("Unexpected 'priority' value for SRV record:", rr.Priority)
+    }
+
+    if rr.Weight != 5 {
+        t.Error("Unexpected 'weight' value for SRV record:", rr.Weight)
+    }
+
+    if rr.Port != 80 {
+        t.Error("Unexpected 'port' value for SRV record:", rr.Port)
+    }
+
+    if rr.Target != "some-webserver.disco.net." {
+        t.Error("Unexpected 'target' value for SRV record:", rr.Target)
+    }
+}
+
+func TestLookupAnswerForSRVInvalidJSON(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupAnswerForSRVInvalidJSON/"
+
+    var bad_vals_map = map[string]string {
+        "malformed":            "{\"priority\": 10,",
+        "missing-target":       "{\"priority\": 10, \"weight\": 5, \"port\": 80}",
+        "neg-int-priority":     "{\"priority\": -10, \"weight\": 5, \"port\": 80, \"target\": \"foo.disco.net\"}",
+        "large-int-port":       "{\"priority\": 10, \"weight\": 5, \"port\": 65536, \"target\": \"foo.disco.net\"}"}
+
+    for name, value := range bad_vals_map {
+
+        client.Set("TestLookupAnswerForSRVInvalidJSON/net/disco/" + name + "/.SRV", value, 0)
+        records, err := resolver.LookupAnswersForType(name + ".disco.net.", dns.TypeSRV)
+
+        if len(records) > 0 {
+            t.Error("Expected no answers, got ", len(records))
+            t.Fatal()
+        }
+
+        if err == nil {
+            t.Error("Expected error, didn't get one")
+            t.Fatal()
+        }
+    }
+}
+
+func TestLookupAnswerForSOAJSON(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupAnswerForSOAJSON/"
+    client.Set("TestLookupAnswerForSOAJSON/net/disco/.SOA",
+        "{\"ns\": \"ns1.disco.net.\", \"mbox\": \"admin.disco.net.\", \"refresh\": 3600, \"retry\": 600, \"expire\": 86400, \"minttl\": 10}",
+        0)
+
+    records, err := resolver.LookupAnswersForType("disco.net.", dns.TypeSOA)
+
+    if err != nil {
+        t.Error("Unexpected error: ", err)
+        t.Fatal()
+    }
+
+    if len(records) != 1 {
+        t.Error("Expected one answer, got ", len(records))
+        t.Fatal()
+    }
+
+    rr := records[0].(*dns.SOA)
+
+    if rr.Ns != "ns1.disco.net." {
+        t.Error("Expected NS to be ns1.disco.net.: ", rr.Ns)
+        t.Fatal()
+    }
+    if rr.Mbox != "admin.disco.net." {
+        t.Error("Expected MBOX to be admin.disco.net.: ", rr.Mbox)
+        t.Fatal()
+    }
+    if rr.Refresh != 3600 || rr.Retry != 600 || rr.Expire != 86400 || rr.Minttl != 10 {
+        t.Error("Unexpected timer values for SOA record: ", rr)
+        t.Fatal()
+    }
+}
+
+func TestAnswerQuestionTTLJSONPrecedence(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionTTLJSONPrecedence/"
+    client.Set("TestAnswerQuestionTTLJSONPrecedence/net/disco/bar/.A/0", "{\"address\": \"1.2.3.4\", \"ttl\": 60}", 0)
+    client.Set("TestAnswerQuestionTTLJSONPrecedence/net/disco/bar/.A/0.ttl", "300", 0)
+    client.Set("TestAnswerQuestionTTLJSONPrecedence/net/disco/baz/.A", "{\"address\": \"1.2.3.4\", \"ttl\": 60}", 0)
+    client.Set("TestAnswerQuestionTTLJSONPrecedence/net/disco/baz/.A.ttl", "300", 0)
+
+    for _, name := range []string{"bar.disco.net.", "baz.disco.net."} {
+        records, _ := resolver.LookupAnswersForType(name, dns.TypeA)
+
+        if len(records) != 1 {
+            t.Error("Expected one answer, got ", len(records))
+            t.Fatal()
+        }
+
+        if records[0].Header().Ttl != 60 {
+            t.Error("Expected TTL of 60 seconds:", records[0].Header().Ttl)
+            t.Fatal()
+        }
+    }
+}
+
+func TestAnswerQuestionDisabledRecord(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionDisabledRecord/"
+    client.Set("TestAnswerQuestionDisabledRecord/net/disco/bar/.A/0", "{\"address\": \"1.2.3.4\", \"disabled\": true, \"comment\": \"Decommissioned\"}", 0)
+    client.Set("TestAnswerQuestionDisabledRecord/net/disco/bar/.A/1", "{\"address\": \"8.8.8.8\", \"disabled\": false}", 0)
+
+    records, _ := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeA)
+
+    if len(records) != 1 {
+        t.Error("Expected one answer, got ", len(records))
+        t.Fatal()
+    }
+
+    rr := records[0].(*dns.A)
+    if rr.A.String() != "8.8.8.8" {
+        t.Error("Expected A record to be 8.8.8.8: ", rr.A)
+        t.Fatal()
+    }
+}
+
+func TestLookupAnswerForTXTLongValue(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupAnswerForTXTLongValue/"
+    client.Set("TestLookupAnswerForTXTLongValue/net/disco/bar/.TXT", strings.Repeat("a", 600), 0)
+
+    records, err := resolver.LookupAnswersForType("bar.disco.net.", dns.TypeTXT)
+
+    if err != nil {
+        t.Error("Unexpected error: ", err)
+        t.Fatal()
+    }
+
+    if len(records) != 1 {
+        t.Error("Expected one answer, got ", len(records))
+        t.Fatal()
+    }
+
+    rr := records[0].(*dns.TXT)
+    if len(rr.Txt) != 3 {
+        t.Error("Expected three strings, got ", len(rr.Txt))
+        t.Fatal()
+    }
+    if len(rr.Txt[0]) != 255 || len(rr.Txt[1]) != 255 || len(rr.Txt[2]) != 90 {
+        t.Error("Unexpected string lengths in TXT record: ", len(rr.Txt[0]), len(rr.Txt[1]), len(rr.Txt[2]))
+        t.Fatal()
+    }
+}
+
+func TestLookupAnswerForTXTMultipleStrings(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupAnswerForTXTMultipleStrings/"
+
+    var vals_map = map[string]string {
+        "json-object":  "{\"text\": [\"v=spf1 a mx\", \"include:_spf.disco.net ~all\"]}",
+        "padded":       " {\"text\": [\"v=spf1 a mx\", \"include:_spf.disco.net ~all\"], \"ttl\": 60} "}
+
+    for name, value := range vals_map {
+        client.Set("TestLookupAnswerForTXTMultipleStrings/net/disco/" + name + "/.TXT", value, 0)
+        records, err := resolver.LookupAnswersForType(name + ".disco.net.", dns.TypeTXT)
+
+        if err != nil {
+            t.Error("Unexpected error: ", err)
+            t.Fatal()
+        }
+
+        if len(records) != 1 {
+            t.Error("Expected one answer, got ", len(records))
+            t.Fatal()
+        }
+
+        rr := records[0].(*dns.TXT)
+        if len(rr.Txt) != 2 || rr.Txt[0] != "v=spf1 a mx" || rr.Txt[1] != "include:_spf.disco.net ~all" {
+            t.Error("Unexpected strings in TXT record for " + name + ": ", rr.Txt)
+            t.Fatal()
+        }
+    }
+}
+
+func TestLookupAnswerForTXTLiteralValues(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupAnswerForTXTLiteralValues/"
+
+    // Values that happen to be JSON text are only structured if they're an
+    // object with a text field, anything else is returned as-is
+    var vals_map = map[string]string {
+        "brackets":     "[not json",
+        "quotes":       "\"quoted\" and not",
+        "unterminated": "\"foo",
+        "segments":     "\"v=spf1 a mx\" \"include:_spf.disco.net ~all\"",
+        "json-array":   "[\"v=spf1 a mx\", \"include:_spf.disco.net ~all\"]",
+        "json-object":  "{\"ttl\": 60, \"disabled\": true, \"version\": 2}",
+        "json-invalid": "{\"text\": \"foo\""}
+
+    for name, value := range vals_map {
+        client.Set("TestLookupAnswerForTXTLiteralValues/net/disco/" + name + "/.TXT", value, 0)
+        records, err := resolver.LookupAnswersForType(name + ".disco.net.", dns.TypeTXT)
+
+        if err != nil {
+            t.Error("Unexpected error: ", err)
+            t.Fatal()
+        }
+
+        if len(records) != 1 {
+            t.Error("Expected one answer for " + value + ", got ", len(records))
+            t.Fatal()
+        }
+
+        rr := records[0].(*dns.TXT)
+        if len(rr.Txt) != 1 || rr.Txt[0] != value {
+            t.Error("Expected literal TXT value " + value + ": ", rr.Txt)
+            t.Fatal()
+        }
+
+        if rr.Header().Ttl != resolver.defaultTtl {
+            t.Error("Expected the default TTL for literal TXT value " + value + ": ", rr.Header().Ttl)
+        }
+    }
+}
+
+/**
+ * Test DNAME redirection of names beneath a DNAME record.
+ **/
+
+func TestLookupDNAME(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupDNAME/"
+    client.Set("TestLookupDNAME/corp/old/.DNAME", "new.corp.", 0)
+    client.Set("TestLookupDNAME/corp/new/foo/bar/.A", "1.2.3.4", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("bar.foo.old.corp.", dns.TypeA)
+
+    answer := resolver.Lookup(query)
+
+    if answer.Rcode != dns.RcodeSuccess {
+        t.Error("Expected NOERROR response code: ", answer.Rcode)
+        t.Fatal()
+    }
+
+    if len(answer.Answer) != 3 {
+        t.Error("Expected three answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    dname := answer.Answer[0].(*dns.DNAME)
+    if dname.Header().Name != "old.corp." || dname.Target != "new.corp." {
+        t.Error("Unexpected DNAME record: ", dname)
+        t.Fatal()
+    }
+
+    cname := answer.Answer[1].(*dns.CNAME)
+    if cname.Header().Name != "bar.foo.old.corp." || cname.Target != "bar.foo.new.corp." {
+        t.Error("Unexpected synthesized CNAME record: ", cname)
+        t.Fatal()
+    }
+
+    rr := answer.Answer[2].(*dns.A)
+    if rr.Header().Name != "bar.foo.new.corp." || rr.A.String() != "1.2.3.4" {
+        t.Error("Unexpected A record: ", rr)
+        t.Fatal()
+    }
+}
+
+func TestLookupDNAMEOwner(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupDNAMEOwner/"
+    client.Set("TestLookupDNAMEOwner/corp/old/.DNAME", "new.corp.", 0)
+    client.Set("TestLookupDNAMEOwner/corp/old/.A", "1.2.3.4", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("old.corp.", dns.TypeA)
+
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 1 {
+        t.Error("Expected one answer, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    if _, ok := answer.Answer[0].(*dns.A); !ok {
+        t.Error("Expected the DNAME owner to answer directly: ", answer.Answer[0])
+        t.Fatal()
+    }
+}
+
+func TestLookupDNAMEOutOfZone(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupDNAMEOutOfZone/"
+    client.Set("TestLookupDNAMEOutOfZone/corp/old/.DNAME", "example.com.", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("foo.old.corp.", dns.TypeA)
+
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 2 {
+        t.Error("Expected two answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    cname := answer.Answer[1].(*dns.CNAME)
+    if cname.Target != "foo.example.com." {
+        t.Error("Expected CNAME target foo.example.com.: ", cname.Target)
+        t.Fatal()
+    }
+}
+
+func TestLookupDNAMETooLong(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupDNAMETooLong/"
+    client.Set("TestLookupDNAMETooLong/corp/old/.DNAME", strings.Repeat("a.", 120) + "corp.", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion(strings.Repeat("b.", 10) + "old.corp.", dns.TypeA)
+
+    answer := resolver.Lookup(query)
+
+    if answer.Rcode != dns.RcodeYXDomain {
+        t.Error("Expected YXDOMAIN response code: ", answer.Rcode)
+        t.Fatal()
+    }
+
+    if len(answer.Answer) != 1 || answer.Answer[0].Header().Name != "old.corp." || answer.Answer[0].Header().Rrtype != dns.TypeDNAME {
+        t.Error("Expected the DNAME record in the answer: ", answer.Answer)
+        t.Fatal()
+    }
+}
+
+func TestLookupDNAMEOccludesData(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupDNAMEOccludesData/"
+    client.Set("TestLookupDNAMEOccludesData/corp/old/.DNAME", "new.corp.", 0)
+    client.Set("TestLookupDNAMEOccludesData/corp/old/foo/.A", "1.2.3.4", 0)
+    client.Set("TestLookupDNAMEOccludesData/corp/new/foo/.A", "5.6.7.8", 0)
+
+    // Data stored beneath the DNAME owner is hidden, whatever the type
+    for _, qType := range []uint16{dns.TypeA, dns.TypeTXT} {
+        query := new(dns.Msg)
+        query.SetQuestion("foo.old.corp.", qType)
+
+        answer := resolver.Lookup(query)
+
+        if len(answer.Answer) < 2 {
+            t.Error("Expected to be redirected, got ", answer.Answer)
+            t.Fatal()
+        }
+
+        if _, ok := answer.Answer[0].(*dns.DNAME); !ok {
+            t.Error("Expected a DNAME record first: ", answer.Answer[0])
+            t.Fatal()
+        }
+
+        for _, rr := range answer.Answer {
+            if a, ok := rr.(*dns.A); ok && a.A.String() != "5.6.7.8" {
+                t.Error("Expected data beneath the DNAME owner to be hidden: ", a)
+            }
+        }
+    }
+}
+
+func TestLookupDNAMEWithinZone(t *testing.T) {
+    defer func(zones *ZoneList) { resolver.zones = zones }(resolver.zones)
+    resolver.zones = NewZoneList([]string{"old.corp."})
+
+    resolver.etcdPrefix = "TestLookupDNAMEWithinZone/"
+    client.Delete("TestLookupDNAMEWithinZone/", true)
+    defer client.Delete("TestLookupDNAMEWithinZone/", true)
+    client.Set("TestLookupDNAMEWithinZone/corp/.DNAME", "example.com.", 0)
+    client.Set("TestLookupDNAMEWithinZone/corp/old/foo/.A", "1.2.3.4", 0)
+
+    // The DNAME above the apex of the zone doesn't apply
+    dname, err := resolver.FindDNAME("foo.old.corp.")
+    if err != nil || dname != nil {
+        t.Error("Didn't expect a DNAME outside of the zone: ", dname, err)
+    }
+
+    client.Set("TestLookupDNAMEWithinZone/corp/old/.DNAME", "new.corp.", 0)
+    dname, err = resolver.FindDNAME("foo.old.corp.")
+    if err != nil || dname == nil || dname.Target != "new.corp." {
+        t.Error("Expected the DNAME at the apex of the zone: ", dname, err)
+    }
+
+    // Without a list of zones, the search stops at the first SOA record
+    resolver.zones = nil
+    client.Delete("TestLookupDNAMEWithinZone/corp/old/.DNAME", false)
+    client.Set("TestLookupDNAMEWithinZone/corp/old/.SOA", "ns1.old.corp.\tadmin.old.corp.\t3600\t600\t86400\t10", 0)
+
+    dname, err = resolver.withNameCache().FindDNAME("foo.old.corp.")
+    if err != nil || dname != nil {
+        t.Error("Didn't expect a DNAME above the SOA record: ", dname, err)
+    }
+
+    client.Delete("TestLookupDNAMEWithinZone/corp/old/.SOA", false)
+    dname, err = resolver.withNameCache().FindDNAME("foo.old.corp.")
+    if err != nil || dname == nil || dname.Target != "example.com." {
+        t.Error("Expected the DNAME without an SOA in the way: ", dname, err)
+    }
+}
+
+/**
+ * Test flattening of ALIAS records into addresses.
+ **/
+
+func TestAnswerQuestionALIAS(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionALIAS/"
+    client.Set("TestAnswerQuestionALIAS/net/disco/.ALIAS", "lb.disco.net.", 0)
+    client.Set("TestAnswerQuestionALIAS/net/disco/.ALIAS.ttl", "600", 0)
+    client.Set("TestAnswerQuestionALIAS/net/disco/lb/.CNAME", "lb-1.disco.net.", 0)
+    client.Set("TestAnswerQuestionALIAS/net/disco/lb/.CNAME.ttl", "60", 0)
+    client.Set("TestAnswerQuestionALIAS/net/disco/lb-1/.A/0", "1.2.3.4", 0)
+    client.Set("TestAnswerQuestionALIAS/net/disco/lb-1/.A/0.ttl", "300", 0)
+    client.Set("TestAnswerQuestionALIAS/net/disco/lb-1/.A/1", "1.2.3.5", 0)
+    client.Set("TestAnswerQuestionALIAS/net/disco/lb-1/.A/1.ttl", "30", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("disco.net.", dns.TypeA)
+
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 2 {
+        t.Error("Expected two answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    for _, record := range answer.Answer {
+        rr := record.(*dns.A)
+        header := rr.Header()
+
+        if header.Name != "disco.net." {
+            t.Error("Expected record with name disco.net.: ", header.Name)
+            t.Fatal()
+        }
+
+        if rr.A.String() == "1.2.3.4" && header.Ttl != 60 {
+            t.Error("Expected TTL of 60 seconds:", header.Ttl)
+            t.Fatal()
+        }
+
+        if rr.A.String() == "1.2.3.5" && header.Ttl != 30 {
+            t.Error("Expected TTL of 30 seconds:", header.Ttl)
+            t.Fatal()
+        }
+    }
+}
+
+func TestAnswerQuestionALIASNoTarget(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionALIASNoTarget/"
+    client.Set("TestAnswerQuestionALIASNoTarget/net/disco/.ALIAS", "lb.disco.net.", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("disco.net.", dns.TypeAAAA)
+
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 0 {
+        t.Error("Expected zero answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+}
+
+func TestAnswerQuestionALIASOtherTypes(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionALIASOtherTypes/"
+    client.Set("TestAnswerQuestionALIASOtherTypes/net/disco/.ALIAS", "lb.disco.net.", 0)
+    client.Set("TestAnswerQuestionALIASOtherTypes/net/disco/lb/.TXT", "foo", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("disco.net.", dns.TypeTXT)
+
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 0 {
+        t.Error("Expected zero answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+}
+
+func TestAnswerQuestionALIASSingleRead(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionALIASSingleRead/"
+    client.Set("TestAnswerQuestionALIASSingleRead/net/disco/bar/.TXT", "foo", 0)
+
+    counter := metrics.GetOrRegisterCounter("resolver.etcd.query_count", metrics.DefaultRegistry)
+    before := counter.Count()
+
+    // The missing A, CNAME and ALIAS records all come from the same read
+    answers, errors := gatherFromChannels(resolver.withNameCache().AnswerQuestion(dns.Question{"bar.disco.net.", dns.TypeA, dns.ClassINET}))
+    if len(answers) != 0 || len(errors) != 0 {
+        t.Error("Expected no answers, got ", answers, errors)
+    }
+
+    if reads := counter.Count() - before; reads != 1 {
+        t.Error("Expected a single read from etcd, got ", reads)
+    }
+}
+
+func TestAnswerQuestionALIASUpstreamTruncated(t *testing.T) {
+    defer func(upstream string) { resolver.aliasUpstream = upstream }(resolver.aliasUpstream)
+
+    resolver.etcdPrefix = "TestAnswerQuestionALIASUpstreamTruncated/"
+    client.Set("TestAnswerQuestionALIASUpstreamTruncated/net/disco/.ALIAS", "lb.example.com.", 0)
+
+    // The upstream only answers over TCP, and truncates answers over UDP
+    udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Error("Unable to listen for UDP: ", err)
+        t.Fatal()
+    }
+    tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+    if err != nil {
+        udp.Close()
+        t.Error("Unable to listen for TCP: ", err)
+        t.Fatal()
+    }
+
+    upstream := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+        msg := new(dns.Msg)
+        msg.SetReply(req)
+        if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+            msg.Truncated = true
+        } else {
+            header := dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}
+            msg.Answer = []dns.RR{&dns.A{header, net.ParseIP("1.2.3.4")}}
+        }
+        w.WriteMsg(msg)
+    })
+
+    udpServer := &dns.Server{PacketConn: udp, Handler: upstream}
+    tcpServer := &dns.Server{Listener: tcp, Handler: upstream}
+    go udpServer.ActivateAndServe()
+    go tcpServer.ActivateAndServe()
+    defer udpServer.Shutdown()
+    defer tcpServer.Shutdown()
+
+    resolver.aliasUpstream = udp.LocalAddr().String()
+    answers, err := resolver.ResolveALIAS("disco.net.", dns.TypeA)
+
+    if err != nil || len(answers) != 1 {
+        t.Error("Expected the answer from upstream over TCP, got ", answers, err)
+        t.Fatal()
+    }
+
+    if rr := answers[0].(*dns.A); rr.Header().Name != "disco.net." || rr.A.String() != "1.2.3.4" {
+        t.Error("Unexpected answer: ", rr)
+    }
+}
+
+/**
+ * Test wildcard matching follows the closest encloser rules of RFC 4592.
+ **/
+
+func TestAnswerQuestionWildcardExistingName(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionWildcardExistingName/"
+    client.Set("TestAnswerQuestionWildcardExistingName/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    client.Set("TestAnswerQuestionWildcardExistingName/net/disco/*/.A", "1.2.3.4", 0)
+    client.Set("TestAnswerQuestionWildcardExistingName/net/disco/bar/.TXT", "foo", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("bar.disco.net.", dns.TypeA)
+
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 0 {
+        t.Error("Expected no answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    if answer.Rcode != dns.RcodeSuccess {
+        t.Error("Expected NOERROR response code, got", dns.RcodeToString[answer.Rcode])
+        t.Fatal()
+    }
+
+    if len(answer.Ns) != 1 {
+        t.Error("Expected one authority record")
+        t.Fatal()
+    }
+}
+
+func TestAnswerQuestionWildcardClosestEncloser(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionWildcardClosestEncloser/"
+    client.Set("TestAnswerQuestionWildcardClosestEncloser/net/disco/*/.A", "1.2.3.4", 0)
+    client.Set("TestAnswerQuestionWildcardClosestEncloser/net/disco/bar/baz/.A", "1.2.3.5", 0)
+
+    // bar.disco.net. exists (as an empty non-terminal) so *.disco.net. doesn't
+    // apply beneath it
+    query := new(dns.Msg)
+    query.SetQuestion("foo.bar.disco.net.", dns.TypeA)
+
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 0 {
+        t.Error("Expected no answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    if answer.Rcode != dns.RcodeNameError {
+        t.Error("Expected NXDOMAIN response code, got", dns.RcodeToString[answer.Rcode])
+        t.Fatal()
+    }
+
+    // Names beneath a name that doesn't exist still match
+    query.SetQuestion("foo.qux.disco.net.", dns.TypeA)
+    answer = resolver.Lookup(query)
+
+    if len(answer.Answer) != 1 {
+        t.Error("Expected one answer, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    if answer.Answer[0].Header().Name != "foo.qux.disco.net." {
+        t.Error("Expected record with name foo.qux.disco.net.: ", answer.Answer[0].Header().Name)
+        t.Fatal()
+    }
+}
+
+func TestAnswerQuestionWildcardNoData(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionWildcardNoData/"
+    client.Set("TestAnswerQuestionWildcardNoData/net/disco/*/.A", "1.2.3.4", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("foo.disco.net.", dns.TypeAAAA)
+
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 0 {
+        t.Error("Expected no answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+
+    if answer.Rcode != dns.RcodeSuccess {
+        t.Error("Expected NOERROR response code, got", dns.RcodeToString[answer.Rcode])
+        t.Fatal()
+    }
+}
+
+func TestAnswerQuestionWildcardZoneCut(t *testing.T) {
+    resolver.etcdPrefix = "TestAnswerQuestionWildcardZoneCut/"
+    client.Set("TestAnswerQuestionWildcardZoneCut/net/disco/child/.NS", "ns1.child.disco.net.", 0)
+    client.Set("TestAnswerQuestionWildcardZoneCut/net/disco/child/*/.A", "1.2.3.4", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("foo.child.disco.net.", dns.TypeA)
+
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 0 {
+        t.Error("Expected no answers, got ", len(answer.Answer))
+        t.Fatal()
+    }
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+    "fmt"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Policies for choosing which names are returned when several records share
+// the same address
+var reversePolicies = map[string]bool{
+    "all": true,        // Return every name
+    "oldest": true,     // The name whose record was created first
+    "newest": true,     // The name whose record was created most recently
+    "shortest": true,   // The name with the fewest characters
+}
+
+type reverseEntry struct {
+    key         string
+    name        string
+    address     string
+    created     uint64
+    ttl         *uint32     // From the record's JSON value, if it has one
+}
+
+// ReverseIndex maintains a mapping of IP addresses to the names that have A or
+// AAAA records pointing to them, allowing PTR records to be synthesized. The
+// index is built from the records within the zones we serve (or everything
+// beneath the etcd prefix, if we don't know the zones), and kept up to date
+// with an etcd watch.
+type ReverseIndex struct {
+    etcd        *etcd.Client
+    etcdPrefix  string
+    policy      string
+    zones       *ZoneList
+
+    lock        sync.RWMutex
+    records     map[string]*reverseEntry
+    addresses   map[string][]*reverseEntry
+    ttls        map[string]uint32
+    stop        chan bool
+}
+
+func NewReverseIndex(client *etcd.Client, etcdPrefix string, policy string, zones *ZoneList) (index *ReverseIndex, err error) {
+    if !reversePolicies[policy] {
+        return nil, fmt.Errorf("Unknown reverse lookup policy '%s'", policy)
+    }
+
+    index = &ReverseIndex{
+        etcd: client,
+        etcdPrefix: "/" + strings.Trim(etcdPrefix, "/"),
+        policy: policy,
+        zones: zones,
+        records: make(map[string]*reverseEntry),
+        addresses: make(map[string][]*reverseEntry),
+        ttls: make(map[string]uint32),
+        stop: make(chan bool)}
+
+    return
+}
+
+// Start builds the index and watches etcd for changes in the background. If
+// the watch fails for any reason the index is rebuilt from scratch.
+func (i *ReverseIndex) Start() {
+    go watchEtcd(i.etcd, i.etcdPrefix, i.Build, i.apply, i.stop)
+}
+
+// Stop stops watching etcd for changes
+func (i *ReverseIndex) Stop() {
+    close(i.stop)
+}
+
+// Build replaces the contents of the index with every address record stored
+// within the configured zones, or beneath the etcd prefix if zones are being
+// discovered (or aren't known). The etcd index of the data is returned, so
+// changes from that point onwards can be watched for.
+func (i *ReverseIndex) Build() (etcdIndex uint64, err error) {
+    timer := metrics.GetOrRegisterTimer("resolver.reverse.build_time", metrics.DefaultRegistry)
+    start := time.Now()
+    defer timer.UpdateSince(start)
+
+    records := make(map[string]*reverseEntry)
+    addresses := make(map[string][]*reverseEntry)
+    ttls := make(map[string]uint32)
+
+    var findRecords func(node *etcd.Node)
+    findRecords = func(node *etcd.Node) {
+        if node.Dir {
+            for _, child := range node.Nodes {
+                findRecords(child)
+            }
+        } else if key, ttl, ok := parseTtlNode(node); ok {
+            ttls[key] = ttl
+        } else if entry := i.parseNode(node); entry != nil {
+            records[node.Key] = entry
+            addresses[entry.address] = append(addresses[entry.address], entry)
+        }
+    }
+
+    // Changes are watched for from the oldest of the reads, so none are missed
+    for n, key := range i.buildKeys() {
+        response, err := i.etcd.Get(key, false, true)
+        var index uint64
+        if err != nil {
+            e, ok := err.(*etcd.EtcdError)
+            if !ok || e.ErrorCode != 100 {
+                return 0, err
+            }
+            index = e.Index
+        } else {
+            index = response.EtcdIndex
+            findRecords(response.Node)
+        }
+
+        if n == 0 || index < etcdIndex {
+            etcdIndex = index
+        }
+    }
+
+    i.lock.Lock()
+    i.records = records
+    i.addresses = addresses
+    i.ttls = ttls
+    i.lock.Unlock()
+
+    debugMsg("Built reverse index of " + strconv.Itoa(len(records)) + " records")
+    return
+}
+
+// buildKeys returns the etcd keys the index is built from, which are those of
+// the configured zones (skipping any within another zone), or the prefix.
+func (i *ReverseIndex) buildKeys() (keys []string) {
+    if i.zones == nil || i.zones.Discovered() {
+        return []string{i.etcdPrefix}
+    }
+
+    for _, zone := range i.zones.Zones() {
+        if parent := dns.SplitDomainName(zone); len(parent) > 0 {
+            if _, ok := i.zones.ZoneFor(dns.Fqdn(strings.Join(parent[1:], "."))); ok {
+                continue
+            }
+        }
+
+        keys = append(keys, strings.TrimSuffix(i.etcdPrefix, "/") + nameToKey(zone, ""))
+    }
+
+    return
+}
+
+// parseTtlNode returns the key of the record a .ttl node belongs to, and the
+// TTL it holds
+func parseTtlNode(node *etcd.Node) (key string, ttl uint32, ok bool) {
+    if node.Dir || !strings.HasSuffix(node.Key, ".ttl") {
+        return
+    }
+
+    value, err := strconv.ParseUint(node.Value, 10, 32)
+    if err != nil {
+        return
+    }
+
+    return strings.TrimSuffix(node.Key, ".ttl"), uint32(value), true
+}
+
+// apply updates the index with a single change from etcd
+func (i *ReverseIndex) apply(response *etcd.Response) {
+    i.lock.Lock()
+    defer i.lock.Unlock()
+
+    key := response.Node.Key
+
+    // Remove the existing records for the key, and anything beneath it
+    if _, ok := i.records[key]; ok {
+        i.remove(key)
+    } else if response.Node.Dir {
+        for recordKey, _ := range i.records {
+            if strings.HasPrefix(recordKey, key + "/") {
+                i.remove(recordKey)
+            }
+        }
+        for ttlKey, _ := range i.ttls {
+            if strings.HasPrefix(ttlKey, key + "/") {
+                delete(i.ttls, ttlKey)
+            }
+        }
+    }
+
+    deleted := false
+    switch response.Action {
+    case "delete", "expire", "compareAndDelete":
+        deleted = true
+    }
+
+    if strings.HasSuffix(key, ".ttl") && !response.Node.Dir {
+        delete(i.ttls, strings.TrimSuffix(key, ".ttl"))
+        if recordKey, ttl, ok := parseTtlNode(response.Node); ok && !deleted {
+            i.ttls[recordKey] = ttl
+        }
+        return
+    }
+
+    if deleted {
+        return
+    }
+
+    if entry := i.parseNode(response.Node); entry != nil && !response.Node.Dir {
+        i.records[key] = entry
+        i.addresses[entry.address] = append(i.addresses[entry.address], entry)
+    }
+}
+
+// remove deletes a record from the index, the lock must be held
+func (i *ReverseIndex) remove(key string) {
+    entry := i.records[key]
+    delete(i.records, key)
+
+    entries := i.addresses[entry.address]
+    for n, existing := range entries {
+        if existing == entry {
+            entries = append(entries[:n], entries[n+1:]...)
+            break
+        }
+    }
+
+    if len(entries) == 0 {
+        delete(i.addresses, entry.address)
+    } else {
+        i.addresses[entry.address] = entries
+    }
+}
+
+// parseNode returns an index entry if the node is an A or AAAA record. For
+// example /net/disco/foo/.A/0 -> 10.0.0.1 maps 10.0.0.1 to foo.disco.net.
+func (i *ReverseIndex) parseNode(node *etcd.Node) *reverseEntry {
+    prefix := strings.TrimSuffix(i.etcdPrefix, "/") + "/"
+    if node.Dir || strings.HasSuffix(node.Key, ".ttl") || !strings.HasPrefix(node.Key, prefix) {
+        return nil
+    }
+
+    segments := strings.Split(node.Key[len(prefix):], "/")
+
+    var labels []string
+    var rrType uint16
+    for n, segment := range segments {
+        if segment == ".A" {
+            rrType = dns.TypeA
+        } else if segment == ".AAAA" {
+            rrType = dns.TypeAAAA
+        } else {
+            continue
+        }
+
+        for l := n - 1; l >= 0; l-- {
+            labels = append(labels, segments[l])
+        }
+        break
+    }
+
+    if rrType == dns.TypeNone || len(labels) == 0 || labels[0] == "*" {
+        return nil
+    }
+
+    name := dns.Fqdn(strings.Join(labels, "."))
+    if i.zones != nil && !i.zones.Discovered() && !i.zones.Contains(name) {
+        return nil
+    }
+
+    metadata := decodeMetadata(node)
+    if metadata != nil && metadata.Disabled {
+        return nil
+    }
+
+    value, err := stringValue(node, rrType, "address")
+    if err != nil {
+        return nil
+    }
+
+    ip := net.ParseIP(value)
+    if ip == nil {
+        return nil
+    }
+
+    entry := &reverseEntry{
+        key: node.Key,
+        name: name,
+        address: ip.String(),
+        created: node.CreatedIndex}
+
+    if metadata != nil {
+        entry.ttl = metadata.Ttl
+    }
+
+    return entry
+}
+
+// LookupNames returns the names with address records for the given IP,
+// according to the configured policy, along with the TTL of each address
+// record (the given default if it doesn't have one).
+func (i *ReverseIndex) LookupNames(ip net.IP, defaultTtl uint32) (names []string, ttls []uint32) {
+    i.lock.RLock()
+    defer i.lock.RUnlock()
+
+    entries := make([]*reverseEntry, 0, len(i.addresses[ip.String()]))
+    for _, entry := range i.addresses[ip.String()] {
+        // Discovered zones come and go, so they're checked as we go
+        if i.zones == nil || i.zones.Contains(entry.name) {
+            entries = append(entries, entry)
+        }
+    }
+
+    if len(entries) == 0 {
+        return
+    }
+
+    sort.Sort(reverseEntriesByAge(entries))
+
+    switch i.policy {
+    case "oldest":
+        entries = entries[:1]
+    case "newest":
+        entries = entries[len(entries)-1:]
+    case "shortest":
+        shortest := entries[0]
+        for _, entry := range entries {
+            if len(entry.name) < len(shortest.name) {
+                shortest = entry
+            }
+        }
+        entries = []*reverseEntry{shortest}
+    }
+
+    // Names with several records for the address get the lowest TTL
+    seen := make(map[string]int)
+    for _, entry := range entries {
+        ttl := defaultTtl
+        if entry.ttl != nil {
+            ttl = *entry.ttl
+        } else if value, ok := i.ttls[entry.key]; ok {
+            ttl = value
+        }
+
+        if n, ok := seen[entry.name]; ok {
+            ttls[n] = minTtl(ttls[n], ttl)
+        } else {
+            seen[entry.name] = len(names)
+            names = append(names, entry.name)
+            ttls = append(ttls, ttl)
+        }
+    }
+
+    return
+}
+
+type reverseEntriesByAge []*reverseEntry
+
+func (e reverseEntriesByAge) Len() int { return len(e) }
+func (e reverseEntriesByAge) Swap(a, b int) { e[a], e[b] = e[b], e[a] }
+func (e reverseEntriesByAge) Less(a, b int) bool {
+    if e[a].created == e[b].created {
+        return e[a].name < e[b].name
+    }
+    return e[a].created < e[b].created
+}
+
+// reverseNameToIP converts a name within in-addr.arpa. or ip6.arpa. into the
+// IP address it represents, or nil if it isn't a complete address.
+func reverseNameToIP(name string) net.IP {
+    name = strings.ToLower(dns.Fqdn(name))
+    labels := dns.SplitDomainName(name)
+
+    var address string
+    if strings.HasSuffix(name, ".in-addr.arpa.") && len(labels) == 6 {
+        octets := make([]string, 4)
+        for n := 0; n < 4; n++ {
+            octets[3-n] = labels[n]
+        }
+        address = strings.Join(octets, ".")
+    } else if strings.HasSuffix(name, ".ip6.arpa.") && len(labels) == 34 {
+        nibbles := make([]byte, 0, 39)
+        for n := 31; n >= 0; n-- {
+            if len(labels[n]) != 1 {
+                return nil
+            }
+            nibbles = append(nibbles, labels[n][0])
+            if n % 4 == 0 && n > 0 {
+                nibbles = append(nibbles, ':')
+            }
+        }
+        address = string(nibbles)
+    } else {
+        return nil
+    }
+
+    return net.ParseIP(address)
+}
+
+// SynthesizePTR returns PTR records for a reverse lookup name, using the
+// reverse index of address records.
+func (r *Resolver) SynthesizePTR(name string) (answers []dns.RR) {
+    if r.reverseIndex == nil {
+        return
+    }
+
+    ip := reverseNameToIP(name)
+    if ip == nil {
+        return
+    }
+
+    // Each PTR record has the TTL of the address record it came from
+    targets, ttls := r.reverseIndex.LookupNames(ip, r.defaultTtl)
+    for n, target := range targets {
+        header := dns.RR_Header{Name: name, Class: dns.ClassINET, Rrtype: dns.TypePTR, Ttl: ttls[n]}
+        answers = append(answers, &dns.PTR{Hdr: header, Ptr: target})
+    }
+
+    if len(answers) > 0 {
+        counter := metrics.GetOrRegisterCounter("resolver.answers.synthesized_ptr", metrics.DefaultRegistry)
+        counter.Inc(1)
+    }
+
+    return
+}
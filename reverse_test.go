@@ -0,0 +1,239 @@
+package main
+
+import (
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "net"
+    "testing"
+    "time"
+)
+
+func TestReverseNameToIP(t *testing.T) {
+    var names = map[string]string {
+        "4.3.2.1.in-addr.arpa.": "1.2.3.4",
+        "4.3.2.1.IN-ADDR.ARPA": "1.2.3.4",
+        "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.": "4321:0:1:2:3:4:567:89ab"}
+
+    for name, expected := range names {
+        ip := reverseNameToIP(name)
+        if ip == nil || !ip.Equal(net.ParseIP(expected)) {
+            t.Error("Expected " + name + " to be " + expected + ": ", ip)
+        }
+    }
+
+    var invalid = []string {
+        "3.2.1.in-addr.arpa.",
+        "foo.3.2.1.in-addr.arpa.",
+        "1.2.3.4.ip6.arpa.",
+        "disco.net."}
+
+    for _, name := range invalid {
+        if ip := reverseNameToIP(name); ip != nil {
+            t.Error("Expected no address for " + name + ": ", ip)
+        }
+    }
+}
+
+func TestReverseIndexPolicies(t *testing.T) {
+    client.Set("TestReverseIndexPolicies/net/disco/bar/.A", "10.0.0.1", 0)
+    client.Set("TestReverseIndexPolicies/net/disco/foo/longer/.A/0", "10.0.0.1", 0)
+    client.Set("TestReverseIndexPolicies/net/disco/baz/.A", "{\"address\": \"10.0.0.1\", \"disabled\": true}", 0)
+    client.Set("TestReverseIndexPolicies/net/disco/v6/.AAAA", "::1", 0)
+    client.Set("TestReverseIndexPolicies/net/disco/*/.A", "10.0.0.1", 0)
+
+    var expected = map[string][]string {
+        "all": []string{"bar.disco.net.", "longer.foo.disco.net."},
+        "oldest": []string{"bar.disco.net."},
+        "newest": []string{"longer.foo.disco.net."},
+        "shortest": []string{"bar.disco.net."}}
+
+    for policy, names := range expected {
+        index, err := NewReverseIndex(client, "TestReverseIndexPolicies/", policy, nil)
+        if err != nil {
+            t.Error("Unexpected error: ", err)
+            t.Fatal()
+        }
+
+        if _, err := index.Build(); err != nil {
+            t.Error("Unexpected error building index: ", err)
+            t.Fatal()
+        }
+
+        found, _ := index.LookupNames(net.ParseIP("10.0.0.1"), 300)
+        if len(found) != len(names) {
+            t.Error("Unexpected names for policy " + policy + ": ", found)
+            t.Fatal()
+        }
+
+        for n, name := range names {
+            if found[n] != name {
+                t.Error("Unexpected names for policy " + policy + ": ", found)
+                t.Fatal()
+            }
+        }
+
+        found, _ = index.LookupNames(net.ParseIP("::1"), 300)
+        if len(found) != 1 || found[0] != "v6.disco.net." {
+            t.Error("Expected v6.disco.net. for ::1: ", found)
+            t.Fatal()
+        }
+    }
+
+    if _, err := NewReverseIndex(client, "TestReverseIndexPolicies/", "random", nil); err == nil {
+        t.Error("Expected error for unknown policy")
+    }
+}
+
+func TestReverseIndexWatch(t *testing.T) {
+    client.Set("TestReverseIndexWatch/net/disco/bar/.A", "10.0.0.2", 0)
+
+    index, _ := NewReverseIndex(client, "TestReverseIndexWatch", "all", nil)
+    index.Start()
+    defer index.Stop()
+
+    waitForNames := func(ip string, count int) []string {
+        var names []string
+        for attempt := 0; attempt < 50; attempt++ {
+            names, _ = index.LookupNames(net.ParseIP(ip), 300)
+            if len(names) == count {
+                break
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+        return names
+    }
+
+    if names := waitForNames("10.0.0.2", 1); len(names) != 1 {
+        t.Error("Expected one name for 10.0.0.2: ", names)
+        t.Fatal()
+    }
+
+    client.Set("TestReverseIndexWatch/net/disco/foo/.A", "10.0.0.3", 0)
+    if names := waitForNames("10.0.0.3", 1); len(names) != 1 || names[0] != "foo.disco.net." {
+        t.Error("Expected foo.disco.net. for 10.0.0.3: ", names)
+        t.Fatal()
+    }
+
+    client.Set("TestReverseIndexWatch/net/disco/bar/.A", "10.0.0.4", 0)
+    if names := waitForNames("10.0.0.2", 0); len(names) != 0 {
+        t.Error("Expected no names for 10.0.0.2: ", names)
+        t.Fatal()
+    }
+
+    client.Delete("TestReverseIndexWatch/net/disco/foo", true)
+    if names := waitForNames("10.0.0.3", 0); len(names) != 0 {
+        t.Error("Expected no names for 10.0.0.3: ", names)
+        t.Fatal()
+    }
+}
+
+func TestLookupSynthesizedPTR(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupSynthesizedPTR/"
+    client.Set("TestLookupSynthesizedPTR/net/disco/bar/.A", "10.0.0.5", 0)
+    client.Set("TestLookupSynthesizedPTR/net/disco/foo/.A", "10.0.0.6", 0)
+    client.Set("TestLookupSynthesizedPTR/arpa/in-addr/10/0/0/6/.PTR", "explicit.disco.net.", 0)
+
+    index, _ := NewReverseIndex(client, "TestLookupSynthesizedPTR/", "oldest", nil)
+    index.Build()
+
+    resolver.reverseIndex = index
+    defer func() { resolver.reverseIndex = nil }()
+
+    query := new(dns.Msg)
+    query.SetQuestion("5.0.0.10.in-addr.arpa.", dns.TypePTR)
+    answer := resolver.Lookup(query)
+
+    if len(answer.Answer) != 1 || answer.Answer[0].(*dns.PTR).Ptr != "bar.disco.net." {
+        t.Error("Expected synthesized PTR to bar.disco.net.: ", answer.Answer)
+        t.Fatal()
+    }
+
+    query.SetQuestion("6.0.0.10.in-addr.arpa.", dns.TypePTR)
+    answer = resolver.Lookup(query)
+
+    if len(answer.Answer) != 1 || answer.Answer[0].(*dns.PTR).Ptr != "explicit.disco.net." {
+        t.Error("Expected explicit PTR to take precedence: ", answer.Answer)
+        t.Fatal()
+    }
+}
+
+func TestReverseIndexTTL(t *testing.T) {
+    client.Set("TestReverseIndexTTL/net/disco/bar/.A", "10.0.0.7", 0)
+    client.Set("TestReverseIndexTTL/net/disco/bar/.A.ttl", "60", 0)
+    client.Set("TestReverseIndexTTL/net/disco/baz/.A/0", "10.0.0.7", 0)
+    client.Set("TestReverseIndexTTL/net/disco/baz/.A/0.ttl", "30", 0)
+    client.Set("TestReverseIndexTTL/net/disco/foo/.A", "{\"address\": \"10.0.0.7\", \"ttl\": 90}", 0)
+    client.Set("TestReverseIndexTTL/net/disco/qux/.A", "10.0.0.7", 0)
+
+    index, _ := NewReverseIndex(client, "TestReverseIndexTTL/", "all", nil)
+    index.Start()
+    defer index.Stop()
+
+    var expected = map[string]uint32 {
+        "bar.disco.net.": 60,
+        "baz.disco.net.": 30,
+        "foo.disco.net.": 90,
+        "qux.disco.net.": 300}
+
+    waitForTtl := func(name string, ttl uint32) (found uint32) {
+        for attempt := 0; attempt < 50; attempt++ {
+            names, ttls := index.LookupNames(net.ParseIP("10.0.0.7"), 300)
+            for n, _ := range names {
+                if names[n] == name {
+                    found = ttls[n]
+                }
+            }
+            if found == ttl {
+                break
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+        return
+    }
+
+    for name, ttl := range expected {
+        if found := waitForTtl(name, ttl); found != ttl {
+            t.Error("Expected a TTL of ", ttl, " for ", name, ", got ", found)
+        }
+    }
+
+    // Changes to the TTL are picked up by the watch
+    client.Set("TestReverseIndexTTL/net/disco/bar/.A.ttl", "120", 0)
+    if found := waitForTtl("bar.disco.net.", 120); found != 120 {
+        t.Error("Expected the new TTL for bar.disco.net., got ", found)
+    }
+
+    client.Delete("TestReverseIndexTTL/net/disco/baz/.A/0.ttl", false)
+    if found := waitForTtl("baz.disco.net.", 300); found != 300 {
+        t.Error("Expected the default TTL for baz.disco.net., got ", found)
+    }
+}
+
+func TestReverseIndexZones(t *testing.T) {
+    client.Set("TestReverseIndexZones/net/disco/bar/.A", "10.0.0.8", 0)
+    client.Set("TestReverseIndexZones/net/disco/child/foo/.A", "10.0.0.8", 0)
+    client.Set("TestReverseIndexZones/org/disco/bar/.A", "10.0.0.8", 0)
+
+    zones := NewZoneList([]string{"disco.net.", "child.disco.net."})
+    index, _ := NewReverseIndex(client, "TestReverseIndexZones/", "all", zones)
+
+    if keys := index.buildKeys(); len(keys) != 1 || keys[0] != "/TestReverseIndexZones/net/disco" {
+        t.Error("Expected the index to be built from the outermost zone: ", keys)
+    }
+
+    if _, err := index.Build(); err != nil {
+        t.Error("Unexpected error building index: ", err)
+        t.Fatal()
+    }
+
+    names, _ := index.LookupNames(net.ParseIP("10.0.0.8"), 300)
+    if len(names) != 2 || names[0] != "bar.disco.net." || names[1] != "foo.child.disco.net." {
+        t.Error("Expected only the names within the zones: ", names)
+    }
+
+    // Records outside of the zones are ignored as they change too
+    index.apply(&etcd.Response{Action: "set", Node: &etcd.Node{Key: "/TestReverseIndexZones/com/disco/.A", Value: "10.0.0.8"}})
+    if names, _ := index.LookupNames(net.ParseIP("10.0.0.8"), 300); len(names) != 2 {
+        t.Error("Expected only the names within the zones: ", names)
+    }
+}
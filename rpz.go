@@ -0,0 +1,525 @@
+package main
+
+import (
+    "fmt"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// The etcd key beneath which response policy zones are stored, one per key
+const etcdPoliciesKey = "/_discodns/rpz"
+
+// Actions taken for queries that match a response policy
+const (
+    rpzActionNXDomain   = "nxdomain"    // CNAME .
+    rpzActionNoData     = "nodata"      // CNAME *.
+    rpzActionPassthru   = "passthru"    // CNAME rpz-passthru.
+    rpzActionDrop       = "drop"        // CNAME rpz-drop.
+    rpzActionLocalData  = "local-data"  // Any other records
+)
+
+// Policy is a single trigger in a response policy zone, and what to do with
+// the queries that match it
+type Policy struct {
+    zone        *PolicyZone
+    trigger     string
+    action      string
+    records     []dns.RR    // The records to answer with, for local data
+}
+
+// PolicyZone is a set of policies in the format of an RPZ zone (see
+// https://tools.ietf.org/html/draft-vixie-dnsop-dns-rpz). QNAME, client IP
+// (rpz-client-ip) and response IP (rpz-ip) triggers are supported.
+type PolicyZone struct {
+    name        string
+    soa         *dns.SOA
+    qnames      map[string]*Policy
+    wildcards   map[string]*Policy  // *.example.com, by example.com
+    clientIPs   []*ipPolicy
+    responseIPs []*ipPolicy
+}
+
+type ipPolicy struct {
+    network     *net.IPNet
+    policy      *Policy
+}
+
+// ResponsePolicies are the policy zones applied to queries, in order of
+// precedence. Zones are loaded from files, and optionally etcd (where they're
+// kept up to date with an etcd watch).
+type ResponsePolicies struct {
+    lock        sync.RWMutex
+    zones       []*PolicyZone
+
+    etcd        *etcd.Client
+    etcdKey     string
+    staticZones []*PolicyZone
+    stop        chan bool
+    stopped     chan bool
+}
+
+// NewResponsePolicies returns the policies in the given RPZ zone files, with the
+// zone named after the file's $ORIGIN (or the name of the file without .zone or
+// .rpz, if it doesn't have one)
+func NewResponsePolicies(files []string) (policies *ResponsePolicies, err error) {
+    policies = &ResponsePolicies{}
+    for _, file := range files {
+        f, err := os.Open(file)
+        if err != nil {
+            return nil, err
+        }
+
+        name := file[strings.LastIndex(file, "/") + 1:]
+        name = strings.TrimSuffix(strings.TrimSuffix(name, ".zone"), ".rpz")
+
+        zone, err := parsePolicyZone(name, f)
+        f.Close()
+        if err != nil {
+            return nil, err
+        }
+
+        policies.staticZones = append(policies.staticZones, zone)
+    }
+
+    policies.zones = policies.staticZones
+    return
+}
+
+// WatchEtcd loads policy zones stored beneath the etcd key once Start is
+// called, applying them after the zones loaded from files. Each key holds a
+// zone, named after the key.
+func (p *ResponsePolicies) WatchEtcd(client *etcd.Client, etcdKey string) {
+    p.etcd = client
+    p.etcdKey = "/" + strings.Trim(etcdKey, "/")
+    p.stop = make(chan bool)
+}
+
+// Start loads the policy zones stored in etcd and watches for changes in the
+// background. This has no effect on policies without etcd.
+func (p *ResponsePolicies) Start() {
+    if p.etcd != nil {
+        p.stopped = make(chan bool)
+        go func() {
+            watchEtcd(p.etcd, p.etcdKey, p.Load, p.reload, p.stop)
+            close(p.stopped)
+        }()
+    }
+}
+
+// Stop stops watching etcd for changes, waiting for any reload in progress
+func (p *ResponsePolicies) Stop() {
+    if p.stop != nil {
+        close(p.stop)
+    }
+    if p.stopped != nil {
+        <-p.stopped
+    }
+}
+
+// Load replaces the policy zones with those stored in etcd (after the zones
+// from files), returning the etcd index of the data. If any of the stored zones
+// are invalid the error is logged, and the current zones are kept.
+func (p *ResponsePolicies) Load() (etcdIndex uint64, err error) {
+    zones := append([]*PolicyZone{}, p.staticZones...)
+
+    response, err := p.etcd.Get(p.etcdKey, true, false)
+    if err != nil {
+        if e, ok := err.(*etcd.EtcdError); ok {
+            if e.ErrorCode == 100 {
+                etcdIndex, err = e.Index, nil
+            }
+        }
+
+        if err != nil {
+            return
+        }
+    } else {
+        etcdIndex = response.EtcdIndex
+
+        for _, node := range response.Node.Nodes {
+            if node.Dir {
+                logger.Printf("[WARNING] Ignoring unexpected policy zone directory %s", node.Key)
+                continue
+            }
+
+            var zone *PolicyZone
+            zone, err = parsePolicyZone(node.Key[strings.LastIndex(node.Key, "/") + 1:], strings.NewReader(node.Value))
+            if err != nil {
+                err = fmt.Errorf("%s (%s)", err, node.Key)
+                break
+            }
+            zones = append(zones, zone)
+        }
+    }
+
+    if err != nil {
+        error_counter := metrics.GetOrRegisterCounter("rpz.etcd.load_errors", metrics.DefaultRegistry)
+        error_counter.Inc(1)
+
+        logger.Printf("[ERROR] Keeping the current policy zones, as those in etcd are invalid: %s", err)
+        return etcdIndex, nil
+    }
+
+    p.lock.Lock()
+    p.zones = zones
+    p.lock.Unlock()
+
+    debugMsg(fmt.Sprintf("Loaded %d policy zones", len(zones)))
+    return
+}
+
+// reload loads every zone again after a change in etcd
+func (p *ResponsePolicies) reload(response *etcd.Response) {
+    p.Load()
+}
+
+// Zones returns the policy zones in use, in order of precedence
+func (p *ResponsePolicies) Zones() []*PolicyZone {
+    if p == nil {
+        return nil
+    }
+
+    p.lock.RLock()
+    defer p.lock.RUnlock()
+
+    return p.zones
+}
+
+// Lookup answers the query with the resolver, unless the query, client or the
+// addresses in the answer trigger one of the policies. The first zone with a
+// matching policy wins, and client IP triggers are checked before the QNAME.
+// The response is nil if the query should be dropped.
+func (p *ResponsePolicies) Lookup(r *Resolver, req *dns.Msg, addr net.Addr, anyPolicy string) (msg *dns.Msg, extendedError *ExtendedError) {
+    zones := p.Zones()
+
+    for _, zone := range zones {
+        if policy := zone.matchQuery(req, addr); policy != nil {
+            if policy.action == rpzActionPassthru {
+                policy.log(req, addr)
+                return r.LookupWithError(req, anyPolicy)
+            }
+            return policy.respond(req, addr)
+        }
+    }
+
+    msg, extendedError = r.LookupWithError(req, anyPolicy)
+    if msg.Rcode != dns.RcodeSuccess {
+        return
+    }
+
+    for _, zone := range zones {
+        if policy := zone.matchResponse(msg); policy != nil {
+            if policy.action == rpzActionPassthru {
+                policy.log(req, addr)
+                return
+            }
+            return policy.respond(req, addr)
+        }
+    }
+
+    return
+}
+
+// matchQuery returns the policy triggered by the client or the name queried
+func (z *PolicyZone) matchQuery(req *dns.Msg, addr net.Addr) *Policy {
+    if ip := addrIP(addr); ip != nil {
+        if policy := matchIPPolicy(z.clientIPs, ip); policy != nil {
+            return policy
+        }
+    }
+
+    name := strings.ToLower(req.Question[0].Name)
+    if policy, ok := z.qnames[name]; ok {
+        return policy
+    }
+
+    // Wildcards only match names beneath them, the closest wins
+    labels := dns.SplitDomainName(name)
+    for i := 1; i < len(labels); i++ {
+        if policy, ok := z.wildcards[dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+            return policy
+        }
+    }
+
+    return nil
+}
+
+// matchResponse returns the policy triggered by an address in the answers
+func (z *PolicyZone) matchResponse(msg *dns.Msg) *Policy {
+    if len(z.responseIPs) == 0 {
+        return nil
+    }
+
+    for _, rr := range msg.Answer {
+        var ip net.IP
+        switch rr := rr.(type) {
+        case *dns.A:
+            ip = rr.A
+        case *dns.AAAA:
+            ip = rr.AAAA
+        }
+
+        if ip != nil {
+            if policy := matchIPPolicy(z.responseIPs, ip); policy != nil {
+                return policy
+            }
+        }
+    }
+
+    return nil
+}
+
+// matchIPPolicy returns the policy for the longest prefix containing the IP
+func matchIPPolicy(policies []*ipPolicy, ip net.IP) (policy *Policy) {
+    longest := -1
+    for _, p := range policies {
+        if ones, _ := p.network.Mask.Size(); ones > longest && p.network.Contains(ip) {
+            policy, longest = p.policy, ones
+        }
+    }
+
+    return
+}
+
+// rpzMetricReplacer makes zone names and triggers safe to use in the name of
+// a metric, where dots separate the parts of the name
+var rpzMetricReplacer = strings.NewReplacer(".", "_", "*", "wildcard")
+
+// counterName returns the name of the metric counting the queries that
+// triggered the policy
+func (p *Policy) counterName() string {
+    zone := strings.TrimSuffix(p.zone.name, ".")
+    return "rpz." + rpzMetricReplacer.Replace(zone) + "." + rpzMetricReplacer.Replace(p.trigger)
+}
+
+// log counts a query that triggered the policy, and logs it in debug mode
+func (p *Policy) log(req *dns.Msg, addr net.Addr) {
+    counter := metrics.GetOrRegisterCounter(p.counterName(), metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    if debugEnabled() {
+        debugMsg(fmt.Sprintf("[RPZ] Policy %s in %s (%s) matched %s query for %s from %v", p.trigger, p.zone.name, p.action,
+                             dns.TypeToString[req.Question[0].Qtype], req.Question[0].Name, addr))
+    }
+}
+
+// respond returns the response to a query that triggered the policy, or nil if
+// it should be dropped
+func (p *Policy) respond(req *dns.Msg, addr net.Addr) (msg *dns.Msg, extendedError *ExtendedError) {
+    p.log(req, addr)
+
+    if p.action == rpzActionDrop {
+        return nil, nil
+    }
+
+    msg = new(dns.Msg)
+    msg.SetReply(req)
+    msg.Authoritative = true
+    msg.RecursionAvailable = false
+
+    extendedError = &ExtendedError{Code: edeBlocked, Text: "Blocked by response policy zone " + p.zone.name}
+
+    q := req.Question[0]
+    if p.action == rpzActionLocalData {
+        extendedError = &ExtendedError{Code: edeForgedAnswer, Text: "Rewritten by response policy zone " + p.zone.name}
+
+        for _, record := range p.records {
+            rrType := record.Header().Rrtype
+            if rrType == q.Qtype || rrType == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+                rr := dns.Copy(record)
+                rr.Header().Name = q.Name
+                msg.Answer = append(msg.Answer, rr)
+            }
+        }
+    }
+
+    if p.action == rpzActionNXDomain {
+        msg.SetRcode(req, dns.RcodeNameError)
+    }
+
+    if len(msg.Answer) == 0 && p.zone.soa != nil {
+        msg.Ns = []dns.RR{p.zone.soa}
+    }
+
+    return
+}
+
+// parsePolicyZone reads a policy zone in the zone file format
+func parsePolicyZone(name string, r io.Reader) (zone *PolicyZone, err error) {
+    zone = &PolicyZone{
+        name: strings.ToLower(dns.Fqdn(name)),
+        qnames: make(map[string]*Policy),
+        wildcards: make(map[string]*Policy)}
+
+    for token := range dns.ParseZone(r, zone.name, name) {
+        if token.Error != nil {
+            return nil, token.Error
+        }
+
+        header := token.RR.Header()
+        owner := strings.ToLower(header.Name)
+
+        // Take the name of the zone from the SOA record, so $ORIGIN works
+        if soa, ok := token.RR.(*dns.SOA); ok {
+            zone.name, zone.soa = owner, soa
+            continue
+        } else if header.Rrtype == dns.TypeNS {
+            continue
+        }
+
+        if !dns.IsSubDomain(zone.name, owner) || owner == zone.name {
+            return nil, fmt.Errorf("Policy %s is outside of the zone %s", owner, zone.name)
+        }
+
+        trigger := strings.TrimSuffix(owner, "." + zone.name)
+        if err = zone.addPolicy(trigger, token.RR); err != nil {
+            return nil, err
+        }
+    }
+
+    return
+}
+
+// addPolicy adds the policy described by the record for the given trigger
+// (the owner name of the record, relative to the zone)
+func (z *PolicyZone) addPolicy(trigger string, rr dns.RR) error {
+    action := rpzActionLocalData
+    if cname, ok := rr.(*dns.CNAME); ok {
+        switch strings.ToLower(cname.Target) {
+        case ".":
+            action = rpzActionNXDomain
+        case "*.":
+            action = rpzActionNoData
+        case "rpz-passthru.":
+            action = rpzActionPassthru
+        case "rpz-drop.":
+            action = rpzActionDrop
+        case "rpz-tcp-only.":
+            return fmt.Errorf("Unsupported action rpz-tcp-only for %s in %s", trigger, z.name)
+        }
+    }
+
+    var triggerType string
+    var network *net.IPNet
+    if strings.HasSuffix(trigger, ".rpz-client-ip") || strings.HasSuffix(trigger, ".rpz-ip") {
+        triggerType = trigger[strings.LastIndex(trigger, ".") + 1:]
+
+        var err error
+        network, err = parseRPZNetwork(strings.TrimSuffix(trigger, "." + triggerType))
+        if err != nil {
+            return fmt.Errorf("Invalid trigger %s in %s: %s", trigger, z.name, err)
+        }
+    } else if strings.HasSuffix(trigger, ".rpz-nsdname") || strings.HasSuffix(trigger, ".rpz-nsip") {
+        return fmt.Errorf("Unsupported trigger %s in %s", trigger, z.name)
+    }
+
+    // Find the existing policy for the trigger, so local data can be made up
+    // of several records
+    var policy *Policy
+    switch triggerType {
+    case "rpz-client-ip":
+        policy = findIPPolicy(z.clientIPs, network)
+    case "rpz-ip":
+        policy = findIPPolicy(z.responseIPs, network)
+    default:
+        if strings.HasPrefix(trigger, "*.") {
+            policy = z.wildcards[dns.Fqdn(trigger[2:])]
+        } else {
+            policy = z.qnames[dns.Fqdn(trigger)]
+        }
+    }
+
+    if policy != nil {
+        if policy.action != rpzActionLocalData || action != rpzActionLocalData {
+            return fmt.Errorf("Conflicting policies for %s in %s", trigger, z.name)
+        }
+        policy.records = append(policy.records, rr)
+        return nil
+    }
+
+    policy = &Policy{zone: z, trigger: trigger, action: action}
+    if action == rpzActionLocalData {
+        policy.records = []dns.RR{rr}
+    }
+
+    switch triggerType {
+    case "rpz-client-ip":
+        z.clientIPs = append(z.clientIPs, &ipPolicy{network, policy})
+    case "rpz-ip":
+        z.responseIPs = append(z.responseIPs, &ipPolicy{network, policy})
+    default:
+        if strings.HasPrefix(trigger, "*.") {
+            z.wildcards[dns.Fqdn(trigger[2:])] = policy
+        } else {
+            z.qnames[dns.Fqdn(trigger)] = policy
+        }
+    }
+
+    return nil
+}
+
+func findIPPolicy(policies []*ipPolicy, network *net.IPNet) *Policy {
+    for _, p := range policies {
+        if p.network.String() == network.String() {
+            return p.policy
+        }
+    }
+    return nil
+}
+
+// parseRPZNetwork parses the network of an IP trigger, which is the prefix
+// length followed by the address in reverse (e.g 24.0.2.0.192 for 192.0.2.0/24,
+// or 48.zz.db8.2001 for 2001:db8::/48)
+func parseRPZNetwork(trigger string) (*net.IPNet, error) {
+    labels := strings.Split(trigger, ".")
+    if len(labels) < 2 {
+        return nil, fmt.Errorf("Expected a prefix length and address")
+    }
+
+    prefix, err := strconv.Atoi(labels[0])
+    if err != nil {
+        return nil, fmt.Errorf("Invalid prefix length '%s'", labels[0])
+    }
+
+    address := labels[1:]
+    for i, j := 0, len(address) - 1; i < j; i, j = i + 1, j - 1 {
+        address[i], address[j] = address[j], address[i]
+    }
+
+    bits := 32
+    ip := net.ParseIP(strings.Join(address, "."))
+    if ip == nil || ip.To4() == nil || len(address) != 4 {
+        bits = 128
+        ip = net.ParseIP(expandRPZZeros(strings.Join(address, ":")))
+        if ip == nil || ip.To4() != nil {
+            return nil, fmt.Errorf("Invalid address '%s'", strings.Join(address, "."))
+        }
+    }
+
+    if prefix < 1 || prefix > bits {
+        return nil, fmt.Errorf("Invalid prefix length %d", prefix)
+    }
+
+    return &net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}, nil
+}
+
+// expandRPZZeros replaces the zz label that stands for the longest run of zeros
+// in an IPv6 trigger with ::
+func expandRPZZeros(address string) string {
+    switch {
+    case address == "zz":
+        return "::"
+    case strings.HasPrefix(address, "zz:"):
+        return "::" + address[3:]
+    case strings.HasSuffix(address, ":zz"):
+        return address[:len(address) - 3] + "::"
+    }
+    return strings.Replace(address, ":zz:", "::", 1)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+const testPolicyZone = `$TTL 60
+@                               SOA     ns1.disco.net. admin.disco.net. 1 3600 600 86400 10
+                                NS      ns1.disco.net.
+bad.disco.net                   CNAME   .
+*.bad.disco.net                 CNAME   .
+empty.disco.net                 CNAME   *.
+quiet.disco.net                 CNAME   rpz-drop.
+ok.bad.disco.net                CNAME   rpz-passthru.
+old.disco.net                   A       10.0.0.1
+old.disco.net                   AAAA    fd00::1
+moved.disco.net                 CNAME   new.disco.net.
+32.1.0.0.127.rpz-client-ip      CNAME   rpz-passthru.
+8.0.0.0.127.rpz-client-ip       CNAME   .
+24.0.9.9.10.rpz-ip              CNAME   .
+32.9.9.9.10.rpz-ip              A       10.1.1.1
+`
+
+func TestPolicyZone(t *testing.T) {
+    resolver.etcdPrefix = "TestPolicyZone/"
+    client.Set("TestPolicyZone/net/disco/web/.A", "10.9.8.1", 0)
+    client.Set("TestPolicyZone/net/disco/blocked/.A", "10.9.9.1", 0)
+    client.Set("TestPolicyZone/net/disco/rewritten/.A", "10.9.9.9", 0)
+    client.Set("TestPolicyZone/net/disco/bad/ok/.A", "10.9.8.2", 0)
+    defer client.Delete("TestPolicyZone/", true)
+
+    zone, err := parsePolicyZone("policy.disco.net", strings.NewReader(testPolicyZone))
+    if err != nil {
+        t.Error("Unexpected error parsing the zone: ", err)
+        t.Fatal()
+    }
+    policies := &ResponsePolicies{zones: []*PolicyZone{zone}}
+
+    var expected = []struct {
+        name        string
+        qType       uint16
+        client      string
+        dropped     bool
+        rcode       int
+        answers     []string
+        soa         bool
+    } {
+        {"web.disco.net.", dns.TypeA, "10.0.0.1", false, dns.RcodeSuccess, []string{"10.9.8.1"}, false},
+        {"bad.disco.net.", dns.TypeA, "10.0.0.1", false, dns.RcodeNameError, nil, true},
+        {"Foo.Bad.Disco.Net.", dns.TypeA, "10.0.0.1", false, dns.RcodeNameError, nil, true},
+        {"ok.bad.disco.net.", dns.TypeA, "10.0.0.1", false, dns.RcodeSuccess, []string{"10.9.8.2"}, false},
+        {"empty.disco.net.", dns.TypeA, "10.0.0.1", false, dns.RcodeSuccess, nil, true},
+        {"quiet.disco.net.", dns.TypeA, "10.0.0.1", true, 0, nil, false},
+        {"old.disco.net.", dns.TypeA, "10.0.0.1", false, dns.RcodeSuccess, []string{"10.0.0.1"}, false},
+        {"old.disco.net.", dns.TypeAAAA, "10.0.0.1", false, dns.RcodeSuccess, []string{"fd00::1"}, false},
+        {"old.disco.net.", dns.TypeTXT, "10.0.0.1", false, dns.RcodeSuccess, nil, true},
+        {"moved.disco.net.", dns.TypeA, "10.0.0.1", false, dns.RcodeSuccess, []string{"new.disco.net."}, false},
+
+        // Client IPs, the longest prefix wins
+        {"web.disco.net.", dns.TypeA, "127.0.0.2", false, dns.RcodeNameError, nil, true},
+        {"web.disco.net.", dns.TypeA, "127.0.0.1", false, dns.RcodeSuccess, []string{"10.9.8.1"}, false},
+        {"bad.disco.net.", dns.TypeA, "127.0.0.1", false, dns.RcodeSuccess, nil, false},
+
+        // Response IPs
+        {"blocked.disco.net.", dns.TypeA, "10.0.0.1", false, dns.RcodeNameError, nil, true},
+        {"rewritten.disco.net.", dns.TypeA, "10.0.0.1", false, dns.RcodeSuccess, []string{"10.1.1.1"}, false},
+    }
+
+    for _, e := range expected {
+        req := new(dns.Msg)
+        req.SetQuestion(e.name, e.qType)
+        addr := &net.UDPAddr{IP: net.ParseIP(e.client), Port: 12345}
+
+        msg, _ := policies.Lookup(resolver, req, addr, anyPolicyFull)
+        if e.dropped {
+            if msg != nil {
+                t.Error("Expected ", e.name, " to be dropped")
+            }
+            continue
+        }
+
+        if msg == nil {
+            t.Error("Expected a response for ", e.name)
+            continue
+        }
+
+        if msg.Rcode != e.rcode {
+            t.Error("Expected ", dns.RcodeToString[e.rcode], " for ", e.name, " from ", e.client, ", got ", dns.RcodeToString[msg.Rcode])
+        }
+
+        answers := make([]string, 0)
+        for _, rr := range msg.Answer {
+            if rr.Header().Name != e.name {
+                t.Error("Expected the answer to be for ", e.name, ": ", rr)
+            }
+
+            switch rr := rr.(type) {
+            case *dns.A:
+                answers = append(answers, rr.A.String())
+            case *dns.AAAA:
+                answers = append(answers, rr.AAAA.String())
+            case *dns.CNAME:
+                answers = append(answers, rr.Target)
+            }
+        }
+        if strings.Join(answers, ",") != strings.Join(e.answers, ",") {
+            t.Error("Expected answers ", e.answers, " for ", e.name, " from ", e.client, ", got ", answers)
+        }
+
+        if e.soa != (len(msg.Ns) == 1 && msg.Ns[0].Header().Name == "policy.disco.net.") {
+            t.Error("Unexpected authority records for ", e.name, " from ", e.client, ": ", msg.Ns)
+        }
+    }
+}
+
+func TestPolicyCounters(t *testing.T) {
+    resolver.etcdPrefix = "TestPolicyCounters/"
+    defer client.Delete("TestPolicyCounters/", true)
+
+    zone, err := parsePolicyZone("policy.disco.net", strings.NewReader(testPolicyZone))
+    if err != nil {
+        t.Error("Unexpected error parsing the zone: ", err)
+        t.Fatal()
+    }
+    policies := &ResponsePolicies{zones: []*PolicyZone{zone}}
+
+    // Each policy has its own counter, even those with the same action
+    var expected = []struct {
+        name        string
+        counter     string
+        hits        int64
+    } {
+        {"bad.disco.net.", "rpz.policy_disco_net.bad_disco_net", 1},
+        {"foo.bad.disco.net.", "rpz.policy_disco_net.wildcard_bad_disco_net", 2},
+        {"bar.bad.disco.net.", "rpz.policy_disco_net.wildcard_bad_disco_net", 2},
+    }
+
+    counts := make(map[string]int64)
+    for _, e := range expected {
+        counts[e.counter] = metrics.GetOrRegisterCounter(e.counter, metrics.DefaultRegistry).Count()
+    }
+
+    for _, e := range expected {
+        req := new(dns.Msg)
+        req.SetQuestion(e.name, dns.TypeA)
+        policies.Lookup(resolver, req, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}, anyPolicyFull)
+    }
+
+    for _, e := range expected {
+        if hits := metrics.GetOrRegisterCounter(e.counter, metrics.DefaultRegistry).Count() - counts[e.counter]; hits != e.hits {
+            t.Error("Expected ", e.hits, " hits for ", e.counter, ", got ", hits)
+        }
+    }
+}
+
+func TestPolicyZoneExtendedErrors(t *testing.T) {
+    resolver.etcdPrefix = "TestPolicyZoneExtendedErrors/"
+
+    zone, err := parsePolicyZone("policy.disco.net", strings.NewReader(testPolicyZone))
+    if err != nil {
+        t.Error("Unexpected error parsing the zone: ", err)
+        t.Fatal()
+    }
+
+    handler := newTestHandler(resolver)
+    handler.policies = &ResponsePolicies{zones: []*PolicyZone{zone}}
+
+    for name, code := range map[string]uint16{"bad.disco.net.": edeBlocked, "old.disco.net.": edeForgedAnswer} {
+        req := new(dns.Msg)
+        req.SetQuestion(name, dns.TypeA)
+        req.SetEdns0(4096, false)
+
+        writer := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 12345}}
+        handler.Handle(writer, req)
+
+        if len(writer.written) != 1 {
+            t.Error("Expected a packed response for ", name)
+            t.Fatal()
+        }
+
+        extendedError, err := unpackExtendedError(writer.written[0])
+        if err != nil || extendedError == nil || extendedError.Code != code {
+            t.Error("Expected extended error ", code, " for ", name, ", got ", extendedError, err)
+        }
+    }
+}
+
+func TestParseRPZNetwork(t *testing.T) {
+    var expected = map[string]string {
+        "32.1.2.0.192": "192.0.2.1/32",
+        "24.0.2.0.192": "192.0.2.0/24",
+        "8.1.2.3.10": "10.0.0.0/8",
+        "128.1.zz.db8.2001": "2001:db8::1/128",
+        "48.zz.db8.2001": "2001:db8::/48",
+        "64.zz.1.0.db8.2001": "2001:db8:0:1::/64",
+        "128.1.0.0.0.0.0.0.fd00": "fd00::1/128",
+    }
+
+    for trigger, cidr := range expected {
+        network, err := parseRPZNetwork(trigger)
+        if err != nil || network.String() != cidr {
+            t.Error("Expected ", cidr, " for ", trigger, ", got ", network, err)
+        }
+    }
+
+    for _, trigger := range []string{"32", "33.1.2.0.192", "0.1.2.0.192", "x.1.2.0.192", "24.2.0.192", "129.1.zz.db8.2001", "64.zz.zz.2001"} {
+        if network, err := parseRPZNetwork(trigger); err == nil {
+            t.Error("Expected an error for ", trigger, ", got ", network)
+        }
+    }
+}
+
+func TestParseInvalidPolicyZones(t *testing.T) {
+    invalid := []string{
+        "ns.disco.net.rpz-nsdname CNAME .",
+        "32.1.0.0.10.rpz-nsip CNAME .",
+        "tcp.disco.net CNAME rpz-tcp-only.",
+        "33.1.0.0.10.rpz-ip CNAME .",
+        "bad.disco.net CNAME .\nbad.disco.net A 10.0.0.1",
+        "outside.example.com. CNAME .",
+        "bad.disco.net IN BOGUS .",
+    }
+
+    for _, zone := range invalid {
+        if _, err := parsePolicyZone("policy.disco.net", strings.NewReader(zone + "\n")); err == nil {
+            t.Error("Expected an error parsing ", zone)
+        }
+    }
+}
+
+func TestEtcdPolicies(t *testing.T) {
+    client := etcd.NewClient([]string{"http://127.0.0.1:4001"})
+    client.Delete("/_TestEtcdPolicies", true)
+    defer client.Delete("/_TestEtcdPolicies", true)
+
+    client.Set("/_TestEtcdPolicies/policy.disco.net", "bad.disco.net CNAME .\n", 0)
+
+    policies, _ := NewResponsePolicies(nil)
+    policies.WatchEtcd(client, "/_TestEtcdPolicies/")
+    policies.Start()
+    defer policies.Stop()
+
+    waitForZones := func(check func([]*PolicyZone) bool) bool {
+        for attempt := 0; attempt < 50; attempt++ {
+            if check(policies.Zones()) {
+                return true
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+        return false
+    }
+
+    if !waitForZones(func(zones []*PolicyZone) bool { return len(zones) == 1 && zones[0].qnames["bad.disco.net."] != nil }) {
+        t.Error("Expected the policy zone stored in etcd to be loaded")
+        t.Fatal()
+    }
+
+    // Invalid zones are ignored, leaving the previous zones in place
+    client.Set("/_TestEtcdPolicies/policy.disco.net", "bad.disco.net CNAME .\nworse.disco.net CNAME rpz-tcp-only.\n", 0)
+    time.Sleep(300 * time.Millisecond)
+    if zones := policies.Zones(); len(zones) != 1 || zones[0].qnames["bad.disco.net."] == nil {
+        t.Error("Expected the previous zone to be kept")
+    }
+
+    client.Set("/_TestEtcdPolicies/policy.disco.net", "worse.disco.net CNAME .\n", 0)
+    if !waitForZones(func(zones []*PolicyZone) bool { return len(zones) == 1 && zones[0].qnames["worse.disco.net."] != nil }) {
+        t.Error("Expected the updated policy zone to be loaded")
+    }
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "net"
+    "strings"
+    "sync"
+    "time"
+)
+
+// ResponseRateLimiter limits the rate of identical responses sent to the same
+// network, in the style of BIND's response rate limiting (RRL). This blunts
+// reflection attacks, where a spoofed source address is used to bounce large
+// responses off us at a victim.
+//
+// Each client network and response (name, type and rcode) has a bucket of
+// tokens, refilled at the configured rate and spent on every response. Once
+// the bucket is empty responses are dropped, except for every slip'th one
+// which is sent truncated, so real clients can retry over TCP. Buckets can go
+// into debt for up to window seconds worth of responses, so a client has to
+// slow down for a while before its responses are sent again.
+type ResponseRateLimiter struct {
+    lock            sync.Mutex
+    rate            int
+    window          int
+    slip            int
+    ipv4Prefix      int
+    ipv6Prefix      int
+    exempt          []*net.IPNet
+    logOnly         bool
+    buckets         *bucketTable
+    pruned          time.Time
+    now             func() time.Time
+}
+
+type rrlBucket struct {
+    balance         float64
+    updated         time.Time
+    limited         int
+}
+
+// NewResponseRateLimiter returns a limiter keeping at most maxBuckets buckets,
+// evicting the least recently used when there are more (or any number of
+// buckets if zero).
+func NewResponseRateLimiter(rate int, window int, slip int, ipv4Prefix int, ipv6Prefix int, exempt []*net.IPNet, logOnly bool, maxBuckets int) *ResponseRateLimiter {
+    return &ResponseRateLimiter{
+        rate: rate,
+        window: window,
+        slip: slip,
+        ipv4Prefix: ipv4Prefix,
+        ipv6Prefix: ipv6Prefix,
+        exempt: exempt,
+        logOnly: logOnly,
+        buckets: newBucketTable(maxBuckets),
+        now: time.Now}
+}
+
+// Limit returns the response to send to the client, which is either the given
+// message, a truncated copy of it (when slipping) or nil if nothing should be
+// sent at all. The limited result is true when the response was changed.
+func (l *ResponseRateLimiter) Limit(addr net.Addr, msg *dns.Msg) (response *dns.Msg, limited bool) {
+    if l == nil || l.rate <= 0 {
+        return msg, false
+    }
+
+    ip := addrIP(addr)
+    if ip == nil || addrInNetworks(addr, l.exempt) {
+        return msg, false
+    }
+
+    network := clientNetwork(ip, l.ipv4Prefix, l.ipv6Prefix)
+    key := network + "/" + rrlResponseKey(msg)
+
+    l.lock.Lock()
+    now := l.now()
+    l.prune(now)
+
+    var bucket *rrlBucket
+    if value, ok := l.buckets.Get(key, now); ok {
+        bucket = value.(*rrlBucket)
+    } else {
+        bucket = &rrlBucket{balance: float64(l.rate), updated: now}
+        if l.buckets.Add(key, bucket, now) {
+            evicted_counter := metrics.GetOrRegisterCounter("rrl.evicted", metrics.DefaultRegistry)
+            evicted_counter.Inc(1)
+        }
+    }
+
+    // Refill the bucket for the time since it was last used, holding at most
+    // one second of responses, then spend a token on this response
+    bucket.balance += now.Sub(bucket.updated).Seconds() * float64(l.rate)
+    if bucket.balance > float64(l.rate) {
+        bucket.balance = float64(l.rate)
+    }
+    bucket.updated = now
+
+    bucket.balance -= 1
+    if debt := -float64(l.window * l.rate); bucket.balance < debt {
+        bucket.balance = debt
+    }
+
+    if bucket.balance >= 0 {
+        if bucket.limited > 0 {
+            logger.Printf("[RRL] Stopped limiting responses to %s for %s", network, rrlDescribe(msg))
+        }
+        bucket.limited = 0
+        l.lock.Unlock()
+        return msg, false
+    }
+
+    bucket.limited++
+    if bucket.limited == 1 {
+        if l.logOnly {
+            logger.Printf("[RRL] Would limit responses to %s for %s (log only)", network, rrlDescribe(msg))
+        } else {
+            logger.Printf("[RRL] Limiting responses to %s for %s", network, rrlDescribe(msg))
+        }
+    }
+    slip := l.slip > 0 && bucket.limited % l.slip == 0
+    l.lock.Unlock()
+
+    action := "dropped"
+    if slip {
+        action = "slipped"
+    }
+
+    if l.logOnly {
+        counter := metrics.GetOrRegisterCounter("rrl.log_only." + action, metrics.DefaultRegistry)
+        counter.Inc(1)
+
+        return msg, false
+    }
+
+    counter := metrics.GetOrRegisterCounter("rrl." + action, metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    if !slip {
+        return nil, true
+    }
+
+    // A truncated response tells genuine clients to retry over TCP, which
+    // can't be spoofed, without giving an attacker anything to amplify
+    response = new(dns.Msg)
+    response.SetReply(msg)
+    response.Rcode = msg.Rcode
+    response.Authoritative = msg.Authoritative
+    response.Truncated = true
+
+    return response, true
+}
+
+// clientNetwork returns the network (as a CIDR) of the client, which is shared
+// by every client within the given prefix length
+func clientNetwork(ip net.IP, ipv4Prefix int, ipv6Prefix int) string {
+    network := &net.IPNet{IP: ip, Mask: net.CIDRMask(ipv6Prefix, 128)}
+    if ip4 := ip.To4(); ip4 != nil {
+        network = &net.IPNet{IP: ip4, Mask: net.CIDRMask(ipv4Prefix, 32)}
+    }
+
+    network.IP = network.IP.Mask(network.Mask)
+    return network.String()
+}
+
+// prune removes the buckets that have been full for a whole window, which
+// only looks at the buckets being removed. The number of buckets is reported
+// at most once per window.
+func (l *ResponseRateLimiter) prune(now time.Time) {
+    window := time.Duration(l.window) * time.Second
+    if window <= 0 {
+        window = time.Second
+    }
+
+    l.buckets.Expire(now.Add(-(window + time.Second)))
+
+    if now.Sub(l.pruned) < window {
+        return
+    }
+    l.pruned = now
+
+    gauge := metrics.GetOrRegisterGauge("rrl.buckets", metrics.DefaultRegistry)
+    gauge.Update(int64(l.buckets.Len()))
+}
+
+// rrlResponseKey identifies a response for rate limiting. Answers are grouped
+// by name and type, NXDOMAIN responses by zone (so random names within a zone
+// share a bucket) and other errors by rcode alone.
+func rrlResponseKey(msg *dns.Msg) string {
+    q := msg.Question[0]
+
+    switch msg.Rcode {
+    case dns.RcodeSuccess:
+        return strings.ToLower(q.Name) + "/" + dns.TypeToString[q.Qtype]
+    case dns.RcodeNameError:
+        name := q.Name
+        for _, rr := range msg.Ns {
+            if rr.Header().Rrtype == dns.TypeSOA {
+                name = rr.Header().Name
+            }
+        }
+        return strings.ToLower(name) + "/" + dns.RcodeToString[msg.Rcode]
+    }
+
+    return dns.RcodeToString[msg.Rcode]
+}
+
+// rrlDescribe returns a description of a response for logging
+func rrlDescribe(msg *dns.Msg) string {
+    q := msg.Question[0]
+    return dns.TypeToString[q.Qtype] + " " + q.Name + " (" + dns.RcodeToString[msg.Rcode] + ")"
+}
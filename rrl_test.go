@@ -0,0 +1,259 @@
+package main
+
+import (
+    "fmt"
+    "github.com/miekg/dns"
+    "net"
+    "testing"
+    "time"
+)
+
+// testRateLimiter returns a limiter with a clock that only moves when told to
+func testRateLimiter(rate int, window int, slip int, exempt []*net.IPNet, logOnly bool) (limiter *ResponseRateLimiter, clock *time.Time) {
+    clock = &time.Time{}
+    *clock = time.Unix(1000000, 0)
+
+    limiter = NewResponseRateLimiter(rate, window, slip, 24, 56, exempt, logOnly, 0)
+    limiter.now = func() time.Time { return *clock }
+    return
+}
+
+func testResponse(name string, rrType uint16, rcode int) *dns.Msg {
+    req := new(dns.Msg)
+    req.SetQuestion(name, rrType)
+
+    msg := new(dns.Msg)
+    msg.SetRcode(req, rcode)
+    return msg
+}
+
+func udpAddr(ip string) net.Addr {
+    return &net.UDPAddr{IP: net.ParseIP(ip), Port: 12345}
+}
+
+// limitResults sends a number of identical responses, returning how many were
+// sent, slipped and dropped
+func limitResults(limiter *ResponseRateLimiter, addr net.Addr, msg *dns.Msg, count int) (sent int, slipped int, dropped int) {
+    for i := 0; i < count; i++ {
+        response, limited := limiter.Limit(addr, msg)
+        if response == nil {
+            dropped++
+        } else if limited {
+            if !response.Truncated || len(response.Answer) > 0 {
+                panic("Expected slipped responses to be truncated and empty")
+            }
+            slipped++
+        } else {
+            sent++
+        }
+    }
+
+    return
+}
+
+func TestResponseRateLimit(t *testing.T) {
+    limiter, clock := testRateLimiter(5, 2, 2, nil, false)
+
+    msg := testResponse("disco.net.", dns.TypeA, dns.RcodeSuccess)
+    msg.Answer = append(msg.Answer, &dns.A{Hdr: dns.RR_Header{Name: "disco.net.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("10.0.0.1")})
+
+    sent, slipped, dropped := limitResults(limiter, udpAddr("192.0.2.1"), msg, 15)
+    if sent != 5 || slipped != 5 || dropped != 5 {
+        t.Error("Expected 5 sent, slipped and dropped responses, got ", sent, slipped, dropped)
+    }
+
+    // Clients within the same network share the limit, but other networks,
+    // names, types and rcodes don't
+    if _, limited := limiter.Limit(udpAddr("192.0.2.200"), msg); !limited {
+        t.Error("Expected the response to another client in the network to be limited")
+    }
+
+    var unlimited = []struct {
+        addr    net.Addr
+        msg     *dns.Msg
+    } {
+        {udpAddr("192.0.3.1"), msg},
+        {udpAddr("192.0.2.1"), testResponse("www.disco.net.", dns.TypeA, dns.RcodeSuccess)},
+        {udpAddr("192.0.2.1"), testResponse("disco.net.", dns.TypeAAAA, dns.RcodeSuccess)},
+        {udpAddr("192.0.2.1"), testResponse("disco.net.", dns.TypeA, dns.RcodeServerFailure)},
+    }
+
+    for _, u := range unlimited {
+        if response, limited := limiter.Limit(u.addr, u.msg); limited || response != u.msg {
+            t.Error("Expected the response to ", u.addr, " for ", u.msg.Question[0], " not to be limited")
+        }
+    }
+
+    // The debt must be paid off before any more responses are sent, so one
+    // second isn't long enough
+    *clock = clock.Add(time.Second)
+    if _, limited := limiter.Limit(udpAddr("192.0.2.1"), msg); !limited {
+        t.Error("Expected the response to still be limited after one second")
+    }
+
+    *clock = clock.Add(3 * time.Second)
+    sent, slipped, dropped = limitResults(limiter, udpAddr("192.0.2.1"), msg, 6)
+    if sent != 5 || dropped != 1 {
+        t.Error("Expected 5 responses to be sent once the client slowed down, got ", sent, slipped, dropped)
+    }
+}
+
+func TestResponseRateLimitSlip(t *testing.T) {
+    var expected = []struct {
+        slip        int
+        slipped     int
+        dropped     int
+    } {
+        {0, 0, 6},
+        {1, 6, 0},
+        {3, 2, 4},
+    }
+
+    for _, e := range expected {
+        limiter, _ := testRateLimiter(1, 10, e.slip, nil, false)
+        msg := testResponse("disco.net.", dns.TypeA, dns.RcodeSuccess)
+
+        sent, slipped, dropped := limitResults(limiter, udpAddr("192.0.2.1"), msg, 7)
+        if sent != 1 || slipped != e.slipped || dropped != e.dropped {
+            t.Error("Unexpected results with a slip of ", e.slip, ": ", sent, slipped, dropped)
+        }
+    }
+}
+
+func TestResponseRateLimitExempt(t *testing.T) {
+    exempt, _ := parseNetworks([]string{"10.0.0.0/8", "fd00::/8"})
+    limiter, _ := testRateLimiter(1, 10, 2, exempt, false)
+    msg := testResponse("disco.net.", dns.TypeA, dns.RcodeSuccess)
+
+    for _, addr := range []string{"10.1.2.3", "fd00::1"} {
+        if sent, _, _ := limitResults(limiter, udpAddr(addr), msg, 10); sent != 10 {
+            t.Error("Expected every response to ", addr, " to be sent, got ", sent)
+        }
+    }
+
+    if sent, _, _ := limitResults(limiter, udpAddr("2001:db8::1"), msg, 10); sent != 1 {
+        t.Error("Expected responses to other clients to be limited, got ", sent)
+    }
+}
+
+func TestResponseRateLimitLogOnly(t *testing.T) {
+    limiter, _ := testRateLimiter(1, 10, 2, nil, true)
+    msg := testResponse("disco.net.", dns.TypeA, dns.RcodeSuccess)
+
+    if sent, _, _ := limitResults(limiter, udpAddr("192.0.2.1"), msg, 10); sent != 10 {
+        t.Error("Expected every response to be sent in log only mode, got ", sent)
+    }
+}
+
+func TestResponseRateLimitPrune(t *testing.T) {
+    limiter, clock := testRateLimiter(1, 10, 2, nil, false)
+
+    limiter.Limit(udpAddr("192.0.2.1"), testResponse("disco.net.", dns.TypeA, dns.RcodeSuccess))
+    *clock = clock.Add(5 * time.Second)
+    limiter.Limit(udpAddr("192.0.2.1"), testResponse("www.disco.net.", dns.TypeA, dns.RcodeSuccess))
+
+    *clock = clock.Add(10 * time.Second)
+    limiter.Limit(udpAddr("192.0.3.1"), testResponse("disco.net.", dns.TypeA, dns.RcodeSuccess))
+
+    if limiter.buckets.Len() != 2 {
+        t.Error("Expected the idle bucket to be removed, got ", limiter.buckets.Len(), " buckets")
+    }
+}
+
+func TestResponseRateLimitMaxTableSize(t *testing.T) {
+    limiter, clock := testRateLimiter(1, 10, 0, nil, false)
+    limiter.buckets = newBucketTable(2)
+
+    // A client over its limit stays limited while other responses come and go
+    limited := testResponse("disco.net.", dns.TypeA, dns.RcodeSuccess)
+    limitResults(limiter, udpAddr("192.0.2.1"), limited, 5)
+
+    for i := 0; i < 10; i++ {
+        *clock = clock.Add(time.Millisecond)
+        limiter.Limit(udpAddr("198.51.100.1"), testResponse(fmt.Sprintf("random-%d.disco.net.", i), dns.TypeA, dns.RcodeSuccess))
+        if response, _ := limiter.Limit(udpAddr("192.0.2.1"), limited); response != nil {
+            t.Error("Expected the recently used bucket to be kept")
+        }
+    }
+
+    // The table never holds more than the maximum, dropping the least
+    // recently used buckets to make room
+    if limiter.buckets.Len() != 2 {
+        t.Error("Expected 2 buckets, got ", limiter.buckets.Len())
+    }
+    if _, ok := limiter.buckets.Get("198.51.100.0/24/random-0.disco.net./A", *clock); ok {
+        t.Error("Expected the least recently used bucket to be evicted")
+    }
+}
+
+func TestResponseRateLimitKeys(t *testing.T) {
+    soa := &dns.SOA{Hdr: dns.RR_Header{Name: "disco.net.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}}
+
+    nxdomain := func(name string) *dns.Msg {
+        msg := testResponse(name, dns.TypeA, dns.RcodeNameError)
+        msg.Ns = []dns.RR{soa}
+        return msg
+    }
+
+    var expected = []struct {
+        msg     *dns.Msg
+        key     string
+    } {
+        {testResponse("Disco.Net.", dns.TypeA, dns.RcodeSuccess), "disco.net./A"},
+        {testResponse("disco.net.", dns.TypeMX, dns.RcodeSuccess), "disco.net./MX"},
+        {nxdomain("random-1.disco.net."), "disco.net./NXDOMAIN"},
+        {nxdomain("random-2.disco.net."), "disco.net./NXDOMAIN"},
+        {testResponse("random.disco.org.", dns.TypeA, dns.RcodeNameError), "random.disco.org./NXDOMAIN"},
+        {testResponse("disco.net.", dns.TypeA, dns.RcodeRefused), "REFUSED"},
+        {testResponse("disco.org.", dns.TypeTXT, dns.RcodeRefused), "REFUSED"},
+    }
+
+    for _, e := range expected {
+        if key := rrlResponseKey(e.msg); key != e.key {
+            t.Error("Expected the key ", e.key, " for ", e.msg.Question[0], ", got ", key)
+        }
+    }
+
+    var networks = map[string]string {
+        "192.0.2.123": "192.0.2.0/24",
+        "2001:db8:1:ff::1": "2001:db8:1::/56",
+        "::ffff:192.0.2.1": "192.0.2.0/24",
+    }
+
+    for ip, network := range networks {
+        if n := clientNetwork(net.ParseIP(ip), 24, 56); n != network {
+            t.Error("Expected the network ", network, " for ", ip, ", got ", n)
+        }
+    }
+}
+
+func TestHandlerResponseRateLimit(t *testing.T) {
+    handler := newTestHandler(nil)
+    handler.queryFilterer = NewQueryFilterer(nil, []QueryFilter{QueryFilter{domain: "disco.net.", action: filterActionRefused}})
+    handler.rateLimiter, _ = testRateLimiter(2, 10, 2, nil, false)
+
+    writer := &testResponseWriter{}
+    for i := 0; i < 6; i++ {
+        query := new(dns.Msg)
+        query.SetQuestion("foo.disco.net.", dns.TypeA)
+        query.SetEdns0(4096, false)
+
+        handler.Handle(writer, query)
+    }
+
+    if len(writer.messages) != 4 {
+        t.Error("Expected 2 responses and 2 slipped responses, got ", len(writer.messages))
+        t.Fatal()
+    }
+
+    for i, msg := range writer.messages {
+        if msg.Rcode != dns.RcodeRefused || msg.Truncated != (i >= 2) {
+            t.Error("Unexpected response ", i, ": ", msg)
+        }
+    }
+
+    // Slipped responses don't carry the extended error
+    if len(writer.written) != 2 {
+        t.Error("Expected only the unlimited responses to include an extended error, got ", len(writer.written))
+    }
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+    "fmt"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Strategies for filling in the serial number of SOA records
+var serialStrategies = map[string]bool{
+    "index": true,      // The highest etcd modified index within the zone
+    "date": true,       // The current date and hour, as YYYYMMDDHH
+    "stored": true,     // The "serial" field of the stored SOA record
+}
+
+// How long a zone serial read from etcd is reused before the zone is read
+// again, when changes aren't being watched for
+const serialCacheDuration = 5 * time.Second
+
+type zoneSerial struct {
+    index       uint64
+    expires     time.Time
+}
+
+// ZoneSerials holds the serial of each zone for the index strategy, which is
+// the highest etcd index seen for anything within the zone. A serial only ever
+// increases, as required by RFC 1982. Since etcd doesn't keep an index for
+// deleted keys, the serials are kept up to date by watching etcd for changes
+// (including deletes), and the zone only needs to be read the first time its
+// serial is asked for.
+type ZoneSerials struct {
+    etcd        *etcd.Client
+    etcdPrefix  string
+
+    lock        sync.Mutex
+    serials     map[string]*zoneSerial
+    watching    bool
+    stop        chan bool
+}
+
+func NewZoneSerials(client *etcd.Client, etcdPrefix string) *ZoneSerials {
+    return &ZoneSerials{
+        etcd: client,
+        etcdPrefix: "/" + strings.Trim(etcdPrefix, "/"),
+        serials: make(map[string]*zoneSerial),
+        stop: make(chan bool)}
+}
+
+// Start watches etcd for changes to the zones in the background
+func (z *ZoneSerials) Start() {
+    if z.etcd != nil {
+        go watchEtcd(z.etcd, z.etcdPrefix, z.build, z.apply, z.stop)
+    }
+}
+
+// Stop stops watching etcd for changes
+func (z *ZoneSerials) Stop() {
+    if z.stop != nil {
+        close(z.stop)
+    }
+}
+
+// build returns the current etcd index to watch for changes from. Changes may
+// have been missed before the watch started (or while it was lost), so every
+// known serial is moved on to the current index too.
+func (z *ZoneSerials) build() (etcdIndex uint64, err error) {
+    response, err := z.etcd.Get(z.etcdPrefix, false, false)
+    if err != nil {
+        e, ok := err.(*etcd.EtcdError)
+        if !ok || e.ErrorCode != 100 {
+            return
+        }
+        etcdIndex, err = e.Index, nil
+    } else {
+        etcdIndex = response.EtcdIndex
+    }
+
+    z.lock.Lock()
+    defer z.lock.Unlock()
+
+    for _, serial := range z.serials {
+        if serial.index < etcdIndex {
+            serial.index = etcdIndex
+        }
+    }
+
+    z.watching = true
+    return
+}
+
+// apply moves the serial of the zone a change belongs to on to the index of
+// the change. Deleting a directory changes every zone beneath it too. As with
+// indexSerial, changes within a delegated child zone (one with NS records,
+// but no SOA record of its own) don't belong to the zone.
+func (z *ZoneSerials) apply(response *etcd.Response) {
+    key := response.Node.Key
+    index := response.Node.ModifiedIndex
+
+    z.lock.Lock()
+    var closest *zoneSerial
+    closestKey := ""
+    for zone, serial := range z.serials {
+        zoneKey := z.zoneKey(zone)
+        if strings.HasPrefix(zoneKey, key + "/") {
+            if serial.index < index {
+                serial.index = index
+            }
+        } else if (key == zoneKey || strings.HasPrefix(key, zoneKey + "/")) && (closest == nil || len(zoneKey) > len(closestKey)) {
+            closest, closestKey = serial, zoneKey
+        }
+    }
+    z.lock.Unlock()
+
+    if closest == nil || z.delegated(closestKey, key) {
+        return
+    }
+
+    z.lock.Lock()
+    defer z.lock.Unlock()
+
+    if closest.index < index {
+        closest.index = index
+    }
+}
+
+// delegated returns true if the key is within a delegated child of the zone
+// with the given key, checking each directory between them in etcd
+func (z *ZoneSerials) delegated(zoneKey string, key string) bool {
+    for dir := key; len(dir) > len(zoneKey); dir = dir[:strings.LastIndex(dir, "/")] {
+        // Record directories (e.g .A/) belong to the name above them
+        if isRecordKey(dir) {
+            continue
+        }
+
+        response, err := z.etcd.Get(dir, false, false)
+        if err != nil {
+            continue
+        }
+
+        for _, child := range response.Node.Nodes {
+            if strings.HasSuffix(child.Key, "/.SOA") || strings.HasSuffix(child.Key, "/.NS") {
+                return true
+            }
+        }
+    }
+
+    return false
+}
+
+// zoneKey returns the etcd key of the given zone
+func (z *ZoneSerials) zoneKey(zone string) string {
+    return strings.TrimSuffix(z.etcdPrefix, "/") + nameToKey(zone, "")
+}
+
+// cached returns the serial for the zone if it doesn't need to be read from
+// etcd, which is always the case once it's known while changes are watched.
+func (z *ZoneSerials) cached(zone string) (index uint64, ok bool) {
+    z.lock.Lock()
+    defer z.lock.Unlock()
+
+    serial, ok := z.serials[zone]
+    if !ok || (!z.watching && time.Now().After(serial.expires)) {
+        return 0, false
+    }
+
+    return serial.index, true
+}
+
+// update records the highest etcd index read for the zone, returning its
+// serial. This is never lower than a serial returned before.
+func (z *ZoneSerials) update(zone string, index uint64) uint64 {
+    z.lock.Lock()
+    defer z.lock.Unlock()
+
+    serial, ok := z.serials[zone]
+    if !ok {
+        serial = &zoneSerial{}
+        z.serials[zone] = serial
+    }
+
+    if serial.index < index {
+        serial.index = index
+    }
+    serial.expires = time.Now().Add(serialCacheDuration)
+
+    return serial.index
+}
+
+func validateSerialStrategy(strategy string) error {
+    if !serialStrategies[strategy] {
+        return fmt.Errorf("Unknown SOA serial strategy '%s'", strategy)
+    }
+    return nil
+}
+
+// ZoneSerial returns the serial number for the zone with the given SOA record,
+// according to the configured strategy.
+func (r *Resolver) ZoneSerial(zone string, soa *dns.SOA) (serial uint32, err error) {
+    switch r.soaSerial {
+    case "date":
+        return dateSerial(time.Now()), nil
+    case "stored":
+        if soa.Serial != 0 {
+            return soa.Serial, nil
+        }
+
+        // SOA records in the tab-separated format don't have a serial
+        debugMsg("No stored serial for " + zone + ", using the etcd index")
+    }
+
+    return r.indexSerial(zone)
+}
+
+// dateSerial returns a serial number in the conventional YYYYMMDDnn format,
+// using the hour of the day as the revision.
+func dateSerial(t time.Time) uint32 {
+    t = t.UTC()
+    return uint32(t.Year()) * 1000000 + uint32(t.Month()) * 10000 + uint32(t.Day()) * 100 + uint32(t.Hour())
+}
+
+// indexSerial returns the highest etcd ModifiedIndex of any node within the
+// zone, ignoring any delegated child zones, or of any change to the zone seen
+// since then. The index is truncated to 32 bits, which is safe under serial
+// number arithmetic (RFC 1982) as long as the zone changes less than 2^31
+// times between secondaries checking the serial.
+func (r *Resolver) indexSerial(zone string) (serial uint32, err error) {
+    zone = strings.ToLower(dns.Fqdn(zone))
+
+    if r.serials != nil {
+        if index, ok := r.serials.cached(zone); ok {
+            return uint32(index), nil
+        }
+    }
+
+    counter := metrics.GetOrRegisterCounter("resolver.etcd.query_count", metrics.DefaultRegistry)
+    error_counter := metrics.GetOrRegisterCounter("resolver.etcd.query_error_count", metrics.DefaultRegistry)
+
+    counter.Inc(1)
+    debugMsg("Querying etcd for the serial of " + zone)
+
+    response, err := r.etcdGet(r.etcdPrefix + nameToKey(zone, ""), false, true)
+    if err != nil {
+        error_counter.Inc(1)
+        return
+    }
+
+    var maxIndex func(node *etcd.Node, apex bool) uint64
+    maxIndex = func(node *etcd.Node, apex bool) (index uint64) {
+        if !node.Dir {
+            return node.ModifiedIndex
+        }
+
+        // Delegated child zones have their own SOA or NS records
+        if !apex {
+            for _, child := range node.Nodes {
+                if strings.HasSuffix(child.Key, "/.SOA") || strings.HasSuffix(child.Key, "/.NS") {
+                    return 0
+                }
+            }
+        }
+
+        index = node.ModifiedIndex
+        for _, child := range node.Nodes {
+            // Record directories (e.g .A/) belong to this name, any other
+            // directories are subdomains
+            var childIndex uint64
+            if isRecordKey(child.Key) {
+                childIndex = maxRecordIndex(child)
+            } else {
+                childIndex = maxIndex(child, false)
+            }
+
+            if childIndex > index {
+                index = childIndex
+            }
+        }
+
+        return
+    }
+
+    index := maxIndex(response.Node, true)
+    if r.serials != nil {
+        index = r.serials.update(zone, index)
+    }
+
+    return uint32(index), nil
+}
+
+// isRecordKey returns true if the last segment of the key identifies a record
+// type (e.g /net/disco/.A) rather than a subdomain.
+func isRecordKey(key string) bool {
+    return strings.HasPrefix(key[strings.LastIndex(key, "/") + 1:], ".")
+}
+
+// maxRecordIndex returns the highest ModifiedIndex of the given record node
+func maxRecordIndex(node *etcd.Node) (index uint64) {
+    index = node.ModifiedIndex
+    for _, child := range node.Nodes {
+        if childIndex := maxRecordIndex(child); childIndex > index {
+            index = childIndex
+        }
+    }
+    return
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+    "github.com/miekg/dns"
+    "testing"
+    "time"
+)
+
+func TestZoneSerialIndex(t *testing.T) {
+    r := &Resolver{etcd: client, etcdPrefix: "TestZoneSerialIndex/"}
+
+    client.Set("TestZoneSerialIndex/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    client.Set("TestZoneSerialIndex/net/disco/foo/.A/0", "1.2.3.4", 0)
+    response, _ := client.Set("TestZoneSerialIndex/net/disco/bar/.TXT.ttl", "60", 0)
+    expected := uint32(response.Node.ModifiedIndex)
+
+    // Changes within delegated zones don't belong to this zone
+    client.Set("TestZoneSerialIndex/net/disco/child/.NS", "ns1.child.disco.net.", 0)
+    client.Set("TestZoneSerialIndex/net/disco/child/foo/.A", "1.2.3.5", 0)
+
+    query := new(dns.Msg)
+    query.SetQuestion("missing.disco.net.", dns.TypeA)
+
+    answer := r.Lookup(query)
+
+    if len(answer.Ns) != 1 {
+        t.Error("Expected one authority record")
+        t.Fatal()
+    }
+
+    soa := answer.Ns[0].(*dns.SOA)
+    if soa.Serial != expected {
+        t.Error("Expected serial to be ", expected, ": ", soa.Serial)
+        t.Fatal()
+    }
+
+    // Direct SOA queries should carry the same serial
+    query.SetQuestion("disco.net.", dns.TypeSOA)
+    answer = r.Lookup(query)
+
+    if len(answer.Answer) != 1 || answer.Answer[0].(*dns.SOA).Serial != expected {
+        t.Error("Expected SOA answer with serial ", expected, ": ", answer.Answer)
+        t.Fatal()
+    }
+}
+
+func TestZoneSerialNeverDecreases(t *testing.T) {
+    r := &Resolver{etcd: client, etcdPrefix: "TestZoneSerialNeverDecreases/", serials: NewZoneSerials(client, "TestZoneSerialNeverDecreases/")}
+
+    client.Set("TestZoneSerialNeverDecreases/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    response, _ := client.Set("TestZoneSerialNeverDecreases/net/disco/foo/.A", "1.2.3.4", 0)
+
+    first, err := r.indexSerial("disco.net.")
+    if err != nil || first != uint32(response.Node.ModifiedIndex) {
+        t.Error("Expected serial to be ", response.Node.ModifiedIndex, ": ", first, err)
+        t.Fatal()
+    }
+
+    // Deleting the newest record doesn't take the serial backwards, even once
+    // the zone is read again
+    client.Delete("TestZoneSerialNeverDecreases/net/disco/foo/.A", false)
+    r.serials.serials["disco.net."].expires = time.Time{}
+
+    if serial, _ := r.indexSerial("disco.net."); serial < first {
+        t.Error("Expected the serial not to go backwards from ", first, ": ", serial)
+    }
+}
+
+func TestZoneSerialWatch(t *testing.T) {
+    serials := NewZoneSerials(client, "TestZoneSerialWatch/")
+    r := &Resolver{etcd: client, etcdPrefix: "TestZoneSerialWatch/", serials: serials}
+
+    client.Delete("TestZoneSerialWatch/", true)
+    client.Set("TestZoneSerialWatch/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    client.Set("TestZoneSerialWatch/net/disco/foo/.A", "1.2.3.4", 0)
+    client.Set("TestZoneSerialWatch/net/disco/child/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+
+    serials.Start()
+    defer serials.Stop()
+
+    waitForSerial := func(zone string, expected uint32) (serial uint32) {
+        for attempt := 0; attempt < 50; attempt++ {
+            serial, _ = r.indexSerial(zone)
+            if serial == expected {
+                break
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+        return
+    }
+
+    // Starting to watch moves the known serials on, so wait for that first
+    for attempt := 0; attempt < 50; attempt++ {
+        serials.lock.Lock()
+        watching := serials.watching
+        serials.lock.Unlock()
+
+        if watching {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+
+    before, _ := r.indexSerial("disco.net.")
+    childBefore, _ := r.indexSerial("child.disco.net.")
+
+    // Deletes move the serial on, without reading the zone again
+    response, _ := client.Delete("TestZoneSerialWatch/net/disco/foo/.A", false)
+    if serial := waitForSerial("disco.net.", uint32(response.Node.ModifiedIndex)); serial != uint32(response.Node.ModifiedIndex) || serial <= before {
+        t.Error("Expected the delete to change the serial to ", response.Node.ModifiedIndex, ": ", serial)
+    }
+
+    // Changes only belong to the closest zone
+    if serial, _ := r.indexSerial("child.disco.net."); serial != childBefore {
+        t.Error("Expected the serial of the child zone to stay at ", childBefore, ": ", serial)
+    }
+
+    // Changes within delegated children don't belong to the zone, which we
+    // know once the later change to the child zone has been seen
+    current, _ := r.indexSerial("disco.net.")
+    client.Set("TestZoneSerialWatch/net/disco/delegated/.NS", "ns1.delegated.disco.net.", 0)
+    client.Set("TestZoneSerialWatch/net/disco/delegated/foo/.A", "1.2.3.6", 0)
+
+    response, _ = client.Set("TestZoneSerialWatch/net/disco/child/bar/.A", "1.2.3.5", 0)
+    if serial := waitForSerial("child.disco.net.", uint32(response.Node.ModifiedIndex)); serial != uint32(response.Node.ModifiedIndex) {
+        t.Error("Expected the change to the child zone to change its serial: ", serial)
+    }
+
+    if serial, _ := r.indexSerial("disco.net."); serial != current {
+        t.Error("Expected changes within the delegated child to leave the serial at ", current, ": ", serial)
+    }
+
+    // Deleting a whole zone changes its serial too
+    response, _ = client.Delete("TestZoneSerialWatch/net/disco", true)
+    if serial := waitForSerial("child.disco.net.", uint32(response.Node.ModifiedIndex)); serial != uint32(response.Node.ModifiedIndex) {
+        t.Error("Expected deleting the parent directory to change the serial: ", serial)
+    }
+}
+
+func TestZoneSerialStored(t *testing.T) {
+    r := &Resolver{etcd: client, etcdPrefix: "TestZoneSerialStored/", soaSerial: "stored"}
+
+    client.Set("TestZoneSerialStored/net/disco/.SOA",
+        "{\"ns\": \"ns1.disco.net.\", \"mbox\": \"admin.disco.net.\", \"serial\": 2015010101, \"refresh\": 3600, \"retry\": 600, \"expire\": 86400, \"minttl\": 10}",
+        0)
+
+    soa := r.Authority("foo.disco.net.")
+    if soa == nil || soa.Serial != 2015010101 {
+        t.Error("Expected stored serial 2015010101: ", soa)
+        t.Fatal()
+    }
+}
+
+func TestDateSerial(t *testing.T) {
+    serial := dateSerial(time.Date(2014, time.November, 3, 17, 30, 0, 0, time.UTC))
+    if serial != 2014110317 {
+        t.Error("Expected serial to be 2014110317: ", serial)
+    }
+}
+
+func TestValidateSerialStrategy(t *testing.T) {
+    for _, strategy := range []string{"index", "date", "stored"} {
+        if err := validateSerialStrategy(strategy); err != nil {
+            t.Error("Unexpected error for " + strategy + ": ", err)
+        }
+    }
+
+    if err := validateSerialStrategy("random"); err == nil {
+        t.Error("Expected error for unknown strategy")
+    }
+}
@@ -4,7 +4,10 @@ import (
     "github.com/coreos/go-etcd/etcd"
     "github.com/miekg/dns"
     "github.com/rcrowley/go-metrics"
+    "net"
+    "runtime/debug"
     "strconv"
+    "sync"
     "time"
 )
 
@@ -15,51 +18,136 @@ type Server struct {
     rTimeout        time.Duration
     wTimeout        time.Duration
     defaultTtl      uint32
+    aliasUpstream   string
+    reverseIndex    *ReverseIndex
+    soaSerial       string
+    serials         *ZoneSerials
+    zones           *ZoneList
     queryFilterer   *QueryFilterer
+    policies        *ResponsePolicies
+    verboseNetworks []*net.IPNet
+    identity        *ServerIdentity
+    anyPolicy       string
+    anyFullNetworks []*net.IPNet
+    queryTimeout    time.Duration
+    maxInflight     int
+    rateLimiter     *ResponseRateLimiter
+    clientLimiter   *ClientRateLimiter
+
+    // The resolver and handlers in use, once running
+    lock            sync.Mutex
+    resolver        *Resolver
+    handlers        []*Handler
 }
 
 type Handler struct {
+    lock            sync.RWMutex
     resolver        *Resolver
     queryFilterer   *QueryFilterer
+    policies        *ResponsePolicies
+    verboseNetworks []*net.IPNet
+    identity        *ServerIdentity
+    anyPolicy       string
+    anyFullNetworks []*net.IPNet
+    queryTimeout    time.Duration
+    rateLimiter     *ResponseRateLimiter
+    clientLimiter   *ClientRateLimiter
 
     // Metrics
     requestCounter      metrics.Counter
     acceptCounter       metrics.Counter
     rejectCounter       metrics.Counter
+    invalidCounter      metrics.Counter
+    panicCounter        metrics.Counter
     responseTimer       metrics.Timer
 }
 
+// validateRequest returns an error response for any message that isn't a
+// well formed query we can answer, or nil if the message is valid.
+func validateRequest(req *dns.Msg) (msg *dns.Msg) {
+    msg = new(dns.Msg)
+    if req.Opcode != dns.OpcodeQuery {
+        msg.SetRcode(req, dns.RcodeNotImplemented)
+        msg.Opcode = req.Opcode
+    } else if len(req.Question) != 1 {
+        msg.SetRcode(req, dns.RcodeFormatError)
+    } else if req.Question[0].Qclass != dns.ClassINET && req.Question[0].Qclass != dns.ClassCHAOS {
+        msg.SetRcode(req, dns.RcodeRefused)
+    } else {
+        return nil
+    }
+
+    return
+}
+
 func (h *Handler) Handle(response dns.ResponseWriter, req *dns.Msg) {
     h.requestCounter.Inc(1)
     h.responseTimer.Time(func() {
+        // Make sure a bug handling one query can't take down the server
+        defer func() {
+            if r := recover(); r != nil {
+                h.panicCounter.Inc(1)
+                logger.Printf("[ERROR] Recovered from panic handling query: %v\n%s", r, debug.Stack())
+
+                msg := new(dns.Msg)
+                msg.SetRcode(req, dns.RcodeServerFailure)
+                response.WriteMsg(msg)
+            }
+        }()
+
+        if msg := validateRequest(req); msg != nil {
+            debugMsg("Invalid request, responding with ", dns.RcodeToString[msg.Rcode])
+            h.invalidCounter.Inc(1)
+            response.WriteMsg(msg)
+            return
+        }
+
+        if !h.clientLimiter.Allow(response.RemoteAddr()) {
+            debugMsg("Query from ", response.RemoteAddr(), " rate limited")
+            if msg := h.clientLimiter.Limit(req); msg != nil {
+                h.writeMsg(response, req, msg, nil)
+            }
+            return
+        }
+
         debugMsg("Handling incoming query for domain " + req.Question[0].Name)
 
         // Lookup the dns record for the request
         // This method will add any answers to the message
         var msg *dns.Msg
-        if h.queryFilterer.ShouldAcceptQuery(req) != true {
+        var extendedError *ExtendedError
+        if req.Question[0].Qclass == dns.ClassCHAOS {
+            msg = h.identity.AnswerChaos(req)
+        } else if accepted, filter := h.queryFilterer.Filter(req, response.RemoteAddr()); !accepted {
             debugMsg("Query not accepted")
 
             h.rejectCounter.Inc(1)
 
-            msg =  new(dns.Msg)
-            msg.SetReply(req)
-            msg.SetRcode(req, dns.RcodeNameError)
-            msg.Authoritative = true
-            msg.RecursionAvailable = false
-
-            // Add a useful TXT record
-            header := dns.RR_Header{Name: req.Question[0].Name,
-                                    Class: dns.ClassINET,
-                                    Rrtype: dns.TypeTXT}
-            msg.Ns = []dns.RR{&dns.TXT{header, []string{"Rejected query based on matched filters"}}}
+            resolver, done := h.requestResolver()
+            defer done()
+
+            msg, extendedError = rejectQuery(resolver, req, filter)
         } else {
             h.acceptCounter.Inc(1)
-            msg = h.resolver.Lookup(req)
+
+            resolver, done := h.requestResolver()
+            defer done()
+
+            msg, extendedError = h.policies.Lookup(resolver, req, response.RemoteAddr(), h.anyPolicyFor(response.RemoteAddr()))
         }
 
+        // Limit the rate of identical responses, to avoid being used to reflect
+        // traffic at someone else
         if msg != nil {
-            err := response.WriteMsg(msg)
+            var limited bool
+            if msg, limited = h.rateLimiter.Limit(response.RemoteAddr(), msg); limited {
+                debugMsg("Response rate limited")
+                extendedError = nil
+            }
+        }
+
+        if msg != nil {
+            err := h.writeMsg(response, req, msg, extendedError)
             if err != nil {
                 debugMsg("Error writing message: ", err)
             }
@@ -69,6 +157,77 @@ func (h *Handler) Handle(response dns.ResponseWriter, req *dns.Msg) {
     })
 }
 
+// requestResolver returns the resolver for answering a single request, which
+// gives up once the query timeout has passed. The returned function must be
+// called when the request is finished.
+func (h *Handler) requestResolver() (resolver *Resolver, done func()) {
+    h.lock.RLock()
+    resolver = h.resolver
+    h.lock.RUnlock()
+
+    if h.queryTimeout > 0 && resolver != nil {
+        return resolver.WithDeadline(time.Now().Add(h.queryTimeout))
+    }
+
+    return resolver, func() {}
+}
+
+// setResolver replaces the resolver used for new requests, leaving those in
+// progress with the resolver they started with
+func (h *Handler) setResolver(resolver *Resolver) {
+    h.lock.Lock()
+    h.resolver = resolver
+    h.lock.Unlock()
+}
+
+// anyPolicyFor returns the policy for answering ANY queries from the client.
+// Clients within the allowed networks get every record, but only over TCP
+// where the response can't be used for amplification.
+func (h *Handler) anyPolicyFor(addr net.Addr) string {
+    if _, ok := addr.(*net.TCPAddr); ok && addrInNetworks(addr, h.anyFullNetworks) {
+        return anyPolicyFull
+    }
+
+    return h.anyPolicy
+}
+
+// writeMsg sends the response, including the extended error (if there is
+// one) and our NSID for clients that support EDNS.
+func (h *Handler) writeMsg(response dns.ResponseWriter, req *dns.Msg, msg *dns.Msg, extendedError *ExtendedError) error {
+    h.identity.SetNSID(req, msg)
+
+    if extendedError == nil || req.IsEdns0() == nil {
+        return response.WriteMsg(msg)
+    }
+
+    verbose := addrInNetworks(response.RemoteAddr(), h.verboseNetworks)
+    buf, err := packExtendedError(msg, req, extendedError, verbose)
+    if err != nil {
+        // The client still gets an answer, just without the extended error
+        logger.Printf("[ERROR] Unable to add the extended error to the response: %s", err)
+        return response.WriteMsg(msg)
+    }
+
+    _, err = response.Write(buf)
+    return err
+}
+
+// responseOpt returns the OPT record of the response, adding one if needed
+func responseOpt(req *dns.Msg, msg *dns.Msg) *dns.OPT {
+    if opt := msg.IsEdns0(); opt != nil {
+        return opt
+    }
+
+    opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+    opt.SetUDPSize(dns.DefaultMsgSize)
+    if reqOpt := req.IsEdns0(); reqOpt != nil && reqOpt.Do() {
+        opt.SetDo()
+    }
+
+    msg.Extra = append(msg.Extra, opt)
+    return opt
+}
+
 func (s *Server) Addr() string {
     return s.addr + ":" + strconv.Itoa(s.port)
 }
@@ -83,6 +242,10 @@ func (s *Server) Run() {
     metrics.Register("request.handler.tcp.filter_accepts", tcpAcceptCounter)
     tcpRejectCounter := metrics.NewCounter()
     metrics.Register("request.handler.tcp.filter_rejects", tcpRejectCounter)
+    tcpInvalidCounter := metrics.NewCounter()
+    metrics.Register("request.handler.tcp.invalid_requests", tcpInvalidCounter)
+    tcpPanicCounter := metrics.NewCounter()
+    metrics.Register("request.handler.tcp.panics", tcpPanicCounter)
 
     udpResponseTimer := metrics.NewTimer()
     metrics.Register("request.handler.udp.response_time", udpResponseTimer)
@@ -92,28 +255,65 @@ func (s *Server) Run() {
     metrics.Register("request.handler.udp.filter_accepts", udpAcceptCounter)
     udpRejectCounter := metrics.NewCounter()
     metrics.Register("request.handler.udp.filter_rejects", udpRejectCounter)
+    udpInvalidCounter := metrics.NewCounter()
+    metrics.Register("request.handler.udp.invalid_requests", udpInvalidCounter)
+    udpPanicCounter := metrics.NewCounter()
+    metrics.Register("request.handler.udp.panics", udpPanicCounter)
+
+    resolver := Resolver{
+        etcd: s.etcd,
+        defaultTtl: s.defaultTtl,
+        aliasUpstream: s.aliasUpstream,
+        reverseIndex: s.reverseIndex,
+        soaSerial: s.soaSerial,
+        serials: s.serials,
+        zones: s.zones,
+        coalescer: NewCoalescer(s.queryTimeout)}
+    if s.maxInflight > 0 {
+        resolver.inflight = make(chan bool, s.maxInflight)
+    }
 
-    resolver := Resolver{etcd: s.etcd, defaultTtl: s.defaultTtl}
     tcpDNShandler := &Handler{
         resolver: &resolver,
         requestCounter: tcpRequestCounter,
         acceptCounter: tcpAcceptCounter,
         rejectCounter: tcpRejectCounter,
+        invalidCounter: tcpInvalidCounter,
+        panicCounter: tcpPanicCounter,
         responseTimer: tcpResponseTimer,
-        queryFilterer: s.queryFilterer}
+        queryFilterer: s.queryFilterer,
+        policies: s.policies,
+        verboseNetworks: s.verboseNetworks,
+        identity: s.identity,
+        anyPolicy: s.anyPolicy,
+        anyFullNetworks: s.anyFullNetworks,
+        queryTimeout: s.queryTimeout,
+        clientLimiter: s.clientLimiter}
+
+    // Only UDP responses are rate limited, as the source of TCP queries can't
+    // be spoofed
     udpDNShandler := &Handler{
         resolver: &resolver,
         requestCounter: udpRequestCounter,
         acceptCounter: udpAcceptCounter,
         rejectCounter: udpRejectCounter,
+        invalidCounter: udpInvalidCounter,
+        panicCounter: udpPanicCounter,
         responseTimer: udpResponseTimer,
-        queryFilterer: s.queryFilterer}
-
-    udpHandler := dns.NewServeMux()
-    tcpHandler := dns.NewServeMux()
+        queryFilterer: s.queryFilterer,
+        policies: s.policies,
+        verboseNetworks: s.verboseNetworks,
+        identity: s.identity,
+        anyPolicy: s.anyPolicy,
+        anyFullNetworks: s.anyFullNetworks,
+        queryTimeout: s.queryTimeout,
+        rateLimiter: s.rateLimiter,
+        clientLimiter: s.clientLimiter}
 
-    tcpHandler.HandleFunc(".", tcpDNShandler.Handle)
-    udpHandler.HandleFunc(".", udpDNShandler.Handle)
+    // Use the handlers directly rather than through a dns.ServeMux, so we get
+    // to validate every request (including those without any questions)
+    tcpHandler := dns.HandlerFunc(tcpDNShandler.Handle)
+    udpHandler := dns.HandlerFunc(udpDNShandler.Handle)
 
     tcpServer := &dns.Server{Addr: s.Addr(),
         Net:          "tcp",
@@ -128,10 +328,36 @@ func (s *Server) Run() {
         ReadTimeout:  s.rTimeout,
         WriteTimeout: s.wTimeout}
 
+    s.lock.Lock()
+    s.resolver = &resolver
+    s.handlers = []*Handler{tcpDNShandler, udpDNShandler}
+    s.lock.Unlock()
+
     go s.start(udpServer)
     go s.start(tcpServer)
 }
 
+// SetDefaultTtl changes the TTL of records without an explicit TTL, for the
+// queries received from now on. The resolver is replaced rather than changed,
+// since it's shared with the requests in progress.
+func (s *Server) SetDefaultTtl(ttl uint32) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    s.defaultTtl = ttl
+    if s.resolver == nil {
+        return
+    }
+
+    resolver := *s.resolver
+    resolver.defaultTtl = ttl
+    s.resolver = &resolver
+
+    for _, handler := range s.handlers {
+        handler.setResolver(s.resolver)
+    }
+}
+
 func (s *Server) start(ds *dns.Server) {
     err := ds.ListenAndServe()
     if err != nil {
@@ -0,0 +1,576 @@
+package main
+
+import (
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "math/rand"
+    "net"
+    "strings"
+    "testing"
+    "time"
+)
+
+// testResponseWriter is a dns.ResponseWriter that records the messages written
+type testResponseWriter struct {
+    remoteAddr  net.Addr
+    messages    []*dns.Msg
+    written     [][]byte
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr { return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53} }
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+    if w.remoteAddr == nil {
+        return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+    }
+    return w.remoteAddr
+}
+func (w *testResponseWriter) WriteMsg(msg *dns.Msg) error { w.messages = append(w.messages, msg); return nil }
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+    msg := new(dns.Msg)
+    if err := msg.Unpack(b); err != nil {
+        return 0, err
+    }
+    w.messages = append(w.messages, msg)
+    w.written = append(w.written, b)
+    return len(b), nil
+}
+func (w *testResponseWriter) Close() error { return nil }
+func (w *testResponseWriter) TsigStatus() error { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack() {}
+
+func newTestHandler(r *Resolver) *Handler {
+    return &Handler{
+        resolver: r,
+        queryFilterer: &QueryFilterer{},
+        requestCounter: metrics.NewCounter(),
+        acceptCounter: metrics.NewCounter(),
+        rejectCounter: metrics.NewCounter(),
+        invalidCounter: metrics.NewCounter(),
+        panicCounter: metrics.NewCounter(),
+        responseTimer: metrics.NewTimer()}
+}
+
+func TestHandlerInvalidRequests(t *testing.T) {
+    handler := newTestHandler(resolver)
+
+    noQuestion := new(dns.Msg)
+
+    multipleQuestions := new(dns.Msg)
+    multipleQuestions.SetQuestion("disco.net.", dns.TypeA)
+    multipleQuestions.Question = append(multipleQuestions.Question, multipleQuestions.Question[0])
+
+    update := new(dns.Msg)
+    update.SetQuestion("disco.net.", dns.TypeSOA)
+    update.Opcode = dns.OpcodeUpdate
+
+    notify := new(dns.Msg)
+    notify.SetNotify("disco.net.")
+
+    hesiod := new(dns.Msg)
+    hesiod.SetQuestion("disco.net.", dns.TypeA)
+    hesiod.Question[0].Qclass = dns.ClassHESIOD
+
+    var expected = []struct {
+        req     *dns.Msg
+        rcode   int
+    } {
+        {noQuestion, dns.RcodeFormatError},
+        {multipleQuestions, dns.RcodeFormatError},
+        {update, dns.RcodeNotImplemented},
+        {notify, dns.RcodeNotImplemented},
+        {hesiod, dns.RcodeRefused}}
+
+    for _, test := range expected {
+        writer := &testResponseWriter{}
+        handler.Handle(writer, test.req)
+
+        if len(writer.messages) != 1 {
+            t.Error("Expected one response, got ", len(writer.messages))
+            t.Fatal()
+        }
+
+        msg := writer.messages[0]
+        if msg.Rcode != test.rcode {
+            t.Error("Expected response code " + dns.RcodeToString[test.rcode] + ", got ", dns.RcodeToString[msg.Rcode])
+        }
+        if msg.Opcode != test.req.Opcode {
+            t.Error("Expected opcode to be copied from the request: ", msg.Opcode)
+        }
+        if msg.Id != test.req.Id {
+            t.Error("Expected id to be copied from the request: ", msg.Id)
+        }
+    }
+
+    if handler.invalidCounter.Count() != int64(len(expected)) {
+        t.Error("Expected invalid request counter to be ", len(expected), ": ", handler.invalidCounter.Count())
+    }
+}
+
+func TestHandlerRecoversFromPanic(t *testing.T) {
+    // A handler without a resolver will panic answering any valid query
+    handler := newTestHandler(nil)
+
+    query := new(dns.Msg)
+    query.SetQuestion("disco.net.", dns.TypeA)
+
+    writer := &testResponseWriter{}
+    handler.Handle(writer, query)
+
+    if len(writer.messages) != 1 || writer.messages[0].Rcode != dns.RcodeServerFailure {
+        t.Error("Expected a single SERVFAIL response: ", writer.messages)
+        t.Fatal()
+    }
+
+    if handler.panicCounter.Count() != 1 {
+        t.Error("Expected panic counter to be 1: ", handler.panicCounter.Count())
+    }
+}
+
+// TestHandlerRandomPackets throws random (but parseable) packets at the handler
+// to make sure every one of them gets a response, without panicking.
+func TestHandlerRandomPackets(t *testing.T) {
+    // The packets are handled without a working etcd, so the queries that
+    // make it to the resolver time out
+    client, stop := newHangingEtcd()
+    defer stop()
+
+    handler := newTestHandler(&Resolver{etcd: client, defaultTtl: 300, coalescer: NewCoalescer(100 * time.Millisecond)})
+    handler.queryTimeout = time.Millisecond
+
+    sendRandomPackets(t, handler)
+}
+
+func TestHandlerRandomPacketsWithRecords(t *testing.T) {
+    resolver.etcdPrefix = "TestHandlerRandomPacketsWithRecords/"
+    client.Set("TestHandlerRandomPacketsWithRecords/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    client.Set("TestHandlerRandomPacketsWithRecords/net/disco/*/.A", "1.2.3.4", 0)
+    defer client.Delete("TestHandlerRandomPacketsWithRecords/", true)
+
+    sendRandomPackets(t, newTestHandler(resolver))
+}
+
+// sendRandomPackets sends the handler random (and often malformed) packets,
+// checking each gets a single response without a panic
+func sendRandomPackets(t *testing.T, handler *Handler) {
+    random := rand.New(rand.NewSource(1))
+
+    names := []string{".", "disco.net.", "foo.disco.net.", "*.disco.net.", "a..b.", "\\000.disco.net.", "4.3.2.1.in-addr.arpa."}
+
+    for i := 0; i < 1000; i++ {
+        var buf []byte
+        if i % 2 == 0 {
+            // Completely random bytes, using a valid header half of the time
+            buf = make([]byte, random.Intn(128))
+            random.Read(buf)
+        } else {
+            msg := new(dns.Msg)
+            msg.Id = uint16(random.Intn(65536))
+            msg.Opcode = random.Intn(16)
+            for q := random.Intn(3); q > 0; q-- {
+                msg.Question = append(msg.Question, dns.Question{
+                    Name: names[random.Intn(len(names))],
+                    Qtype: uint16(random.Intn(260)),
+                    Qclass: uint16(random.Intn(5))})
+            }
+
+            var err error
+            buf, err = msg.Pack()
+            if err != nil {
+                continue
+            }
+
+            // Flip some bits for good measure
+            for flips := random.Intn(3); flips > 0 && len(buf) > 0; flips-- {
+                buf[random.Intn(len(buf))] ^= byte(1 << uint(random.Intn(8)))
+            }
+        }
+
+        req := new(dns.Msg)
+        if !unpacks(req, buf) {
+            continue
+        }
+
+        writer := &testResponseWriter{}
+        handler.Handle(writer, req)
+
+        if len(writer.messages) != 1 {
+            t.Error("Expected one response for ", req, ", got ", len(writer.messages))
+            t.Fatal()
+        }
+    }
+
+    if handler.panicCounter.Count() != 0 {
+        t.Error("Expected no panics, got ", handler.panicCounter.Count())
+    }
+}
+
+// unpacks returns true if the packet could be unpacked into msg. The server
+// itself responds with a FORMERR to those that can't.
+func unpacks(msg *dns.Msg, buf []byte) (ok bool) {
+    defer func() {
+        if recover() != nil {
+            ok = false
+        }
+    }()
+
+    return msg.Unpack(buf) == nil
+}
+
+// unpackExtendedError finds the Extended DNS Error option in a packed message,
+// which the vendored dns library drops when unpacking.
+func unpackExtendedError(buf []byte) (extendedError *ExtendedError, err error) {
+    msg := new(dns.Msg)
+    if err = msg.Unpack(buf); err != nil {
+        return
+    }
+
+    off := 12
+    for _ = range msg.Question {
+        if _, off, err = dns.UnpackDomainName(buf, off); err != nil {
+            return
+        }
+        off += 4
+    }
+
+    for n := 0; n < len(msg.Answer) + len(msg.Ns) + len(msg.Extra); n++ {
+        var rr dns.RR
+        start := off
+        if rr, off, err = dns.UnpackRR(buf, off); err != nil {
+            return
+        }
+        if rr.Header().Rrtype != dns.TypeOPT {
+            continue
+        }
+
+        // Skip the root name, type, class, ttl and rdlength
+        rdata := buf[start + 11:off]
+        for len(rdata) >= 4 {
+            code := uint16(rdata[0]) << 8 | uint16(rdata[1])
+            length := int(rdata[2]) << 8 | int(rdata[3])
+            option := rdata[4:4 + length]
+            if code == edeOptionCode {
+                return &ExtendedError{
+                    Code: uint16(option[0]) << 8 | uint16(option[1]),
+                    Text: string(option[2:])}, nil
+            }
+            rdata = rdata[4 + length:]
+        }
+    }
+
+    return
+}
+
+func TestExtendedErrorInvalidData(t *testing.T) {
+    resolver.etcdPrefix = "TestExtendedErrorInvalidData/"
+    client.Set("TestExtendedErrorInvalidData/net/disco/bad/.A", "not-an-address", 0)
+
+    _, network, _ := net.ParseCIDR("10.0.0.0/8")
+    handler := newTestHandler(resolver)
+    handler.verboseNetworks = []*net.IPNet{network}
+
+    query := new(dns.Msg)
+    query.SetQuestion("bad.disco.net.", dns.TypeA)
+    query.SetEdns0(4096, false)
+
+    // Clients outside of the verbose networks only see the key
+    writer := &testResponseWriter{}
+    handler.Handle(writer, query)
+
+    if len(writer.written) != 1 || writer.messages[0].Rcode != dns.RcodeServerFailure {
+        t.Error("Expected a single SERVFAIL response")
+        t.Fatal()
+    }
+
+    extendedError, err := unpackExtendedError(writer.written[0])
+    if err != nil || extendedError == nil {
+        t.Error("Expected an extended error: ", err)
+        t.Fatal()
+    }
+    if extendedError.Code != edeInvalidData {
+        t.Error("Expected Invalid Data, got ", extendedError.Code)
+    }
+    if extendedError.Text != "/TestExtendedErrorInvalidData/net/disco/bad/.A" {
+        t.Error("Expected the key as the extra text, got ", extendedError.Text)
+    }
+
+    // Internal clients also see the error itself
+    writer = &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 12345}}
+    handler.Handle(writer, query)
+
+    extendedError, err = unpackExtendedError(writer.written[0])
+    if err != nil || extendedError == nil {
+        t.Error("Expected an extended error: ", err)
+        t.Fatal()
+    }
+    if !strings.HasPrefix(extendedError.Text, "/TestExtendedErrorInvalidData/net/disco/bad/.A: ") {
+        t.Error("Expected the key and error as the extra text, got ", extendedError.Text)
+    }
+}
+
+func TestExtendedErrorWithoutEdns(t *testing.T) {
+    resolver.etcdPrefix = "TestExtendedErrorWithoutEdns/"
+    client.Set("TestExtendedErrorWithoutEdns/net/disco/bad/.A", "not-an-address", 0)
+
+    handler := newTestHandler(resolver)
+
+    query := new(dns.Msg)
+    query.SetQuestion("bad.disco.net.", dns.TypeA)
+
+    writer := &testResponseWriter{}
+    handler.Handle(writer, query)
+
+    if len(writer.messages) != 1 || writer.messages[0].Rcode != dns.RcodeServerFailure {
+        t.Error("Expected a single SERVFAIL response")
+        t.Fatal()
+    }
+    if writer.messages[0].IsEdns0() != nil {
+        t.Error("Didn't expect an OPT record for a client without EDNS")
+    }
+}
+
+func TestExtendedErrorPackFailure(t *testing.T) {
+    handler := newTestHandler(resolver)
+
+    query := new(dns.Msg)
+    query.SetQuestion("foo.disco.net.", dns.TypeA)
+    query.SetEdns0(4096, false)
+
+    msg := new(dns.Msg)
+    msg.SetRcode(query, dns.RcodeServerFailure)
+
+    // The response is sent without the extended error if it can't be added
+    writer := &testResponseWriter{}
+    extendedError := &ExtendedError{Code: edeOther, Text: strings.Repeat("a", dns.MaxMsgSize)}
+    if err := handler.writeMsg(writer, query, msg, extendedError); err != nil {
+        t.Error("Unexpected error writing the response: ", err)
+    }
+
+    if len(writer.messages) != 1 || writer.messages[0].Rcode != dns.RcodeServerFailure {
+        t.Error("Expected a single SERVFAIL response: ", writer.messages)
+    }
+}
+
+func TestExtendedErrorFilterRejection(t *testing.T) {
+    handler := newTestHandler(resolver)
+    handler.queryFilterer = NewQueryFilterer(nil, []QueryFilter{QueryFilter{domain: "disco.net.", qTypes: []string{}}})
+
+    query := new(dns.Msg)
+    query.SetQuestion("foo.disco.net.", dns.TypeA)
+    query.SetEdns0(4096, true)
+
+    writer := &testResponseWriter{}
+    handler.Handle(writer, query)
+
+    if len(writer.written) != 1 || writer.messages[0].Rcode != dns.RcodeNameError {
+        t.Error("Expected a single NXDOMAIN response")
+        t.Fatal()
+    }
+    if len(writer.messages[0].Ns) > 0 {
+        t.Error("Didn't expect any authority records")
+    }
+
+    opt := writer.messages[0].IsEdns0()
+    if opt == nil || !opt.Do() {
+        t.Error("Expected an OPT record with the DO bit set")
+    }
+
+    extendedError, err := unpackExtendedError(writer.written[0])
+    if err != nil || extendedError == nil {
+        t.Error("Expected an extended error: ", err)
+        t.Fatal()
+    }
+    if extendedError.Code != edeBlocked {
+        t.Error("Expected Blocked, got ", extendedError.Code)
+    }
+}
+
+func TestExtendedErrorFilterProhibited(t *testing.T) {
+    handler := newTestHandler(resolver)
+    handler.queryFilterer = NewQueryFilterer(nil, []QueryFilter{
+        QueryFilter{domain: "disco.net.", excludedClients: []*net.IPNet{&net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}}})
+
+    query := new(dns.Msg)
+    query.SetQuestion("foo.disco.net.", dns.TypeA)
+    query.SetEdns0(4096, true)
+
+    writer := &testResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 12345}}
+    handler.Handle(writer, query)
+
+    if len(writer.written) != 1 {
+        t.Error("Expected a single packed response")
+        t.Fatal()
+    }
+
+    extendedError, err := unpackExtendedError(writer.written[0])
+    if err != nil || extendedError == nil || extendedError.Code != edeProhibited {
+        t.Error("Expected a Prohibited extended error: ", extendedError, err)
+    }
+}
+
+func TestFilterActions(t *testing.T) {
+    resolver.etcdPrefix = "TestFilterActions/"
+    client.Set("TestFilterActions/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    defer client.Delete("TestFilterActions/", true)
+
+    var expected = []struct {
+        filter      string
+        qType       uint16
+        dropped     bool
+        rcode       int
+        answer      string
+        authority   bool
+        code        uint16
+    } {
+        {"disco.net:", dns.TypeA, false, dns.RcodeNameError, "", true, edeBlocked},
+        {"disco.net: action=nxdomain", dns.TypeA, false, dns.RcodeNameError, "", true, edeBlocked},
+        {"disco.net: action=refused", dns.TypeA, false, dns.RcodeRefused, "", false, edeBlocked},
+        {"disco.net: action=refused from=!10.0.0.0/8", dns.TypeA, false, dns.RcodeRefused, "", false, edeProhibited},
+        {"disco.net: action=drop", dns.TypeA, true, 0, "", false, 0},
+        {"disco.net: action=sinkhole:10.0.0.1", dns.TypeA, false, dns.RcodeSuccess, "10.0.0.1", false, edeForgedAnswer},
+        {"disco.net: action=sinkhole:10.0.0.1", dns.TypeAAAA, false, dns.RcodeSuccess, "", false, edeForgedAnswer},
+        {"disco.net: action=sinkhole:fd00::1", dns.TypeAAAA, false, dns.RcodeSuccess, "fd00::1", false, edeForgedAnswer},
+        {"disco.net: action=sinkhole:blocked.disco.com", dns.TypeMX, false, dns.RcodeSuccess, "blocked.disco.com.", false, edeForgedAnswer},
+    }
+
+    for _, e := range expected {
+        filters, err := parseFilters([]string{e.filter})
+        if err != nil {
+            t.Error("Unexpected error parsing filter: ", err)
+            t.Fatal()
+        }
+
+        handler := newTestHandler(resolver)
+        handler.queryFilterer = NewQueryFilterer(nil, filters)
+
+        query := new(dns.Msg)
+        query.SetQuestion("foo.disco.net.", e.qType)
+        query.SetEdns0(4096, false)
+
+        writer := &testResponseWriter{}
+        handler.Handle(writer, query)
+
+        if e.dropped {
+            if len(writer.messages) != 0 {
+                t.Error("Expected no response for ", e.filter)
+            }
+            continue
+        }
+
+        if len(writer.messages) != 1 {
+            t.Error("Expected a single response for ", e.filter)
+            t.Fatal()
+        }
+
+        msg := writer.messages[0]
+        if msg.Rcode != e.rcode {
+            t.Error("Expected ", dns.RcodeToString[e.rcode], " for ", e.filter, ", got ", dns.RcodeToString[msg.Rcode])
+        }
+
+        answer := ""
+        if len(msg.Answer) == 1 {
+            switch rr := msg.Answer[0].(type) {
+            case *dns.A:
+                answer = rr.A.String()
+            case *dns.AAAA:
+                answer = rr.AAAA.String()
+            case *dns.CNAME:
+                answer = rr.Target
+            }
+        } else if len(msg.Answer) > 1 {
+            t.Error("Expected at most one answer for ", e.filter)
+        }
+        if answer != e.answer {
+            t.Error("Expected answer ", e.answer, " for ", e.filter, ", got ", answer)
+        }
+
+        if e.authority != (len(msg.Ns) == 1) {
+            t.Error("Unexpected authority records for ", e.filter, ": ", msg.Ns)
+        }
+
+        extendedError, err := unpackExtendedError(writer.written[0])
+        if err != nil || extendedError == nil || extendedError.Code != e.code {
+            t.Error("Expected extended error ", e.code, " for ", e.filter, ", got ", extendedError, err)
+        }
+    }
+}
+
+func TestFilterNXDomainOutsideZones(t *testing.T) {
+    resolver.etcdPrefix = "TestFilterNXDomainOutsideZones/"
+    client.Set("TestFilterNXDomainOutsideZones/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    defer client.Delete("TestFilterNXDomainOutsideZones/", true)
+
+    filters, _ := parseFilters([]string{"disco.net:", "disco.org:"})
+    handler := newTestHandler(resolver)
+    handler.queryFilterer = NewQueryFilterer(nil, filters)
+
+    // Only names with an SOA are answered authoritatively
+    var expected = []struct {
+        name            string
+        authoritative   bool
+    } {
+        {"foo.disco.net.", true},
+        {"foo.disco.org.", false},
+    }
+
+    for _, e := range expected {
+        query := new(dns.Msg)
+        query.SetQuestion(e.name, dns.TypeA)
+
+        writer := &testResponseWriter{}
+        handler.Handle(writer, query)
+
+        if len(writer.messages) != 1 || writer.messages[0].Rcode != dns.RcodeNameError {
+            t.Error("Expected an NXDOMAIN response for ", e.name, ": ", writer.messages)
+            t.Fatal()
+        }
+
+        msg := writer.messages[0]
+        if msg.Authoritative != e.authoritative || (len(msg.Ns) == 1) != e.authoritative {
+            t.Error("Expected authoritative ", e.authoritative, " for ", e.name, ", got ", msg.Authoritative, msg.Ns)
+        }
+    }
+}
+
+func TestExtendedErrorFor(t *testing.T) {
+    tests := []struct {
+        err     error
+        code    uint16
+        text    string
+    }{
+        {&etcd.EtcdError{ErrorCode: etcdNotReachable}, edeNoReachableAuthority, ""},
+        {&etcd.EtcdError{ErrorCode: 300, Cause: "/net/disco"}, edeNetworkError, "/net/disco"},
+        {&RecordValueError{Message: "Multiple CNAME records is invalid", Key: "/net/disco/.CNAME"}, edeInvalidData, "/net/disco/.CNAME"},
+        {&NodeConversionError{Node: &etcd.Node{Key: "/net/disco/.A/0"}}, edeInvalidData, "/net/disco/.A/0"},
+        {&NameTooLongError{Name: "disco.net."}, edeOther, ""},
+    }
+
+    for _, test := range tests {
+        extendedError := extendedErrorFor(test.err)
+        if extendedError.Code != test.code || extendedError.Text != test.text {
+            t.Error("Unexpected extended error for ", test.err, ": ", extendedError)
+        }
+    }
+}
+
+func TestHandlerANYPolicy(t *testing.T) {
+    _, network, _ := net.ParseCIDR("10.0.0.0/8")
+    handler := newTestHandler(resolver)
+    handler.anyPolicy = anyPolicyHinfo
+    handler.anyFullNetworks = []*net.IPNet{network}
+
+    var expected = []struct {
+        addr    net.Addr
+        policy  string
+    }{
+        {&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 12345}, anyPolicyHinfo},
+        {&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 12345}, anyPolicyFull},
+        {&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 12345}, anyPolicyHinfo}}
+
+    for _, test := range expected {
+        if policy := handler.anyPolicyFor(test.addr); policy != test.policy {
+            t.Error("Expected ", test.policy, " policy for ", test.addr, ": ", policy)
+        }
+    }
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+    "fmt"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// NameCache holds the names read from etcd while answering a single request,
+// so each name is only read once no matter how many record types, fallbacks
+// and negative answers need it.
+type NameCache struct {
+    lock        sync.Mutex
+    names       map[string]*etcd.Node   // nil if nothing is stored for the name
+    dirs        map[string]*etcd.Node   // record directories, by key
+}
+
+// withNameCache returns a copy of the resolver that caches the names it reads,
+// to be used for answering a single request.
+func (r *Resolver) withNameCache() *Resolver {
+    request := *r
+    request.names = &NameCache{
+        names: make(map[string]*etcd.Node),
+        dirs: make(map[string]*etcd.Node)}
+    return &request
+}
+
+// GetNode returns the etcd node for the given name with its immediate children
+// (the record keys and subdomains), but not their children. Returns nil if
+// nothing exists at or beneath the name.
+func (r *Resolver) GetNode(name string) (node *etcd.Node, err error) {
+    name = strings.ToLower(dns.Fqdn(name))
+
+    if r.names != nil {
+        r.names.lock.Lock()
+        cached, ok := r.names.names[name]
+        r.names.lock.Unlock()
+
+        if ok {
+            hit_counter := metrics.GetOrRegisterCounter("resolver.names.cache_hits", metrics.DefaultRegistry)
+            hit_counter.Inc(1)
+            return cached, nil
+        }
+    }
+
+    counter := metrics.GetOrRegisterCounter("resolver.etcd.query_count", metrics.DefaultRegistry)
+    error_counter := metrics.GetOrRegisterCounter("resolver.etcd.query_error_count", metrics.DefaultRegistry)
+
+    key := nameToKey(name, "")
+
+    counter.Inc(1)
+    debugMsg("Querying etcd for " + key)
+
+    // The name is read without recursion, since the subdomains beneath it
+    // could be the entire zone. Only the record directories that are needed
+    // are read later.
+    response, err := r.etcdGet(r.etcdPrefix + key, true, false)
+    if err != nil {
+        if e, ok := err.(*etcd.EtcdError); !ok || e.ErrorCode != 100 {
+            error_counter.Inc(1)
+            return
+        }
+        node, err = nil, nil
+    } else {
+        node = response.Node
+    }
+
+    if r.names != nil {
+        r.names.lock.Lock()
+        r.names.names[name] = node
+        r.names.lock.Unlock()
+    }
+
+    return
+}
+
+// getRecordDir reads a record directory (e.g /net/disco/.A) recursively, or
+// takes it from the request's cache.
+func (r *Resolver) getRecordDir(key string) (node *etcd.Node, err error) {
+    if r.names != nil {
+        r.names.lock.Lock()
+        cached, ok := r.names.dirs[key]
+        r.names.lock.Unlock()
+
+        if ok {
+            hit_counter := metrics.GetOrRegisterCounter("resolver.names.cache_hits", metrics.DefaultRegistry)
+            hit_counter.Inc(1)
+            return cached, nil
+        }
+    }
+
+    counter := metrics.GetOrRegisterCounter("resolver.etcd.query_count", metrics.DefaultRegistry)
+    error_counter := metrics.GetOrRegisterCounter("resolver.etcd.query_error_count", metrics.DefaultRegistry)
+
+    counter.Inc(1)
+    debugMsg("Querying etcd for " + key)
+
+    response, err := r.etcdGet(key, true, true)
+    if err != nil {
+        if e, ok := err.(*etcd.EtcdError); !ok || e.ErrorCode != 100 {
+            error_counter.Inc(1)
+            return
+        }
+        // Removed since the name was read
+        node, err = nil, nil
+    } else {
+        node = response.Node
+    }
+
+    if r.names != nil {
+        r.names.lock.Lock()
+        r.names.dirs[key] = node
+        r.names.lock.Unlock()
+    }
+
+    return
+}
+
+// etcdGet reads a key from etcd, sharing the response of any identical read
+// that's already in flight.
+func (r *Resolver) etcdGet(key string, sort bool, recursive bool) (*etcd.Response, error) {
+    if r.expired() {
+        return nil, ErrDeadlineExceeded
+    }
+
+    if r.coalescer == nil {
+        return r.cancelableGet(key, sort, recursive, r.cancel)
+    }
+
+    // The shared read has its own timeout, so it's not cut short when the
+    // request that started it gives up
+    read := func(cancel <-chan bool) (*etcd.Response, error) {
+        return r.cancelableGet(key, sort, recursive, cancel)
+    }
+
+    return r.coalescer.Do(fmt.Sprintf("%s?sorted=%t&recursive=%t", key, sort, recursive), read, r.cancel)
+}
+
+// recordsFromNode returns the records stored beneath the node of a name with
+// the given key segment (e.g .A for /net/disco/.A or /net/disco/.A/0). Only
+// the record directory for the segment is read, the rest are left alone.
+func (r *Resolver) recordsFromNode(node *etcd.Node, segment string) (records []*EtcdRecord, err error) {
+    if node == nil || !node.Dir {
+        return
+    }
+
+    var valueNode, ttlNode *etcd.Node
+    for _, child := range node.Nodes {
+        switch child.Key[strings.LastIndex(child.Key, "/") + 1:] {
+        case segment:
+            valueNode = child
+        case segment + ".ttl":
+            ttlNode = child
+        }
+    }
+
+    if valueNode == nil {
+        return
+    }
+
+    if valueNode.Dir && len(valueNode.Nodes) == 0 {
+        valueNode, err = r.getRecordDir(valueNode.Key)
+        if valueNode == nil || err != nil {
+            return
+        }
+    }
+
+    ttl := r.defaultTtl
+    if ttlNode != nil && !valueNode.Dir {
+        ttlValue, err := strconv.ParseUint(ttlNode.Value, 10, 32)
+        if err != nil {
+            debugMsg("Unable to convert ttl value to int: ", ttlNode.Value)
+        } else {
+            ttl = uint32(ttlValue)
+        }
+    }
+
+    return r.collectRecords(valueNode, ttl), nil
+}
+
+// collectRecords returns the records stored at the given node, pairing any
+// values in a directory with the .ttl keys that follow them.
+func (r *Resolver) collectRecords(node *etcd.Node, ttl uint32) (records []*EtcdRecord) {
+    records = make([]*EtcdRecord, 0)
+
+    if node.Dir == true {
+        var lastValNode *etcd.Node
+        for _, node := range node.Nodes {
+
+            if strings.HasSuffix(node.Key, ".ttl") {
+                ttlValue, err := strconv.ParseUint(node.Value, 10, 32)
+                if err != nil {
+                    debugMsg("Unable to convert ttl value to int: ", node.Value)
+                } else if lastValNode == nil {
+                    debugMsg(".ttl node with no matching value node: ", node.Key)
+                } else {
+                    records = append(records, r.collectRecords(lastValNode, uint32(ttlValue))...)
+                    lastValNode = nil
+                    continue
+                }
+            } else {
+                if lastValNode != nil {
+                    records = append(records, r.collectRecords(lastValNode, r.defaultTtl)...)
+                }
+                lastValNode = node
+            }
+        }
+
+        if lastValNode != nil {
+            records = append(records, r.collectRecords(lastValNode, r.defaultTtl)...)
+        }
+
+        return
+    }
+
+    // If for some reason this is passed a ttl node unexpectedly, bail
+    if strings.HasSuffix(node.Key, ".ttl") {
+        debugMsg("Unexpected .ttl node", node.Key)
+        return
+    }
+
+    comment := ""
+    if metadata := decodeMetadata(node); metadata != nil {
+        if metadata.Disabled {
+            debugMsg("Skipping disabled record ", node.Key)
+            return
+        }
+
+        if metadata.Ttl != nil {
+            ttl = *metadata.Ttl
+        }
+
+        comment = metadata.Comment
+    }
+
+    return append(records, &EtcdRecord{node, ttl, comment})
+}
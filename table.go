@@ -0,0 +1,86 @@
+package main
+
+import (
+    "container/list"
+    "time"
+)
+
+// bucketTable holds the rate limiting buckets, keyed by client (or network and
+// response), up to a maximum number of entries. Entries are kept in the order
+// they were last used, so the idle ones can be expired without looking at
+// every entry, and the least recently used entry is evicted to make room when
+// the table is full. Without a limit on its size, a flood of queries from
+// spoofed addresses (or for random names) would grow the table forever.
+type bucketTable struct {
+    max             int
+    entries         map[string]*list.Element
+    order           *list.List  // Most recently used first
+}
+
+type tableEntry struct {
+    key             string
+    value           interface{}
+    used            time.Time
+}
+
+// newBucketTable returns a table holding at most max entries, or any number if
+// max is zero
+func newBucketTable(max int) *bucketTable {
+    return &bucketTable{
+        max: max,
+        entries: make(map[string]*list.Element),
+        order: list.New()}
+}
+
+// Get returns the value for the key, marking it as used now
+func (t *bucketTable) Get(key string, now time.Time) (value interface{}, ok bool) {
+    element, ok := t.entries[key]
+    if !ok {
+        return nil, false
+    }
+
+    entry := element.Value.(*tableEntry)
+    entry.used = now
+    t.order.MoveToFront(element)
+
+    return entry.value, true
+}
+
+// Add adds a value for a key that isn't in the table, evicting the least
+// recently used entry if the table is full. Evicted is true if an entry was
+// evicted.
+func (t *bucketTable) Add(key string, value interface{}, now time.Time) (evicted bool) {
+    if t.max > 0 && len(t.entries) >= t.max {
+        if oldest := t.order.Back(); oldest != nil {
+            t.remove(oldest)
+            evicted = true
+        }
+    }
+
+    t.entries[key] = t.order.PushFront(&tableEntry{key, value, now})
+    return
+}
+
+// Expire removes the entries that haven't been used since the given time
+func (t *bucketTable) Expire(before time.Time) {
+    for oldest := t.order.Back(); oldest != nil && oldest.Value.(*tableEntry).used.Before(before); oldest = t.order.Back() {
+        t.remove(oldest)
+    }
+}
+
+// Each calls f for every value in the table, most recently used first
+func (t *bucketTable) Each(f func(key string, value interface{})) {
+    for element := t.order.Front(); element != nil; element = element.Next() {
+        entry := element.Value.(*tableEntry)
+        f(entry.key, entry.value)
+    }
+}
+
+func (t *bucketTable) Len() int {
+    return len(t.entries)
+}
+
+func (t *bucketTable) remove(element *list.Element) {
+    delete(t.entries, element.Value.(*tableEntry).key)
+    t.order.Remove(element)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "strings"
+)
+
+// RecordMetadata holds the optional fields that can be attached to any record
+// stored as a structured JSON object, for example...
+//
+//  {"address": "10.1.1.1", "ttl": 60, "comment": "Primary web server"}
+type RecordMetadata struct {
+    Ttl         *uint32     `json:"ttl"`
+    Disabled    bool        `json:"disabled"`
+    Comment     string      `json:"comment"`
+}
+
+// isJSONObject returns true if the given node's value should be decoded as a
+// structured JSON object rather than a plain (tab-separated) string. Values
+// that aren't valid JSON objects are always taken literally. TXT records may
+// well contain JSON text of their own, so they're only structured when the
+// object has a "text" field.
+func isJSONObject(node *etcd.Node) bool {
+    value := strings.TrimSpace(node.Value)
+    if !strings.HasPrefix(value, "{") {
+        return false
+    }
+
+    fields := make(map[string]json.RawMessage)
+    if err := json.Unmarshal([]byte(value), &fields); err != nil {
+        return false
+    }
+
+    if strings.Contains(node.Key + "/", "/.TXT/") {
+        _, ok := fields["text"]
+        return ok
+    }
+
+    return true
+}
+
+// decodeJSONValue decodes the JSON object stored in the given node into v,
+// returning a NodeConversionError if the value isn't valid.
+func decodeJSONValue(node *etcd.Node, rrType uint16, v interface{}) (err error) {
+    err = json.Unmarshal([]byte(node.Value), v)
+    if err != nil {
+        err = &NodeConversionError{
+            Node: node,
+            Message: fmt.Sprintf("Failed to decode JSON value: %s", err),
+            AttemptedType: rrType}
+    }
+
+    return
+}
+
+// decodeMetadata returns the common metadata fields for the given node, or nil
+// if the node isn't a structured record.
+func decodeMetadata(node *etcd.Node) (metadata *RecordMetadata) {
+    if !isJSONObject(node) {
+        return
+    }
+
+    metadata = new(RecordMetadata)
+    err := json.Unmarshal([]byte(node.Value), metadata)
+    if err != nil {
+        // Leave it to the converter to report the invalid value
+        debugMsg("Unable to decode record metadata for ", node.Key, ": ", err)
+        return nil
+    }
+
+    return
+}
+
+// stringValue returns the value of a node for record types that only need a
+// single string. Structured records provide this string with the given field.
+func stringValue(node *etcd.Node, rrType uint16, field string) (value string, err error) {
+    if !isJSONObject(node) {
+        return node.Value, nil
+    }
+
+    fields := make(map[string]interface{})
+    err = decodeJSONValue(node, rrType, &fields)
+    if err != nil {
+        return
+    }
+
+    value, ok := fields[field].(string)
+    if !ok {
+        err = &NodeConversionError{
+            Node: node,
+            Message: fmt.Sprintf("Expected a string '%s' field in JSON value", field),
+            AttemptedType: rrType}
+    }
+
+    return
+}
+
+// The maximum length of a single character-string within a TXT record
+const maxTxtStringLength = 255
+
+// txtStrings returns the character-strings for a TXT record stored in the given
+// node. A structured value may explicitly list its strings as an array in the
+// "text" field, otherwise the whole value is used as a single string. Any
+// strings longer than 255 bytes are split up.
+func txtStrings(node *etcd.Node) (txt []string, err error) {
+    segments := []string{node.Value}
+
+    if isJSONObject(node) {
+        var value struct {
+            Text    json.RawMessage `json:"text"`
+        }
+
+        err = decodeJSONValue(node, dns.TypeTXT, &value)
+        if err != nil {
+            return
+        }
+
+        segments, err = decodeTxtSegments(value.Text)
+        if err != nil || len(segments) == 0 {
+            err = &NodeConversionError{
+                Node: node,
+                Message: "Expected a string or array of strings 'text' field in JSON value",
+                AttemptedType: dns.TypeTXT}
+            return
+        }
+    }
+
+    txt = make([]string, 0, len(segments))
+    for _, segment := range segments {
+        txt = append(txt, splitTxtString(segment)...)
+    }
+
+    return
+}
+
+// decodeTxtSegments decodes a JSON string, or array of strings
+func decodeTxtSegments(raw json.RawMessage) (segments []string, err error) {
+    var text string
+    if err = json.Unmarshal(raw, &text); err == nil {
+        return []string{text}, nil
+    }
+
+    err = json.Unmarshal(raw, &segments)
+    return
+}
+
+// splitTxtString splits a string into chunks no longer than the maximum length
+// of a TXT character-string.
+func splitTxtString(value string) (chunks []string) {
+    chunks = make([]string, 0, len(value) / maxTxtStringLength + 1)
+    for len(value) > maxTxtStringLength {
+        chunks = append(chunks, value[:maxTxtStringLength])
+        value = value[maxTxtStringLength:]
+    }
+
+    return append(chunks, value)
+}
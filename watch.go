@@ -0,0 +1,43 @@
+package main
+
+import (
+    "github.com/coreos/go-etcd/etcd"
+    "time"
+)
+
+// watchEtcd keeps some state in sync with everything beneath an etcd prefix,
+// until the stop channel is closed. The build function is called to load the
+// state, returning the etcd index it reflects, and apply is then called with
+// every change after that index. If the watch fails for any reason (e.g the
+// index has been cleared from etcd's history) the state is built again.
+func watchEtcd(client *etcd.Client, prefix string, build func() (uint64, error), apply func(*etcd.Response), stop chan bool) {
+    for {
+        etcdIndex, err := build()
+        if err == nil {
+            receiver := make(chan *etcd.Response)
+            errors := make(chan error, 1)
+
+            go func() {
+                _, err := client.Watch(prefix, etcdIndex + 1, true, receiver, stop)
+                errors <- err
+            }()
+
+            for response := range receiver {
+                apply(response)
+            }
+
+            err = <-errors
+        }
+
+        if err == etcd.ErrWatchStoppedByUser {
+            return
+        }
+
+        logger.Printf("[WARNING] Lost track of changes to %s, reloading: %s", prefix, err)
+        select {
+        case <-stop:
+            return
+        case <-time.After(time.Second):
+        }
+    }
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "github.com/rcrowley/go-metrics"
+    "strings"
+)
+
+// ClosestEncloser returns the closest existing ancestor of the given name (or
+// the name itself, in which case exact is true), along with its etcd node.
+// Names exist if there are any records at or beneath them (RFC 4592 2.2).
+func (r *Resolver) ClosestEncloser(name string) (encloser string, node *etcd.Node, exact bool, err error) {
+    labels := dns.SplitDomainName(strings.ToLower(dns.Fqdn(name)))
+
+    for i := 0; i <= len(labels); i++ {
+        encloser = dns.Fqdn(strings.Join(labels[i:], "."))
+
+        node, err = r.GetNode(encloser)
+        if err != nil || node != nil {
+            return encloser, node, i == 0, err
+        }
+    }
+
+    return
+}
+
+// isDelegation returns true if the given node is a zone cut, with NS records
+// but no SOA record.
+func isDelegation(node *etcd.Node) bool {
+    delegated := false
+    for _, child := range node.Nodes {
+        if strings.HasSuffix(child.Key, "/.SOA") {
+            return false
+        } else if strings.HasSuffix(child.Key, "/.NS") {
+            delegated = true
+        }
+    }
+
+    return delegated
+}
+
+// AnswerWildcard answers a question for a name without any records of the
+// requested type, following the rules of RFC 4592. A wildcard is only used
+// when the name doesn't exist at all, and only the wildcard immediately beneath
+// the closest encloser of the name is considered (unless that's a zone cut).
+//
+// A CNAME record synthesized from a wildcard is followed, with the answers for
+// its target returned as chased. The exists flag is true when the name (or the
+// matching wildcard) exists without records of the requested type.
+func (r *Resolver) AnswerWildcard(q dns.Question, anyPolicy string) (answers []dns.RR, chased []dns.RR, exists bool, err error) {
+    encloser, node, exact, err := r.ClosestEncloser(q.Name)
+    if err != nil || node == nil {
+        return
+    }
+
+    if exact {
+        return nil, nil, true, nil
+    }
+
+    if isDelegation(node) {
+        debugMsg("Not using wildcards beneath zone cut ", encloser)
+        return
+    }
+
+    // Only bother asking for records if the wildcard exists
+    source := dns.Fqdn("*." + strings.TrimSuffix(encloser, "."))
+    for _, child := range node.Nodes {
+        if strings.HasSuffix(child.Key, "/*") {
+            exists = true
+        }
+    }
+
+    if !exists {
+        return
+    }
+
+    counter := metrics.GetOrRegisterCounter("resolver.answers.wildcard", metrics.DefaultRegistry)
+    counter.Inc(1)
+
+    answers, err = r.AnswerTarget(source, q, anyPolicy)
+    if err != nil {
+        return nil, nil, false, err
+    }
+
+    if len(answers) == 1 && q.Qtype != dns.TypeCNAME {
+        if cname, ok := answers[0].(*dns.CNAME); ok && r.inZone(cname.Target) {
+            chased, err = r.AnswerTarget(cname.Target, q, anyPolicy)
+        }
+    }
+
+    return
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+    "errors"
+    "github.com/coreos/go-etcd/etcd"
+    "github.com/miekg/dns"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// ErrZonesNotReady is the failure for queries received before the zones have
+// been discovered, when we can't tell whether a name is ours
+var ErrZonesNotReady = errors.New("Zones haven't been discovered from etcd yet")
+
+// ZoneList is the set of zones served by discodns. Zones are either configured
+// up front, or discovered from the SOA records stored in etcd (and kept up to
+// date with an etcd watch). Besides refusing queries for other names, the list
+// bounds the search for SOA and DNAME records, decides whether DNAME, ALIAS
+// and wildcard CNAME targets are looked for in etcd, and limits the records
+// in the reverse index.
+type ZoneList struct {
+    etcd        *etcd.Client
+    etcdPrefix  string
+
+    lock        sync.RWMutex
+    zones       map[string]bool
+    ready       bool        // False until the zones have been discovered
+    stop        chan bool
+}
+
+// NewZoneList returns a fixed list of zones
+func NewZoneList(zones []string) *ZoneList {
+    list := &ZoneList{zones: make(map[string]bool), ready: true}
+    for _, zone := range zones {
+        list.zones[strings.ToLower(dns.Fqdn(zone))] = true
+    }
+
+    return list
+}
+
+// NewDiscoveredZoneList returns a list of zones which is populated from the SOA
+// records stored beneath the etcd prefix, once Start is called.
+func NewDiscoveredZoneList(client *etcd.Client, etcdPrefix string) *ZoneList {
+    return &ZoneList{
+        etcd: client,
+        etcdPrefix: "/" + strings.Trim(etcdPrefix, "/"),
+        zones: make(map[string]bool),
+        stop: make(chan bool)}
+}
+
+// Start discovers zones and watches etcd for changes in the background. This
+// has no effect on a fixed list of zones.
+func (z *ZoneList) Start() {
+    if z.etcd != nil {
+        go watchEtcd(z.etcd, z.etcdPrefix, z.Discover, z.apply, z.stop)
+    }
+}
+
+// Stop stops watching etcd for changes
+func (z *ZoneList) Stop() {
+    if z.stop != nil {
+        close(z.stop)
+    }
+}
+
+// Discover replaces the list with the owner of every SOA record stored beneath
+// the etcd prefix, returning the etcd index of the data.
+func (z *ZoneList) Discover() (etcdIndex uint64, err error) {
+    zones := make(map[string]bool)
+
+    response, err := z.etcd.Get(z.etcdPrefix, false, true)
+    if err != nil {
+        if e, ok := err.(*etcd.EtcdError); ok {
+            if e.ErrorCode == 100 {
+                etcdIndex, err = e.Index, nil
+            }
+        }
+    } else {
+        etcdIndex = response.EtcdIndex
+
+        var findZones func(node *etcd.Node)
+        findZones = func(node *etcd.Node) {
+            for _, child := range node.Nodes {
+                if zone, ok := z.zoneForKey(child.Key); ok {
+                    zones[zone] = true
+                } else if child.Dir && !isRecordKey(child.Key) {
+                    findZones(child)
+                }
+            }
+        }
+
+        findZones(response.Node)
+    }
+
+    if err != nil {
+        return
+    }
+
+    z.lock.Lock()
+    z.zones = zones
+    z.ready = true
+    z.lock.Unlock()
+
+    debugMsg("Discovered zones ", z.Zones())
+    return
+}
+
+// apply updates the list with a single change from etcd
+func (z *ZoneList) apply(response *etcd.Response) {
+    key := response.Node.Key
+    deleted := false
+    switch response.Action {
+    case "delete", "expire", "compareAndDelete":
+        deleted = true
+    }
+
+    z.lock.Lock()
+    defer z.lock.Unlock()
+
+    if zone, ok := z.zoneForKey(key); ok {
+        if deleted {
+            delete(z.zones, zone)
+        } else {
+            z.zones[zone] = true
+        }
+    } else if deleted && response.Node.Dir {
+        // Remove any zones beneath a deleted directory
+        for zone, _ := range z.zones {
+            zoneKey := strings.TrimSuffix(z.etcdPrefix, "/") + nameToKey(zone, "")
+            if zoneKey == key || strings.HasPrefix(zoneKey, key + "/") {
+                delete(z.zones, zone)
+            }
+        }
+    }
+}
+
+// zoneForKey returns the name of the zone if the key is an SOA record, for
+// example /net/disco/.SOA is the SOA record for disco.net.
+func (z *ZoneList) zoneForKey(key string) (zone string, ok bool) {
+    prefix := strings.TrimSuffix(z.etcdPrefix, "/")
+    if !strings.HasSuffix(key, "/.SOA") || !strings.HasPrefix(key, prefix + "/") {
+        return
+    }
+
+    segments := strings.Split(strings.Trim(key[len(prefix):len(key) - len("/.SOA")], "/"), "/")
+    labels := make([]string, 0, len(segments))
+    for i := len(segments) - 1; i >= 0; i-- {
+        if len(segments[i]) > 0 {
+            labels = append(labels, segments[i])
+        }
+    }
+
+    return dns.Fqdn(strings.Join(labels, ".")), true
+}
+
+// Discovered returns true if the zones are discovered from etcd, rather than
+// configured up front
+func (z *ZoneList) Discovered() bool {
+    return z.etcd != nil
+}
+
+// Ready returns true once the zones are known, which is straight away for a
+// fixed list and after the first successful discovery otherwise. Until then
+// the list is empty, but that doesn't mean we serve no zones.
+func (z *ZoneList) Ready() bool {
+    z.lock.RLock()
+    defer z.lock.RUnlock()
+
+    return z.ready
+}
+
+// Zones returns the names of every zone in the list, sorted
+func (z *ZoneList) Zones() (zones []string) {
+    z.lock.RLock()
+    defer z.lock.RUnlock()
+
+    zones = make([]string, 0, len(z.zones))
+    for zone, _ := range z.zones {
+        zones = append(zones, zone)
+    }
+
+    sort.Strings(zones)
+    return
+}
+
+// ZoneFor returns the most specific zone that the given name belongs to
+func (z *ZoneList) ZoneFor(name string) (zone string, ok bool) {
+    name = strings.ToLower(dns.Fqdn(name))
+
+    z.lock.RLock()
+    defer z.lock.RUnlock()
+
+    labels := dns.SplitDomainName(name)
+    for i := 0; i <= len(labels); i++ {
+        zone = dns.Fqdn(strings.Join(labels[i:], "."))
+        if z.zones[zone] {
+            return zone, true
+        }
+    }
+
+    return "", false
+}
+
+// Contains returns true if the given name belongs to any zone in the list
+func (z *ZoneList) Contains(name string) bool {
+    _, ok := z.ZoneFor(name)
+    return ok
+}
+
+// inZone returns true if the given name belongs to one of the zones we serve,
+// which could be any name if we don't know the zones. Names outside of them
+// aren't worth looking for in etcd.
+func (r *Resolver) inZone(name string) bool {
+    return r.zones == nil || r.zones.Contains(name)
+}
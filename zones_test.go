@@ -0,0 +1,192 @@
+package main
+
+import (
+    "github.com/miekg/dns"
+    "testing"
+    "time"
+)
+
+func TestZoneListConfigured(t *testing.T) {
+    zones := NewZoneList([]string{"disco.net", "Child.Disco.NET.", "in-addr.arpa."})
+
+    var expected = map[string]string {
+        "disco.net.": "disco.net.",
+        "foo.disco.net.": "disco.net.",
+        "foo.child.disco.net.": "child.disco.net.",
+        "4.3.2.1.in-addr.arpa.": "in-addr.arpa.",
+        "FOO.DISCO.NET": "disco.net."}
+
+    for name, zone := range expected {
+        found, ok := zones.ZoneFor(name)
+        if !ok || found != zone {
+            t.Error("Expected zone " + zone + " for " + name + ": ", found)
+        }
+    }
+
+    for _, name := range []string{"net.", "xdisco.net.", "google.com.", "."} {
+        if zones.Contains(name) {
+            t.Error("Didn't expect " + name + " to be contained in any zone")
+        }
+    }
+}
+
+func TestZoneListDiscover(t *testing.T) {
+    client.Delete("TestZoneListDiscover/", true)
+    defer client.Delete("TestZoneListDiscover/", true)
+    client.Set("TestZoneListDiscover/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    client.Set("TestZoneListDiscover/net/disco/child/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    client.Set("TestZoneListDiscover/net/disco/foo/.A", "1.2.3.4", 0)
+
+    zones := NewDiscoveredZoneList(client, "TestZoneListDiscover/")
+    zones.Start()
+    defer zones.Stop()
+
+    waitForZones := func(count int) []string {
+        var found []string
+        for attempt := 0; attempt < 50; attempt++ {
+            found = zones.Zones()
+            if len(found) == count {
+                break
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+        return found
+    }
+
+    found := waitForZones(2)
+    if len(found) != 2 || found[0] != "child.disco.net." || found[1] != "disco.net." {
+        t.Error("Expected child.disco.net. and disco.net. zones: ", found)
+        t.Fatal()
+    }
+
+    client.Set("TestZoneListDiscover/com/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    if found = waitForZones(3); !zones.Contains("foo.disco.com.") {
+        t.Error("Expected disco.com. to be discovered: ", found)
+        t.Fatal()
+    }
+
+    client.Delete("TestZoneListDiscover/net/disco/child", true)
+    if found = waitForZones(2); len(found) != 2 || found[0] != "disco.com." {
+        t.Error("Expected child.disco.net. to be removed: ", found)
+        t.Fatal()
+    }
+}
+
+func TestLookupBeforeZonesDiscovered(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupBeforeZonesDiscovered/"
+    client.Set("TestLookupBeforeZonesDiscovered/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    client.Set("TestLookupBeforeZonesDiscovered/net/disco/foo/.A", "1.2.3.4", 0)
+
+    zones := NewDiscoveredZoneList(client, "TestLookupBeforeZonesDiscovered/")
+    resolver.zones = zones
+    defer func() { resolver.zones = nil }()
+
+    // Nothing is refused until we know which zones are ours
+    query := new(dns.Msg)
+    query.SetQuestion("foo.disco.net.", dns.TypeA)
+    answer, extendedError := resolver.LookupWithError(query, anyPolicyFull)
+
+    if answer.Rcode != dns.RcodeServerFailure || answer.Authoritative {
+        t.Error("Expected a non-authoritative SERVFAIL response, got ", answer)
+    }
+    if extendedError == nil || extendedError.Code != edeNotReady {
+        t.Error("Expected a Not Ready extended error, got ", extendedError)
+    }
+
+    if _, err := zones.Discover(); err != nil {
+        t.Error("Unexpected error discovering zones: ", err)
+        t.Fatal()
+    }
+
+    answer, _ = resolver.LookupWithError(query, anyPolicyFull)
+    if answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 1 {
+        t.Error("Expected an answer once the zones are discovered, got ", answer)
+    }
+
+    query.SetQuestion("google.com.", dns.TypeA)
+    if answer, _ = resolver.LookupWithError(query, anyPolicyFull); answer.Rcode != dns.RcodeRefused {
+        t.Error("Expected names outside of the zones to be refused, got ", dns.RcodeToString[answer.Rcode])
+    }
+}
+
+func TestLookupRefusedOutsideZones(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupRefusedOutsideZones/"
+    client.Set("TestLookupRefusedOutsideZones/net/disco/foo/.A", "1.2.3.4", 0)
+    client.Set("TestLookupRefusedOutsideZones/com/google/.A", "1.2.3.5", 0)
+
+    resolver.zones = NewZoneList([]string{"disco.net."})
+    defer func() { resolver.zones = nil }()
+
+    query := new(dns.Msg)
+    query.SetQuestion("foo.disco.net.", dns.TypeA)
+    answer := resolver.Lookup(query)
+
+    if answer.Rcode != dns.RcodeSuccess || len(answer.Answer) != 1 {
+        t.Error("Expected one answer for foo.disco.net.: ", answer)
+        t.Fatal()
+    }
+
+    query.SetQuestion("google.com.", dns.TypeA)
+    answer = resolver.Lookup(query)
+
+    if answer.Rcode != dns.RcodeRefused {
+        t.Error("Expected REFUSED response code, got", dns.RcodeToString[answer.Rcode])
+        t.Fatal()
+    }
+
+    if len(answer.Answer) != 0 || answer.Authoritative {
+        t.Error("Expected a non-authoritative response without answers: ", answer)
+        t.Fatal()
+    }
+}
+
+func TestLookupWithinZones(t *testing.T) {
+    resolver.etcdPrefix = "TestLookupWithinZones/"
+    client.Set("TestLookupWithinZones/.SOA", "ns1.root.\tadmin.root.\t3600\t600\t86400\t10", 0)
+    client.Set("TestLookupWithinZones/net/disco/.SOA", "ns1.disco.net.\tadmin.disco.net.\t3600\t600\t86400\t10", 0)
+    client.Set("TestLookupWithinZones/net/disco/.ALIAS", "lb.disco.org.", 0)
+    client.Set("TestLookupWithinZones/net/disco/old/.DNAME", "new.disco.org.", 0)
+    client.Set("TestLookupWithinZones/org/disco/lb/.A", "1.2.3.4", 0)
+    client.Set("TestLookupWithinZones/org/disco/new/foo/.A", "1.2.3.5", 0)
+
+    resolver.zones = NewZoneList([]string{"disco.net."})
+    defer func() { resolver.zones = nil }()
+
+    // The SOA is looked for no higher than the apex of the zone
+    soa := resolver.Authority("foo.bar.disco.net.")
+    if soa == nil || soa.Header().Name != "disco.net." {
+        t.Error("Expected the SOA of disco.net.: ", soa)
+    }
+
+    resolver.zones = NewZoneList([]string{"bar.disco.net."})
+    if soa := resolver.Authority("foo.bar.disco.net."); soa != nil {
+        t.Error("Didn't expect an SOA above the apex of the zone: ", soa)
+    }
+
+    // Targets outside of the zones aren't looked for in etcd
+    resolver.zones = NewZoneList([]string{"disco.net."})
+
+    query := new(dns.Msg)
+    query.SetQuestion("disco.net.", dns.TypeA)
+    if answer := resolver.Lookup(query); len(answer.Answer) != 0 {
+        t.Error("Didn't expect the ALIAS target to be resolved from etcd: ", answer.Answer)
+    }
+
+    query.SetQuestion("foo.old.disco.net.", dns.TypeA)
+    if answer := resolver.Lookup(query); len(answer.Answer) != 2 {
+        t.Error("Expected only the DNAME and CNAME records: ", answer.Answer)
+    }
+
+    // Without any zones, everything in etcd is fair game
+    resolver.zones = nil
+
+    query.SetQuestion("disco.net.", dns.TypeA)
+    if answer := resolver.Lookup(query); len(answer.Answer) != 1 {
+        t.Error("Expected the ALIAS target to be resolved from etcd: ", answer.Answer)
+    }
+
+    query.SetQuestion("foo.old.disco.net.", dns.TypeA)
+    if answer := resolver.Lookup(query); len(answer.Answer) != 3 {
+        t.Error("Expected the DNAME target to be resolved from etcd: ", answer.Answer)
+    }
+}